@@ -7,27 +7,23 @@ import (
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/workspace/the-crypto-project/cmd/utils"
+	"github.com/workspace/the-crypto-project/config"
 	blockchain "github.com/workspace/the-crypto-project/core"
 	jsonrpc "github.com/workspace/the-crypto-project/json-rpc"
 	"github.com/workspace/the-crypto-project/p2p"
-	"github.com/workspace/the-crypto-project/util/env"
+	"github.com/workspace/the-crypto-project/util/datadir"
 )
 
 func main() {
 	defer os.Exit(0)
-	var conf = env.New()
+	// The flags are bound to the settings they override
+	var conf = config.Default()
 	var address string
-	var instanceId string
-	
-	var rpcPort string
-	var rpcAddr string
-	var rpc bool
 
-    
 	cli := utils.CommandLine{
 		Blockchain: &blockchain.Blockchain{
 			Database:   nil,
-			InstanceId: instanceId,
+			InstanceId: conf.InstanceId,
 		},
 		P2p: nil,
 	}
@@ -41,10 +37,12 @@ func main() {
 		Args:  cobra.MinimumNArgs(0),
 		Run: func(cmd *cobra.Command, args []string) {
 
-			cli := cli.UpdateInstance(instanceId, true)
-			cli.CreateBlockchain(address)
+			cli := cli.UpdateInstance(conf.InstanceId, true)
+			cli.CreateBlockchain(address, conf.Storage.TxIndex, conf.Storage.AddrIndex)
 		},
 	}
+	initCmd.Flags().BoolVar(&conf.Storage.TxIndex, "txindex", conf.Storage.TxIndex, "Keep an index of all transactions for lookups by id")
+	initCmd.Flags().BoolVar(&conf.Storage.AddrIndex, "addrindex", conf.Storage.AddrIndex, "Keep an index of the transactions of every address")
 
 	/*
 	* WALLET COMMAND
@@ -74,11 +72,22 @@ func main() {
 		Use:   "balance",
 		Short: "Get the address balance",
 		Run: func(cmd *cobra.Command, args []string) {
-			cli := cli.UpdateInstance(instanceId, true)
+			cli := cli.UpdateInstance(conf.InstanceId, true)
 			cli.GetBalance(address)
 		},
 	}
-	walletCmd.AddCommand(newWalletCmd, listWalletAddressCmd, walletBalanceCmd)
+	var skip, limit int
+	var walletHistoryCmd = &cobra.Command{
+		Use:   "history",
+		Short: "List the transactions of an address, newest first",
+		Run: func(cmd *cobra.Command, args []string) {
+			cli := cli.UpdateInstance(conf.InstanceId, true)
+			cli.PrintAddressHistory(address, skip, limit)
+		},
+	}
+	walletHistoryCmd.Flags().IntVar(&skip, "skip", 0, "Number of transactions to skip")
+	walletHistoryCmd.Flags().IntVar(&limit, "limit", blockchain.DefaultAddressPageSize, "Number of transactions to show")
+	walletCmd.AddCommand(newWalletCmd, listWalletAddressCmd, walletBalanceCmd, walletHistoryCmd)
 
 	/*
 	* UTXOS COMMAND
@@ -88,11 +97,69 @@ func main() {
 		Short: "Re-build and Compute Unspent transaction outputs",
 		Args:  cobra.MinimumNArgs(0),
 		Run: func(cmd *cobra.Command, args []string) {
-			cli := cli.UpdateInstance(instanceId, true)
+			cli := cli.UpdateInstance(conf.InstanceId, true)
 			cli.ComputeUTXOs()
 		},
 	}
 	/*
+	* REINDEX COMMAND
+	 */
+	var reindexTx, reindexAddr bool
+	var reindexCmd = &cobra.Command{
+		Use:   "reindex",
+		Short: "Build the transaction and address indexes and keep them up to date from now on",
+		Args:  cobra.MinimumNArgs(0),
+		Run: func(cmd *cobra.Command, args []string) {
+			cli := cli.UpdateInstance(conf.InstanceId, true)
+			cli.Reindex(reindexTx, reindexAddr)
+		},
+	}
+	reindexCmd.Flags().BoolVar(&reindexTx, "txindex", true, "Build the transaction index")
+	reindexCmd.Flags().BoolVar(&reindexAddr, "addrindex", true, "Build the address index")
+	/*
+	* VERIFYCHAIN COMMAND
+	 */
+	var verifyDepth, verifyLevel int
+	var verifyRepair bool
+	var verifyChainCmd = &cobra.Command{
+		Use:   "verifychain",
+		Short: "Check the blocks, the UTXO set and the undo records of the database",
+		Args:  cobra.MinimumNArgs(0),
+		Run: func(cmd *cobra.Command, args []string) {
+			cli := cli.UpdateInstance(conf.InstanceId, true)
+			cli.VerifyChain(verifyDepth, verifyLevel, verifyRepair)
+		},
+	}
+	verifyChainCmd.Flags().IntVar(&verifyDepth, "depth", 0, "Number of blocks to check from the tip, 0 checks them all")
+	verifyChainCmd.Flags().IntVar(&verifyLevel, "level", blockchain.VerifyUTXOSet, "0 linkage and heights, 1 proof of work and merkle roots, 2 transactions and signatures, 3 UTXO set and undo records")
+	verifyChainCmd.Flags().BoolVar(&verifyRepair, "repair", false, "Roll back to the last good block and rebuild the UTXO set and indexes")
+	/*
+	* MIGRATE COMMAND
+	 */
+	var migrateDryRun bool
+	var migrateCmd = &cobra.Command{
+		Use:   "migrate",
+		Short: "Upgrade the database to the schema version of this node",
+		Args:  cobra.MinimumNArgs(0),
+		Run: func(cmd *cobra.Command, args []string) {
+			cli.Migrate(conf.InstanceId, migrateDryRun)
+		},
+	}
+	migrateCmd.Flags().BoolVar(&migrateDryRun, "dry-run", false, "Show the migrations that would run without writing anything")
+	/*
+	* IMPORT COMMAND
+	 */
+	var importFrom string
+	var importCmd = &cobra.Command{
+		Use:   "import",
+		Short: "Copy the chain and wallets of an earlier version into the data directory",
+		Args:  cobra.MinimumNArgs(0),
+		Run: func(cmd *cobra.Command, args []string) {
+			cli.ImportLegacy(conf.InstanceId, importFrom)
+		},
+	}
+	importCmd.Flags().StringVar(&importFrom, "from", datadir.DefaultLegacyDir, "Directory the earlier version wrote to, tmp/ of the checkout it ran from")
+	/*
 	* PRINT COMMAND
 	 */
 	var printCmd = &cobra.Command{
@@ -100,41 +167,57 @@ func main() {
 		Short: "Print the blocks in the blockchain",
 		Args:  cobra.MinimumNArgs(0),
 		Run: func(cmd *cobra.Command, args []string) {
-			cli := cli.UpdateInstance(instanceId, true)
+			cli := cli.UpdateInstance(conf.InstanceId, true)
 			cli.PrintBlockchain()
 		},
 	}
 
+	/*
+	* SUPPLY COMMAND
+	 */
+	var supplyCmd = &cobra.Command{
+		Use:   "supply",
+		Short: "Show the token supply and the subsidy schedule",
+		Args:  cobra.MinimumNArgs(0),
+		Run: func(cmd *cobra.Command, args []string) {
+			cli := cli.UpdateInstance(conf.InstanceId, true)
+			cli.GetSupplyInfo()
+		},
+	}
+
 	/*
 	* NODE COMMAND
 	 */
-	var minerAddress string
-	var miner bool
-	var fullNode bool
-	var listenPort string
+	var genesisAddress string
 	var nodeCmd = &cobra.Command{
 		Use:   "startnode",
 		Short: "start a node",
 		Args:  cobra.MinimumNArgs(0),
 		Run: func(cmd *cobra.Command, args []string) {
-			fmt.Println(miner)
-			if miner && len(minerAddress) == 0 {
+			if conf.Mining.Enabled && len(conf.Mining.Address) == 0 {
 				log.Fatalln("Miner address is required --address")
 			}
+			if conf.Storage.InMemory {
+				if err := cli.UseMemoryStore(genesisAddress); err != nil {
+					log.Fatalln(err)
+				}
+			}
 
-			cli := cli.UpdateInstance(instanceId, false)
-			cli.StartNode(listenPort, minerAddress, miner, fullNode, func(net *p2p.Network) {
-				if rpc {
+			cli := cli.UpdateInstance(conf.InstanceId, false)
+			cli.StartNode(conf.P2P.Port, conf.Mining.Address, conf.Mining.Enabled, conf.P2P.FullNode, func(net *p2p.Network) {
+				if conf.RPC.Enabled {
 					cli.P2p = net
-					go jsonrpc.StartServer(cli, rpc, rpcPort, rpcAddr)
+					go jsonrpc.StartServer(cli, conf.RPC.Enabled, conf.RPC.Port, conf.RPC.Addr)
 				}
 			})
 		},
 	}
-	nodeCmd.Flags().StringVar(&listenPort, "port", conf.ListenPort, "Node listening port")
-	nodeCmd.Flags().StringVar(&minerAddress, "address", conf.MinerAddress, "Set miner address")
-	nodeCmd.Flags().BoolVar(&miner, "miner", conf.Miner, "Set as true if you are joining the network as a miner")
-	nodeCmd.Flags().BoolVar(&fullNode, "fullnode", conf.FullNode, "Set as true if you are joining the network as a miner")
+	nodeCmd.Flags().StringVar(&conf.P2P.Port, "port", conf.P2P.Port, "Node listening port")
+	nodeCmd.Flags().StringVar(&conf.Mining.Address, "address", conf.Mining.Address, "Set miner address")
+	nodeCmd.Flags().BoolVar(&conf.Mining.Enabled, "miner", conf.Mining.Enabled, "Set as true if you are joining the network as a miner")
+	nodeCmd.Flags().BoolVar(&conf.P2P.FullNode, "fullnode", conf.P2P.FullNode, "Set as true if you are joining the network as a miner")
+	nodeCmd.Flags().BoolVar(&conf.Storage.InMemory, "inmemory", conf.Storage.InMemory, "Keep the chain in memory instead of on disk, regtest only")
+	nodeCmd.Flags().StringVar(&genesisAddress, "genesis", "", "With --inmemory, start a new chain paying its genesis block to this address instead of syncing from peers")
 
 	/*
 	* SEND COMMAND
@@ -142,28 +225,69 @@ func main() {
 	var mine bool
 	var sendFrom string
 	var sendTo string
-	var amount float64
+	var amount blockchain.Amount
 
 	var sendCmd = &cobra.Command{
 		Use:   "send",
 		Short: "Send x amount of token to address from local wallet address",
 		Args:  cobra.MinimumNArgs(0),
 		Run: func(cmd *cobra.Command, args []string) {
-			cli.Send(sendFrom, sendTo, amount, mine)
+			cli.Send(sendFrom, sendTo, amount, blockchain.Amount(conf.Wallet.FeeRate), mine)
 		},
 	}
 	sendCmd.Flags().StringVar(&sendFrom, "sendfrom", "", "Sender's wallet address")
 	sendCmd.Flags().StringVar(&sendTo, "sendto", "", "Reciever's wallet address")
-	sendCmd.Flags().Float64Var(&amount, "amount", float64(0), "Amount of token to send")
+	sendCmd.Flags().Var(&amount, "amount", "Amount of token to send, up to 8 decimal places")
+	sendCmd.Flags().Int64Var(&conf.Wallet.FeeRate, "feerate", conf.Wallet.FeeRate, "Fee in base units per byte of the transaction, higher fees are mined first")
 	sendCmd.Flags().BoolVar(&mine, "mine", false, "Set if you want your Node to mine the transaction instantly")
 
+	/*
+	* CONFIG COMMAND
+	 */
+	var dataDir string
+	var configFile string
+	var configCmd = &cobra.Command{
+		Use:   "config",
+		Short: "Inspect the node configuration",
+	}
+	var configDumpCmd = &cobra.Command{
+		Use:   "dump",
+		Short: "Print the effective configuration as a config file",
+		Args:  cobra.MinimumNArgs(0),
+		Run: func(cmd *cobra.Command, args []string) {
+			data, err := conf.Dump()
+			if err != nil {
+				log.Fatal(err)
+			}
+			fmt.Printf("# Data directory: %s\n# Config file: %s\n", datadir.Dir(), configFile)
+			fmt.Print(string(data))
+		},
+	}
+	configCmd.AddCommand(configDumpCmd)
+
 	var rootCmd = &cobra.Command{
 		Use: "demon",
+		// Every command runs with the configuration resolved from the
+		// config file, the environment and the flags, against the network
+		// it selects, and keeps its files in the data directory
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			if err := datadir.Set(dataDir); err != nil {
+				return err
+			}
+			if configFile == "" {
+				configFile = datadir.ConfigFile()
+			}
+			if err := config.Resolve(conf, configFile, cmd.Flags()); err != nil {
+				return err
+			}
+			cli.Blockchain.InstanceId = conf.InstanceId
+			return datadir.Create()
+		},
 		Run: func(cmd *cobra.Command, args []string) {
-			cli := cli.UpdateInstance(instanceId, false)
+			cli := cli.UpdateInstance(conf.InstanceId, false)
 
-			if rpc {
-				jsonrpc.StartServer(cli, rpc, rpcPort, rpcAddr)
+			if conf.RPC.Enabled {
+				jsonrpc.StartServer(cli, conf.RPC.Enabled, conf.RPC.Port, conf.RPC.Addr)
 			}
 		},
 	}
@@ -172,17 +296,26 @@ func main() {
 	/*
 	* HTTP FLAGS
 	 */
-	rootCmd.PersistentFlags().StringVar(&rpcPort, "rpcport", "", " HTTP-RPC server listening port (default: 5000)")
-	rootCmd.PersistentFlags().StringVar(&rpcAddr, "rpcaddr", "", "HTTP-RPC server listening interface (default: localhost)")
-	rootCmd.PersistentFlags().BoolVar(&rpc, "rpc", false, "Enable the HTTP-RPC server")
+	rootCmd.PersistentFlags().StringVar(&conf.RPC.Port, "rpcport", conf.RPC.Port, "HTTP-RPC server listening port")
+	rootCmd.PersistentFlags().StringVar(&conf.RPC.Addr, "rpcaddr", conf.RPC.Addr, "HTTP-RPC server listening interface (default: all)")
+	rootCmd.PersistentFlags().BoolVar(&conf.RPC.Enabled, "rpc", conf.RPC.Enabled, "Enable the HTTP-RPC server")
 
-	rootCmd.PersistentFlags().StringVar(&instanceId, "instanceid", "", "Blockchain instance")
+	rootCmd.PersistentFlags().StringVar(&conf.InstanceId, "instanceid", conf.InstanceId, "Blockchain instance")
+	rootCmd.PersistentFlags().StringVar(&conf.Network, "network", conf.Network, "Network to run on: main, test or regtest")
+	rootCmd.PersistentFlags().StringVar(&dataDir, "datadir", "", "Data directory (default: $"+datadir.EnvVar+" or "+datadir.Default()+")")
+	rootCmd.PersistentFlags().StringVar(&configFile, "config", "", "Config file (default: config.yaml in the data directory)")
 	rootCmd.AddCommand(
 		initCmd,
 		walletCmd,
 		computeutxosCmd,
+		reindexCmd,
+		migrateCmd,
+		importCmd,
+		verifyChainCmd,
+		configCmd,
 		sendCmd,
 		printCmd,
+		supplyCmd,
 		nodeCmd,
 	)
 	rootCmd.Execute()
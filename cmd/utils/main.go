@@ -1,13 +1,19 @@
 package utils
 
 import (
+	"bytes"
+	"encoding/hex"
 	"fmt"
+	"os"
 	"strconv"
 	"time"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/workspace/the-crypto-project/config"
 	blockchain "github.com/workspace/the-crypto-project/core"
 	"github.com/workspace/the-crypto-project/p2p"
+	"github.com/workspace/the-crypto-project/params"
+	"github.com/workspace/the-crypto-project/util/datadir"
 	"github.com/workspace/the-crypto-project/util/utils"
 	"github.com/workspace/the-crypto-project/wallet"
 )
@@ -23,7 +29,10 @@ type Error struct {
 	Message string
 }
 type BalanceResponse struct {
-	Balance   float64
+	Balance blockchain.Amount
+	// Mining rewards that can't be spent until they mature, not part of
+	// Balance
+	Immature  blockchain.Amount
 	Address   string
 	Timestamp int64
 	Error     *Error
@@ -32,11 +41,62 @@ type BalanceResponse struct {
 type SendResponse struct {
 	SendTo    string
 	SendFrom  string
-	Amount    float64
+	Amount    blockchain.Amount
+	Fee       blockchain.Amount
 	Timestamp int64
 	Error     *Error
 }
 
+// A transaction and where it was confirmed
+type TransactionResponse struct {
+	TxID        string
+	Transaction blockchain.Transaction
+	// The serialized transaction, hex encoded
+	Hex           string
+	BlockHash     string
+	Height        int
+	Confirmations int
+}
+
+// A page of the transactions of an address, newest first
+type AddressHistoryResponse struct {
+	Address      string
+	Total        int
+	Skip         int
+	Transactions []AddressTxResponse
+}
+
+type AddressTxResponse struct {
+	TxID      string
+	BlockHash string
+	Height    int
+	Received  blockchain.Amount
+	Sent      blockchain.Amount
+}
+
+// A page of the unspent outputs of an address, oldest first
+type AddressUTXOsResponse struct {
+	Address string
+	Total   int
+	Skip    int
+	UTXOs   []AddressUTXOResponse
+}
+
+type AddressUTXOResponse struct {
+	TxID     string
+	Out      int
+	Value    blockchain.Amount
+	Height   int
+	Coinbase bool
+	Mature   bool
+}
+
+// Where the memory pool was saved and how many transactions it held
+type SaveMempoolResponse struct {
+	Path         string
+	Transactions int
+}
+
 func (cli *CommandLine) StartNode(listenPort, minerAddress string, miner, fullNode bool, fn func(*p2p.Network)) {
 	if miner {
 		log.Infof("Starting Node %s as a MINER\n", listenPort)
@@ -51,21 +111,52 @@ func (cli *CommandLine) StartNode(listenPort, minerAddress string, miner, fullNo
 		log.Infof("Starting Node on PORT: %s\n", listenPort)
 	}
 
-	chain := cli.Blockchain.ContinueBlockchain()
+	chain, err := cli.Blockchain.ContinueBlockchain()
+	if err != nil {
+		log.Panic(err)
+	}
 	p2p.StartNode(chain, listenPort, minerAddress, miner, fullNode, fn)
 }
 
+// UseMemoryStore keeps the chain of a regtest node in memory, it is gone
+// once the node exits. The chain starts with a genesis block paying
+// genesisAddress, or empty to sync from peers when it isn't set.
+func (cli *CommandLine) UseMemoryStore(genesisAddress string) error {
+	if params.Active.Name != params.RegTest.Name {
+		return fmt.Errorf("in-memory chains are only for the %s network", params.RegTest.Name)
+	}
+	if len(genesisAddress) == 0 {
+		cli.Blockchain.Database = blockchain.NewMemoryStore()
+		return nil
+	}
+	if !wallet.ValidateAddress(genesisAddress) {
+		return fmt.Errorf("invalid genesis address %q", genesisAddress)
+	}
+
+	chain, err := blockchain.NewMemoryBlockchain(genesisAddress)
+	if err != nil {
+		return err
+	}
+	chain.InstanceId = cli.Blockchain.InstanceId
+	cli.Blockchain = chain
+	return nil
+}
+
 func (cli *CommandLine) UpdateInstance(InstanceId string, closeDbAlways bool) *CommandLine {
 	utils.SetLog(InstanceId)
 	cli.Blockchain.InstanceId = InstanceId
 	if blockchain.Exists(InstanceId) {
-		cli.Blockchain = cli.Blockchain.ContinueBlockchain()
+		chain, err := cli.Blockchain.ContinueBlockchain()
+		if err != nil {
+			log.Panic(err)
+		}
+		cli.Blockchain = chain
 	}
 	cli.CloseDbAlways = closeDbAlways
 
 	return cli
 }
-func (cli *CommandLine) Send(from string, to string, amount float64, mineNow bool) SendResponse {
+func (cli *CommandLine) Send(from string, to string, amount, feeRate blockchain.Amount, mineNow bool) SendResponse {
 	
 	if !wallet.ValidateAddress(from) {
 		log.Error("sendFrom address is Invalid ")
@@ -87,13 +178,25 @@ func (cli *CommandLine) Send(from string, to string, amount float64, mineNow boo
 	}
 
 
-	chain := cli.Blockchain.ContinueBlockchain()
+	chain, err := cli.Blockchain.ContinueBlockchain()
+	if err != nil {
+		log.Error(err)
+		return SendResponse{
+			Error: &Error{
+				Code:    5028,
+				Message: "failed to open the blockchain",
+			},
+		}
+	}
 	if cli.CloseDbAlways {
 		defer chain.Database.Close()
 	}
-	utxos := blockchain.UXTOSet{chain}
-	cwd := false
-	wallets, err := wallet.InitializeWallets(cwd)
+	utxos := blockchain.UXTOSet{Blockchain: chain}
+	// A running node builds on the transactions of its memory pool
+	if cli.P2p != nil {
+		utxos.Unconfirmed = cli.P2p.Mempool.View(config.Active.Wallet.UnconfirmedDepth)
+	}
+	wallets, err := wallet.InitializeWallets()
 	if err != nil {
 		chain.Database.Close()
 		log.Panic(err)
@@ -110,7 +213,17 @@ func (cli *CommandLine) Send(from string, to string, amount float64, mineNow boo
 		}
 	}
 
-	tx, err := blockchain.NewTransaction(&wallet, to, amount, &utxos)
+	tx, err := blockchain.NewTransaction(&wallet, to, amount, feeRate, &utxos)
+	if err != nil {
+		log.Error(err)
+		return SendResponse{
+			Error: &Error{
+				Code:    5028,
+				Message: "failed to execute transaction",
+			},
+		}
+	}
+	fee, err := utxos.TransactionFee(tx)
 	if err != nil {
 		log.Error(err)
 		return SendResponse{
@@ -121,17 +234,46 @@ func (cli *CommandLine) Send(from string, to string, amount float64, mineNow boo
 		}
 	}
 	if mineNow {
-
-		cbTx := blockchain.MinerTx(from, "")
-		txs := []*blockchain.Transaction{cbTx, tx}
-		log.Info("Transaction executed")
-
-		block := chain.MineBlock(txs)
-		utxos.Update(block)
-
-		if cli.P2p != nil {
-			cli.P2p.Blocks <- block
+		// Unconfirmed transactions it spends are mined along
+		var candidates []*blockchain.Transaction
+		for _, in := range tx.Inputs {
+			if cli.P2p == nil {
+				break
+			}
+			parentID := hex.EncodeToString(in.ID)
+			if parent, ok := cli.P2p.Mempool.Get(parentID); ok {
+				for _, ancestor := range cli.P2p.Mempool.Ancestors(parentID) {
+					ancestor := ancestor
+					candidates = append(candidates, &ancestor)
+				}
+				candidates = append(candidates, &parent)
+			}
+		}
+		candidates = append(candidates, tx)
+
+		txs, err := chain.AssembleBlock(from, candidates)
+		if err == nil {
+			log.Info("Transaction executed")
+			var block *blockchain.Block
+			block, err = chain.MineBlock(txs)
+			if err == nil && cli.P2p != nil {
+				// A block of a peer may have taken the tip meanwhile
+				if bytes.Equal(chain.LastHash, block.Hash) {
+					cli.P2p.Mempool.RemoveBlock(block)
+				}
+				cli.P2p.Blocks <- block
+			}
+		}
+		if err != nil {
+			log.Error(err)
+			return SendResponse{
+				Error: &Error{
+					Code:    5028,
+					Message: "failed to mine transaction",
+				},
+			}
 		}
+
 	} else {
 		if cli.P2p != nil {
 			cli.P2p.Transactions <- tx
@@ -143,75 +285,307 @@ func (cli *CommandLine) Send(from string, to string, amount float64, mineNow boo
 		SendTo:    to,
 		SendFrom:  from,
 		Amount:    amount,
+		Fee:       fee,
 		Timestamp: time.Now().Unix(),
 	}
 }
-func (cli *CommandLine) CreateBlockchain(address string) {
-	if !wallet.ValidateAddress(address) {
+func (cli *CommandLine) CreateBlockchain(address string, txIndex, addrIndex bool) {
+	// Only networks without a pinned genesis mine one paying the address
+	if len(params.Active.GenesisHash) > 0 {
+		if address != "" {
+			log.Warnf("The %s network has a fixed genesis block, ignoring address %s", params.Active.Name, address)
+		}
+	} else if !wallet.ValidateAddress(address) {
 		log.Panic("Invalid address")
 	}
 
-	chain := blockchain.InitBlockchain(address, cli.Blockchain.InstanceId)
+	chain, err := blockchain.InitBlockchain(address, cli.Blockchain.InstanceId)
+	if err != nil {
+		log.Panic(err)
+	}
 	if cli.CloseDbAlways {
 		defer chain.Database.Close()
 	}
-	utxos := blockchain.UXTOSet{chain}
-	utxos.Compute()
+	if txIndex || addrIndex {
+		if _, err := chain.Reindex(txIndex, addrIndex); err != nil {
+			log.Panic(err)
+		}
+	}
 	log.Info("Initialized Blockchain Successfully")
 }
 
 func (cli *CommandLine) ComputeUTXOs() {
-	chain := cli.Blockchain.ContinueBlockchain()
+	chain, err := cli.Blockchain.ContinueBlockchain()
+	if err != nil {
+		log.Panic(err)
+	}
 
 	if cli.CloseDbAlways {
 		defer chain.Database.Close()
 	}
-	utxos := blockchain.UXTOSet{chain}
-	utxos.Compute()
-	count := utxos.CountTransactions()
+	utxos := blockchain.UXTOSet{Blockchain: chain}
+	if err := utxos.Compute(); err != nil {
+		log.Panic(err)
+	}
+	count, err := utxos.CountTransactions()
+	if err != nil {
+		log.Panic(err)
+	}
 	log.Infof("Rebuild DONE!!!!, there are %d transactions in the utxos set", count)
 }
+// Reindex builds the selected indexes from the main chain and keeps them
+// up to date from then on
+func (cli *CommandLine) Reindex(txIndex, addrIndex bool) {
+	chain, err := cli.Blockchain.ContinueBlockchain()
+	if err != nil {
+		log.Panic(err)
+	}
+
+	if cli.CloseDbAlways {
+		defer chain.Database.Close()
+	}
+	count, err := chain.Reindex(txIndex, addrIndex)
+	if err != nil {
+		log.Panic(err)
+	}
+	log.Infof("Reindex DONE!!!!, %d transactions indexed", count)
+}
+
+// VerifyChain checks the last depth blocks of the chain at level and reports
+// the first inconsistency, with repair set the chain is rolled back to the
+// last good block and its state rebuilt
+func (cli *CommandLine) VerifyChain(depth, level int, repair bool) {
+	chain, err := cli.Blockchain.ContinueBlockchain()
+	if err != nil {
+		log.Panic(err)
+	}
+	if cli.CloseDbAlways {
+		defer chain.Database.Close()
+	}
+
+	report, err := chain.VerifyChain(depth, level)
+	if err != nil {
+		log.Panic(err)
+	}
+	if report.Fault == nil {
+		log.Infof("Verified %d blocks at level %d from height %d to %d, no problems found",
+			report.Checked, report.Level, report.From, report.TipHeight)
+		return
+	}
+	log.Errorf("Verification failed: %v", report.Fault)
+	if !repair {
+		log.Fatalf("The last good block is at height %d, run verifychain again with --repair to roll back to it", report.LastGood)
+	}
+
+	if err := chain.RepairChain(report); err != nil {
+		log.Panic(err)
+	}
+	height, err := chain.GetBestHeight()
+	if err != nil {
+		log.Panic(err)
+	}
+	log.Infof("Repaired, the chain is at height %d", height)
+}
+
+// Migrate upgrades the database of the instance to the current schema
+// version, with dryRun set it only lists the migrations it would run. The
+// database is opened directly since ContinueBlockchain would upgrade it.
+func (cli *CommandLine) Migrate(instanceId string, dryRun bool) {
+	utils.SetLog(instanceId)
+	if !blockchain.Exists(instanceId) {
+		log.Fatal("No blockchain found, nothing to migrate")
+	}
+	db, err := blockchain.OpenBardgerDB(instanceId)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer db.Close()
+
+	report, err := blockchain.Migrate(db, dryRun)
+	if err != nil {
+		log.Panic(err)
+	}
+	if len(report.Steps) == 0 {
+		log.Infof("The database is up to date at schema version %d", report.To)
+		return
+	}
+	for _, step := range report.Steps {
+		if dryRun {
+			log.Infof("Would upgrade to schema version %d: %s (%d keys)", step.Version, step.Description, step.Keys)
+		} else {
+			log.Infof("Upgraded to schema version %d: %s (%d keys)", step.Version, step.Description, step.Keys)
+		}
+	}
+}
+
+// ImportLegacy copies the chain database of an instance and the wallets an
+// earlier version wrote under dir into the data directory. The originals
+// are left alone, nothing the data directory has is replaced and what this
+// node can't read is not copied.
+func (cli *CommandLine) ImportLegacy(instanceId, dir string) {
+	found := false
+	from, to := datadir.LegacyChainDB(dir, instanceId), blockchain.GetDatabasePath(instanceId)
+	if blockchain.DBExists(from) {
+		found = true
+		if err := importChain(from, to); err != nil {
+			log.Errorf("Chain database %s not imported: %v", from, err)
+		} else {
+			log.Infof("Copied the chain database %s to %s, it is upgraded when the node opens it", from, to)
+		}
+	}
+
+	from, to = datadir.LegacyWalletsFile(dir), datadir.WalletsFile()
+	if _, err := os.Stat(from); err == nil {
+		found = true
+		var wallets wallet.Wallets
+		err := wallets.ReadFile(from)
+		if err == nil {
+			err = datadir.Copy(from, to)
+		}
+		if err != nil {
+			log.Errorf("Wallets %s not imported: %v", from, err)
+		} else {
+			log.Infof("Copied %d wallets from %s to %s", len(wallets.Wallets), from, to)
+		}
+	}
+
+	if !found {
+		log.Errorf("No chain database or wallets of the %s network under %s", params.Active.Name, dir)
+	}
+}
+
+// importChain copies a chain database next to to and only puts it in place
+// once this node has checked it can read or upgrade it
+func importChain(from, to string) error {
+	if blockchain.DBExists(to) {
+		return fmt.Errorf("%s already exists", to)
+	}
+	staging := to + ".import"
+	if err := datadir.Copy(from, staging); err != nil {
+		return err
+	}
+	db, err := blockchain.OpenBadgerStore(staging)
+	if err == nil {
+		_, err = blockchain.Migrate(db, true)
+		db.Close()
+	}
+	if err != nil {
+		os.RemoveAll(staging)
+		return err
+	}
+	return os.Rename(staging, to)
+}
+
 func (cli *CommandLine) GetBalance(address string) BalanceResponse {
-	if !wallet.ValidateAddress(address) {
-		log.Panic("Invalid address")
+	publicKeyHash, err := addressPubKeyHash(address)
+	if err != nil {
+		log.Error(err)
+		return BalanceResponse{
+			Address: address,
+			Error: &Error{
+				Code:    5028,
+				Message: "address is Invalid",
+			},
+		}
+	}
+	chain, err := cli.Blockchain.ContinueBlockchain()
+	if err != nil {
+		log.Error(err)
+		return BalanceResponse{
+			Address: address,
+			Error: &Error{
+				Code:    5028,
+				Message: "failed to open the blockchain",
+			},
+		}
 	}
-	chain := cli.Blockchain.ContinueBlockchain()
 	if cli.CloseDbAlways {
 		defer chain.Database.Close()
 	}
-	balance := float64(0)
-	publicKeyHash := wallet.Base58Decode([]byte(address))
-	publicKeyHash = publicKeyHash[1 : len(publicKeyHash)-4]
-	utxos := blockchain.UXTOSet{chain}
+	utxos := blockchain.UXTOSet{Blockchain: chain}
 
-	UTXOs := utxos.FindUnSpentTransactions(publicKeyHash)
-	for _, out := range UTXOs {
-		balance += out.Value
+	balance, immature, err := utxos.FindBalance(publicKeyHash)
+	if err != nil {
+		log.Error(err)
+		return BalanceResponse{
+			Address: address,
+			Error: &Error{
+				Code:    5028,
+				Message: "failed to read the balance",
+			},
+		}
 	}
 
-	log.Infof("Balance of %s:%f\n", address, balance)
+	log.Infof("Balance of %s:%s\n", address, balance)
+	if immature > 0 {
+		log.Infof("Immature mining rewards of %s:%s\n", address, immature)
+	}
 
 	return BalanceResponse{
 		balance,
+		immature,
 		address,
 		time.Now().Unix(),
 		&Error{},
 	}
 }
 
-func (cli *CommandLine) CreateWallet() string {
-	cwd := false
-	wallets, _ := wallet.InitializeWallets(cwd)
-	address := wallets.AddWallet()
-	wallets.SaveFile(cwd)
+func (cli *CommandLine) GetSupplyInfo() (blockchain.SupplyInfo, error) {
+	chain, err := cli.Blockchain.ContinueBlockchain()
+	if err != nil {
+		log.Error(err)
+		return blockchain.SupplyInfo{}, err
+	}
+	if cli.CloseDbAlways {
+		defer chain.Database.Close()
+	}
+	info, err := chain.GetSupplyInfo()
+	if err != nil {
+		log.Error(err)
+		return info, err
+	}
+
+	log.Infof("Height: %d", info.Height)
+	log.Infof("Supply: %s", info.Supply)
+	log.Infof("Max supply: %s", info.MaxSupply)
+	log.Infof("Block subsidy: %s", info.Subsidy)
+	log.Infof("Next halving at height %d", info.NextHalvingHeight)
+
+	return info, nil
+}
+
+// SaveMempool writes the memory pool of the running node to the data
+// directory, the node loads it back when it starts again
+func (cli *CommandLine) SaveMempool() (SaveMempoolResponse, error) {
+	if cli.P2p == nil {
+		return SaveMempoolResponse{}, fmt.Errorf("no node is running, it has no memory pool to save")
+	}
+	path, saved, err := cli.P2p.SaveMempool()
+	if err != nil {
+		log.Error(err)
+		return SaveMempoolResponse{}, err
+	}
+	log.Infof("Saved %d transactions of the memory pool to %s", saved, path)
+	return SaveMempoolResponse{path, saved}, nil
+}
+
+func (cli *CommandLine) CreateWallet() (string, error) {
+	wallets, _ := wallet.InitializeWallets()
+	address, err := wallets.AddWallet()
+	if err == nil {
+		err = wallets.SaveFile()
+	}
+	if err != nil {
+		log.Error(err)
+		return "", err
+	}
 
 	log.Info("ADDRESS:", address)
-	return address
+	return address, nil
 }
 
 func (cli *CommandLine) ListAddresses() {
-	cwd := false
-	wallets, err := wallet.InitializeWallets(cwd)
+	wallets, err := wallet.InitializeWallets()
 	if err != nil {
 		log.Panic(err)
 	}
@@ -222,14 +596,24 @@ func (cli *CommandLine) ListAddresses() {
 	}
 }
 func (cli *CommandLine) PrintBlockchain() {
-	chain := cli.Blockchain.ContinueBlockchain()
+	chain, err := cli.Blockchain.ContinueBlockchain()
+	if err != nil {
+		log.Panic(err)
+	}
 	if cli.CloseDbAlways {
 		defer chain.Database.Close()
 	}
 	iter := chain.Iterator()
+	if iter == nil {
+		log.Info("The blockchain has no blocks")
+		return
+	}
 
 	for {
-		block := iter.Next()
+		block, err := iter.Next()
+		if err != nil {
+			log.Panic(err)
+		}
 		fmt.Printf("PrevHash: %x\n", block.PrevHash)
 		fmt.Printf("Hash: %x\n", block.Hash)
 		fmt.Printf("Height: %d\n", block.Height)
@@ -247,16 +631,27 @@ func (cli *CommandLine) PrintBlockchain() {
 	}
 }
 
-func (cli *CommandLine) GetBlockchain() []*blockchain.Block {
+func (cli *CommandLine) GetBlockchain() ([]*blockchain.Block, error) {
 	var blocks []*blockchain.Block
-	chain := cli.Blockchain.ContinueBlockchain()
+	chain, err := cli.Blockchain.ContinueBlockchain()
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
 	if cli.CloseDbAlways {
 		defer chain.Database.Close()
 	}
 	iter := chain.Iterator()
+	if iter == nil {
+		return blocks, nil
+	}
 
 	for {
-		block := iter.Next()
+		block, err := iter.Next()
+		if err != nil {
+			log.Error(err)
+			return nil, err
+		}
 		blocks = append(blocks, block)
 
 		if len(block.PrevHash) == 0 {
@@ -264,26 +659,187 @@ func (cli *CommandLine) GetBlockchain() []*blockchain.Block {
 		}
 	}
 
-	return blocks
+	return blocks, nil
 }
 
-func (cli *CommandLine) GetBlockByHeight(height int) blockchain.Block {
-	var block blockchain.Block
-	chain := cli.Blockchain.ContinueBlockchain()
+func (cli *CommandLine) GetBlockByHeight(height int) (blockchain.Block, error) {
+	chain, err := cli.Blockchain.ContinueBlockchain()
+	if err != nil {
+		log.Error(err)
+		return blockchain.Block{}, err
+	}
 	if cli.CloseDbAlways {
 		defer chain.Database.Close()
 	}
-	iter := chain.Iterator()
 
-	for {
-		block = *iter.Next()
-		if block.Height == height-1 {
-			return block
-		}
-		if len(block.PrevHash) == 0 {
-			break
-		}
+	block, err := chain.GetBlockByHeight(height)
+	if err != nil {
+		log.Error(err)
 	}
+	return block, err
+}
 
-	return block
+func (cli *CommandLine) GetBlockRange(from, to int) ([]*blockchain.Block, error) {
+	chain, err := cli.Blockchain.ContinueBlockchain()
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	if cli.CloseDbAlways {
+		defer chain.Database.Close()
+	}
+
+	blocks, err := chain.GetBlockRange(from, to)
+	if err != nil {
+		log.Error(err)
+	}
+	return blocks, err
+}
+
+func (cli *CommandLine) GetTransaction(txID string) (TransactionResponse, error) {
+	ID, err := hex.DecodeString(txID)
+	if err != nil {
+		return TransactionResponse{}, fmt.Errorf("invalid transaction id %q", txID)
+	}
+	chain, err := cli.Blockchain.ContinueBlockchain()
+	if err != nil {
+		log.Error(err)
+		return TransactionResponse{}, err
+	}
+	if cli.CloseDbAlways {
+		defer chain.Database.Close()
+	}
+
+	if enabled, err := chain.TxIndexEnabled(); err == nil && !enabled {
+		log.Warn("The transaction index is disabled, run reindex to enable it")
+	}
+	tx, loc, err := chain.LocateTransaction(ID)
+	if err != nil {
+		log.Error(err)
+		return TransactionResponse{}, err
+	}
+	bestHeight, err := chain.GetBestHeight()
+	if err != nil {
+		log.Error(err)
+		return TransactionResponse{}, err
+	}
+
+	return TransactionResponse{
+		TxID:          txID,
+		Transaction:   tx,
+		Hex:           hex.EncodeToString(tx.Serializer()),
+		BlockHash:     hex.EncodeToString(loc.BlockHash),
+		Height:        loc.Height,
+		Confirmations: bestHeight - loc.Height + 1,
+	}, nil
+}
+
+func addressPubKeyHash(address string) ([]byte, error) {
+	if !wallet.ValidateAddress(address) {
+		return nil, fmt.Errorf("invalid address %q", address)
+	}
+	publicKeyHash, err := wallet.Base58Decode([]byte(address))
+	if err != nil {
+		return nil, err
+	}
+	return publicKeyHash[1 : len(publicKeyHash)-4], nil
+}
+
+func (cli *CommandLine) GetAddressHistory(address string, skip, limit int) (AddressHistoryResponse, error) {
+	publicKeyHash, err := addressPubKeyHash(address)
+	if err != nil {
+		return AddressHistoryResponse{}, err
+	}
+	chain, err := cli.Blockchain.ContinueBlockchain()
+	if err != nil {
+		log.Error(err)
+		return AddressHistoryResponse{}, err
+	}
+	if cli.CloseDbAlways {
+		defer chain.Database.Close()
+	}
+
+	history, total, err := chain.GetAddressHistory(publicKeyHash, skip, limit)
+	if err != nil {
+		log.Error(err)
+		return AddressHistoryResponse{}, err
+	}
+
+	res := AddressHistoryResponse{
+		Address:      address,
+		Total:        total,
+		Skip:         skip,
+		Transactions: []AddressTxResponse{},
+	}
+	for _, tx := range history {
+		res.Transactions = append(res.Transactions, AddressTxResponse{
+			TxID:      hex.EncodeToString(tx.TxID),
+			BlockHash: hex.EncodeToString(tx.BlockHash),
+			Height:    tx.Height,
+			Received:  tx.Received,
+			Sent:      tx.Sent,
+		})
+	}
+	return res, nil
+}
+
+func (cli *CommandLine) GetAddressUTXOs(address string, skip, limit int) (AddressUTXOsResponse, error) {
+	publicKeyHash, err := addressPubKeyHash(address)
+	if err != nil {
+		return AddressUTXOsResponse{}, err
+	}
+	chain, err := cli.Blockchain.ContinueBlockchain()
+	if err != nil {
+		log.Error(err)
+		return AddressUTXOsResponse{}, err
+	}
+	if cli.CloseDbAlways {
+		defer chain.Database.Close()
+	}
+
+	utxos, total, err := chain.GetAddressUTXOs(publicKeyHash, skip, limit)
+	if err != nil {
+		log.Error(err)
+		return AddressUTXOsResponse{}, err
+	}
+
+	res := AddressUTXOsResponse{
+		Address: address,
+		Total:   total,
+		Skip:    skip,
+		UTXOs:   []AddressUTXOResponse{},
+	}
+	for _, utxo := range utxos {
+		res.UTXOs = append(res.UTXOs, AddressUTXOResponse{
+			TxID:     hex.EncodeToString(utxo.TxID),
+			Out:      utxo.Out,
+			Value:    utxo.Value,
+			Height:   utxo.Height,
+			Coinbase: utxo.Coinbase,
+			Mature:   utxo.Mature,
+		})
+	}
+	return res, nil
+}
+
+// PrintAddressHistory prints a page of the transactions of an address,
+// newest first
+func (cli *CommandLine) PrintAddressHistory(address string, skip, limit int) {
+	res, err := cli.GetAddressHistory(address, skip, limit)
+	if err != nil {
+		return
+	}
+
+	fmt.Printf("Transactions of %s: %d\n", address, res.Total)
+	for _, tx := range res.Transactions {
+		fmt.Printf("Height: %d\n", tx.Height)
+		fmt.Printf("TxID: %s\n", tx.TxID)
+		fmt.Printf("Block: %s\n", tx.BlockHash)
+		fmt.Printf("Received: %s\n", tx.Received)
+		fmt.Printf("Sent: %s\n", tx.Sent)
+		fmt.Println()
+	}
+	if shown := res.Skip + len(res.Transactions); shown < res.Total {
+		fmt.Printf("%d more, use --skip %d to see them\n", res.Total-shown, shown)
+	}
 }
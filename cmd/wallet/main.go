@@ -6,13 +6,11 @@ import (
 	"strings"
 
 	"github.com/spf13/cobra"
+	"github.com/workspace/the-crypto-project/config"
+	"github.com/workspace/the-crypto-project/util/datadir"
 	"github.com/workspace/the-crypto-project/wallet"
 )
 
-const (
-	cwd = true
-)
-
 func PrintWalletAddress(address string, w wallet.Wallet) {
 	var lines []string
 	lines = append(lines, fmt.Sprintf("======ADDRESS:======\n %s ", address))
@@ -27,9 +25,14 @@ func main() {
 		Short: "Generate new wallet and print",
 		Run: func(cmd *cobra.Command, args []string) {
 
-			wallets, _ := wallet.InitializeWallets(cwd)
-			address := wallets.AddWallet()
-			wallets.SaveFile(cwd)
+			wallets, _ := wallet.InitializeWallets()
+			address, err := wallets.AddWallet()
+			if err != nil {
+				log.Fatal(err)
+			}
+			if err := wallets.SaveFile(); err != nil {
+				log.Fatal(err)
+			}
 			w , _ := wallets.GetWallet(address)
 			PrintWalletAddress(address, w)
 		},
@@ -41,7 +44,7 @@ func main() {
 		Run: func(cmd *cobra.Command, args []string) {
 			var w wallet.Wallet
 			var address string
-			wallets, _ := wallet.InitializeWallets(cwd)
+			wallets, _ := wallet.InitializeWallets()
 			if Address != "" {
 				if !wallet.ValidateAddress(Address) {
 					log.Panic("Invalid address")
@@ -61,7 +64,26 @@ func main() {
 	}
 	cmdPrint.PersistentFlags().StringVar(&Address, "address", "", "Wallet address")
 
-	var rootCmd = &cobra.Command{Use: "wallet"}
+	var conf = config.Default()
+	var dataDir string
+	var configFile string
+	var rootCmd = &cobra.Command{
+		Use: "wallet",
+		// Addresses and wallet files depend on the network, both binaries
+		// read it from the same configuration
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			if err := datadir.Set(dataDir); err != nil {
+				return err
+			}
+			if configFile == "" {
+				configFile = datadir.ConfigFile()
+			}
+			return config.Resolve(conf, configFile, cmd.Flags())
+		},
+	}
+	rootCmd.PersistentFlags().StringVar(&conf.Network, "network", conf.Network, "Network of the wallets: main, test or regtest")
+	rootCmd.PersistentFlags().StringVar(&dataDir, "datadir", "", "Data directory shared with the node (default: $"+datadir.EnvVar+" or "+datadir.Default()+")")
+	rootCmd.PersistentFlags().StringVar(&configFile, "config", "", "Config file (default: config.yaml in the data directory)")
 	rootCmd.AddCommand(cmdNew, cmdPrint)
 	rootCmd.Execute()
 }
@@ -0,0 +1,228 @@
+// Package config holds the settings of a node. They are resolved from, in
+// increasing order of precedence, the defaults, the config.yaml file of the
+// data directory, the environment and the command line flags.
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"github.com/workspace/the-crypto-project/params"
+	"gopkg.in/yaml.v2"
+)
+
+// Config is the schema of config.yaml. The env tag names the environment
+// variable overriding a setting.
+type Config struct {
+	// Network to run on: main, test or regtest
+	Network string `yaml:"network" env:"DEMON_NETWORK"`
+	// Instance of the node, several instances can share a data directory
+	InstanceId string `yaml:"instance_id" env:"DEMON_INSTANCE_ID"`
+
+	P2P     P2PConfig     `yaml:"p2p"`
+	RPC     RPCConfig     `yaml:"rpc"`
+	Mining  MiningConfig  `yaml:"mining"`
+	Wallet  WalletConfig  `yaml:"wallet"`
+	Mempool MempoolConfig `yaml:"mempool"`
+	Log     LogConfig     `yaml:"log"`
+	Storage StorageConfig `yaml:"storage"`
+}
+
+type P2PConfig struct {
+	// Port the node listens on, a random one when empty
+	Port string `yaml:"port" env:"LISTEN_PORT"`
+	// Join the full nodes channel and serve the memory pool
+	FullNode bool `yaml:"full_node" env:"FULL_NODE"`
+}
+
+type RPCConfig struct {
+	Enabled bool `yaml:"enabled" env:"DEMON_RPC"`
+	// Interface the HTTP-RPC server listens on, all of them when empty
+	Addr string `yaml:"addr" env:"DEMON_RPC_ADDR"`
+	Port string `yaml:"port" env:"DEMON_RPC_PORT"`
+}
+
+type MiningConfig struct {
+	Enabled bool `yaml:"enabled" env:"MINER"`
+	// Address the block rewards are paid to
+	Address string `yaml:"address" env:"MINER_ADDRESS"`
+}
+
+type WalletConfig struct {
+	// Bytes of checksum at the end of an address
+	AddressChecksum int `yaml:"address_checksum" env:"WALLET_ADDRESS_CHECKSUM"`
+	// Fee in base units per byte of the transactions sent
+	FeeRate int64 `yaml:"fee_rate" env:"DEMON_FEE_RATE"`
+	// Unconfirmed ancestors a transaction sent by a node may have, it
+	// spends only confirmed outputs at 0
+	UnconfirmedDepth int `yaml:"unconfirmed_depth" env:"DEMON_WALLET_UNCONFIRMED_DEPTH"`
+}
+
+type MempoolConfig struct {
+	// Largest transaction the memory pool accepts, in bytes
+	MaxTxSize int `yaml:"max_tx_size" env:"DEMON_MEMPOOL_MAX_TX_SIZE"`
+	// Lowest fee, in base units per byte, of the transactions it accepts
+	MinRelayFeeRate int64 `yaml:"min_relay_fee_rate" env:"DEMON_MIN_RELAY_FEE_RATE"`
+	// Size the pool grows to before evicting the lowest fee rates
+	MaxSizeMB int `yaml:"max_size_mb" env:"DEMON_MEMPOOL_MAX_SIZE_MB"`
+	// How long a transaction may wait to be mined
+	ExpiryHours int `yaml:"expiry_hours" env:"DEMON_MEMPOOL_EXPIRY_HOURS"`
+	// Let a transaction paying a higher fee replace the pooled ones
+	// spending the same outputs, instead of refusing it
+	ReplaceByFee bool `yaml:"replace_by_fee" env:"DEMON_MEMPOOL_REPLACE_BY_FEE"`
+	// Most unconfirmed ancestors of a transaction, and descendants of a
+	// transaction, both counting the transaction itself
+	MaxAncestors   int `yaml:"max_ancestors" env:"DEMON_MEMPOOL_MAX_ANCESTORS"`
+	MaxDescendants int `yaml:"max_descendants" env:"DEMON_MEMPOOL_MAX_DESCENDANTS"`
+	// Save the pool to the data directory on shutdown and every
+	// save_interval_minutes, and load it back on start
+	Persist             bool `yaml:"persist" env:"DEMON_MEMPOOL_PERSIST"`
+	SaveIntervalMinutes int  `yaml:"save_interval_minutes" env:"DEMON_MEMPOOL_SAVE_INTERVAL_MINUTES"`
+}
+
+type LogConfig struct {
+	// panic, fatal, error, warning, info, debug or trace
+	Level string `yaml:"level" env:"DEMON_LOG_LEVEL"`
+	// Size a log file grows to before it is rotated
+	MaxSizeMB int `yaml:"max_size_mb" env:"DEMON_LOG_MAX_SIZE_MB"`
+	// Rotated files kept, and for how long
+	MaxBackups int `yaml:"max_backups" env:"DEMON_LOG_MAX_BACKUPS"`
+	MaxAgeDays int `yaml:"max_age_days" env:"DEMON_LOG_MAX_AGE_DAYS"`
+}
+
+type StorageConfig struct {
+	// Keep the chain in memory instead of on disk, regtest only
+	InMemory bool `yaml:"in_memory" env:"DEMON_INMEMORY"`
+	// Indexes kept by a chain created with init
+	TxIndex   bool `yaml:"tx_index" env:"DEMON_TXINDEX"`
+	AddrIndex bool `yaml:"addr_index" env:"DEMON_ADDRINDEX"`
+}
+
+// Default returns the settings used when nothing overrides them
+func Default() *Config {
+	return &Config{
+		Network: params.MainNet.Name,
+		RPC: RPCConfig{
+			Port: "5000",
+		},
+		Wallet: WalletConfig{
+			AddressChecksum: 4,
+			// blockchain.DefaultFeeRate
+			FeeRate:          10,
+			UnconfirmedDepth: 5,
+		},
+		Mempool: MempoolConfig{
+			MaxTxSize:           100000,
+			MinRelayFeeRate:     1,
+			MaxSizeMB:           300,
+			ExpiryHours:         336,
+			MaxAncestors:        25,
+			MaxDescendants:      25,
+			Persist:             true,
+			SaveIntervalMinutes: 15,
+		},
+		Log: LogConfig{
+			Level:      "info",
+			MaxSizeMB:  50,
+			MaxBackups: 3,
+			MaxAgeDays: 28,
+		},
+	}
+}
+
+// Active is the configuration the node runs with, the defaults until Select
+// is called
+var Active = Default()
+
+// Load returns the defaults overridden by file, then by the environment. A
+// missing file or .env is not an error.
+func Load(file string) (*Config, error) {
+	c := Default()
+	data, err := ioutil.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := yaml.UnmarshalStrict(data, c); err != nil {
+			return nil, fmt.Errorf("config file %s: %w", file, err)
+		}
+	}
+
+	if err := loadDotEnv(); err != nil {
+		return nil, err
+	}
+	if err := applyEnv(c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Resolve loads file into c, the flags are bound to fields of c and the
+// ones given on the command line keep their value. The result is selected.
+func Resolve(c *Config, file string, flags *pflag.FlagSet) error {
+	changed := make(map[string]string)
+	flags.Visit(func(flag *pflag.Flag) {
+		changed[flag.Name] = flag.Value.String()
+	})
+
+	loaded, err := Load(file)
+	if err != nil {
+		return err
+	}
+	*c = *loaded
+	for name, value := range changed {
+		if err := flags.Set(name, value); err != nil {
+			return fmt.Errorf("--%s: %w", name, err)
+		}
+	}
+	return Select(c)
+}
+
+// Select checks c and makes it the Active configuration, it also selects
+// the network
+func Select(c *Config) error {
+	if _, err := logrus.ParseLevel(c.Log.Level); err != nil {
+		return fmt.Errorf("log level: %w", err)
+	}
+	if c.Wallet.AddressChecksum < 1 || c.Wallet.AddressChecksum > 32 {
+		return fmt.Errorf("address checksum of %d bytes, it must be between 1 and 32", c.Wallet.AddressChecksum)
+	}
+	if c.Mempool.MaxTxSize <= 0 {
+		return fmt.Errorf("mempool transactions of at most %d bytes, it must be positive", c.Mempool.MaxTxSize)
+	}
+	if c.Mempool.MaxSizeMB <= 0 || c.Mempool.ExpiryHours <= 0 {
+		return fmt.Errorf("mempool of %d MB and expiry of %d hours, they must be positive",
+			c.Mempool.MaxSizeMB, c.Mempool.ExpiryHours)
+	}
+	if c.Mempool.MaxAncestors < 1 || c.Mempool.MaxDescendants < 1 {
+		return fmt.Errorf("mempool chains of %d ancestors and %d descendants, they must be at least 1",
+			c.Mempool.MaxAncestors, c.Mempool.MaxDescendants)
+	}
+	if c.Mempool.Persist && c.Mempool.SaveIntervalMinutes <= 0 {
+		return fmt.Errorf("mempool saved every %d minutes, it must be positive", c.Mempool.SaveIntervalMinutes)
+	}
+	if c.Wallet.UnconfirmedDepth < 0 {
+		return fmt.Errorf("wallet unconfirmed depth of %d, it can't be negative", c.Wallet.UnconfirmedDepth)
+	}
+	if c.Mempool.MinRelayFeeRate < 0 {
+		return fmt.Errorf("minimum relay fee rate of %d, it can't be negative", c.Mempool.MinRelayFeeRate)
+	}
+	if err := params.Select(c.Network); err != nil {
+		return err
+	}
+	Active = c
+	return nil
+}
+
+// Dump writes c as a config file
+func (c *Config) Dump() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := yaml.NewEncoder(&buf).Encode(c); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
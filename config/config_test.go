@@ -0,0 +1,171 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/pflag"
+	"github.com/workspace/the-crypto-project/params"
+	"github.com/workspace/the-crypto-project/util/datadir"
+)
+
+// setEnv sets the environment variable name for the rest of the test, an
+// empty value unsets it
+func setEnv(t *testing.T, name, value string) {
+	t.Helper()
+	old, ok := os.LookupEnv(name)
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(name, old)
+		} else {
+			os.Unsetenv(name)
+		}
+	})
+	if value == "" {
+		os.Unsetenv(name)
+	} else {
+		os.Setenv(name, value)
+	}
+}
+
+// resolve binds flags to a default configuration the way demon does, parses
+// args and resolves the configuration with file
+func resolve(t *testing.T, file string, args ...string) (*Config, error) {
+	t.Helper()
+	c := Default()
+	flags := pflag.NewFlagSet("demon", pflag.ContinueOnError)
+	flags.StringVar(&c.Network, "network", c.Network, "")
+	flags.StringVar(&c.RPC.Port, "rpcport", c.RPC.Port, "")
+	flags.BoolVar(&c.Mining.Enabled, "miner", c.Mining.Enabled, "")
+	if err := flags.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return c, Resolve(c, file, flags)
+}
+
+func writeFile(t *testing.T, content string) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestResolve(t *testing.T) {
+	// No .env of the data directory gets in the way
+	if err := datadir.Set(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		Active = Default()
+		params.Select(params.MainNet.Name)
+	}()
+
+	for _, test := range []struct {
+		name string
+		file string
+		env  map[string]string
+		args []string
+		// Port and network of the resolved configuration
+		port, network string
+		miner         bool
+	}{
+		{name: "defaults", port: "5000", network: params.MainNet.Name},
+		{
+			name: "file over defaults",
+			file: "network: test\nrpc:\n  port: \"6000\"\nmining:\n  enabled: true\n",
+			port: "6000", network: params.TestNet.Name, miner: true,
+		},
+		{
+			name: "environment over file",
+			file: "network: test\nrpc:\n  port: \"6000\"\n",
+			env:  map[string]string{"DEMON_RPC_PORT": "7000", "DEMON_NETWORK": "regtest"},
+			port: "7000", network: params.RegTest.Name,
+		},
+		{
+			name: "flags over environment",
+			file: "network: test\nrpc:\n  port: \"6000\"\nmining:\n  enabled: true\n",
+			env:  map[string]string{"DEMON_RPC_PORT": "7000", "DEMON_NETWORK": "regtest"},
+			args: []string{"--rpcport", "8000", "--network", "main", "--miner=false"},
+			port: "8000", network: params.MainNet.Name,
+		},
+		{
+			name: "flags only for what they set",
+			file: "rpc:\n  port: \"6000\"\n",
+			env:  map[string]string{"DEMON_NETWORK": "test"},
+			args: []string{"--miner"},
+			port: "6000", network: params.TestNet.Name, miner: true,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			for _, name := range []string{"DEMON_RPC_PORT", "DEMON_NETWORK", "MINER"} {
+				setEnv(t, name, test.env[name])
+			}
+			file := filepath.Join(t.TempDir(), "missing.yaml")
+			if test.file != "" {
+				file = writeFile(t, test.file)
+			}
+			c, err := resolve(t, file, test.args...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.RPC.Port != test.port || c.Network != test.network || c.Mining.Enabled != test.miner {
+				t.Fatalf("resolved port %s, network %s and miner %v, want %s, %s and %v",
+					c.RPC.Port, c.Network, c.Mining.Enabled, test.port, test.network, test.miner)
+			}
+			if Active != c || params.Active.Name != test.network {
+				t.Fatalf("the %s network of the configuration isn't selected, %s is", test.network, params.Active.Name)
+			}
+		})
+	}
+}
+
+func TestResolveRejectsInvalidValues(t *testing.T) {
+	if err := datadir.Set(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		Active = Default()
+		params.Select(params.MainNet.Name)
+	}()
+
+	for _, test := range []struct {
+		name string
+		file string
+		env  map[string]string
+		args []string
+	}{
+		{name: "unknown network in the file", file: "network: nonet\n"},
+		{name: "unknown network in the environment", env: map[string]string{"DEMON_NETWORK": "nonet"}},
+		{name: "unknown network flag", args: []string{"--network", "nonet"}},
+		{name: "unknown setting", file: "mempool:\n  max_size: 10\n"},
+		{name: "malformed file", file: "rpc: [\n"},
+		{name: "malformed environment value", env: map[string]string{"MINER": "maybe"}},
+		{name: "log level", file: "log:\n  level: loud\n"},
+		{name: "address checksum", file: "wallet:\n  address_checksum: 33\n"},
+		{name: "mempool size", file: "mempool:\n  max_size_mb: 0\n"},
+		{name: "mempool chains", file: "mempool:\n  max_ancestors: 0\n"},
+		{name: "save interval", file: "mempool:\n  save_interval_minutes: -1\n"},
+		{name: "negative fee rate", file: "mempool:\n  min_relay_fee_rate: -1\n"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			for _, name := range []string{"DEMON_NETWORK", "MINER"} {
+				setEnv(t, name, test.env[name])
+			}
+			file := filepath.Join(t.TempDir(), "missing.yaml")
+			if test.file != "" {
+				file = writeFile(t, test.file)
+			}
+			before := Active
+			if _, err := resolve(t, file, test.args...); err == nil {
+				t.Fatal("the configuration was accepted")
+			}
+			if Active != before {
+				t.Fatal("a rejected configuration was selected")
+			}
+		})
+	}
+}
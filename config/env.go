@@ -0,0 +1,71 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+
+	"github.com/joho/godotenv"
+	"github.com/workspace/the-crypto-project/util/datadir"
+)
+
+// loadDotEnv adds the variables of the .env files of the working and data
+// directories to the environment, without overriding the ones already set
+func loadDotEnv() error {
+	for _, file := range []string{".env", filepath.Join(datadir.Dir(), ".env")} {
+		if _, err := os.Stat(file); os.IsNotExist(err) {
+			continue
+		}
+		if err := godotenv.Load(file); err != nil {
+			return fmt.Errorf("loading %s: %w", file, err)
+		}
+	}
+	return nil
+}
+
+// applyEnv sets the fields of c, and of its sections, named by an env tag
+// whose variable is set
+func applyEnv(c *Config) error {
+	return applyEnvValue(reflect.ValueOf(c).Elem())
+}
+
+func applyEnvValue(v reflect.Value) error {
+	for i := 0; i < v.NumField(); i++ {
+		field, fieldType := v.Field(i), v.Type().Field(i)
+		if field.Kind() == reflect.Struct {
+			if err := applyEnvValue(field); err != nil {
+				return err
+			}
+			continue
+		}
+		name := fieldType.Tag.Get("env")
+		value, ok := os.LookupEnv(name)
+		if name == "" || !ok {
+			continue
+		}
+
+		var err error
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(value)
+		case reflect.Bool:
+			var b bool
+			if b, err = strconv.ParseBool(value); err == nil {
+				field.SetBool(b)
+			}
+		case reflect.Int, reflect.Int64:
+			var n int64
+			if n, err = strconv.ParseInt(value, 10, 64); err == nil {
+				field.SetInt(n)
+			}
+		default:
+			err = fmt.Errorf("unsupported type %s", field.Type())
+		}
+		if err != nil {
+			return fmt.Errorf("environment variable %s: %w", name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,302 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/workspace/the-crypto-project/wallet"
+)
+
+// The address index lists, for every public key hash, the main chain
+// transactions that pay it or spend its outputs. Keys are
+// index/addr/<hash length><hash><height><position in block> so the history of an
+// address is a prefix scan in chain order, the value is the transaction ID.
+// Like the transaction index it is only kept once addrIndexFlag is set.
+var (
+	addrIndexPrefix = []byte("index/addr/")
+	addrIndexFlag   = []byte("meta/addrindex")
+)
+
+const (
+	// Entries returned when a page doesn't set a limit
+	DefaultAddressPageSize = 100
+	// Largest page of address history or UTXOs returned at once
+	MaxAddressPageSize = 1000
+)
+
+var ErrAddrIndexDisabled = errors.New("the address index is disabled, run reindex to build it")
+
+// AddressTx is a transaction in the history of an address
+type AddressTx struct {
+	TxID      []byte
+	BlockHash []byte
+	Height    int
+	// Value of the outputs of the transaction paying the address
+	Received Amount
+	// Value of the outputs of the address the transaction spends
+	Sent Amount
+}
+
+// AddressUTXO is an unspent output locked to an address
+type AddressUTXO struct {
+	TxID   []byte
+	Out    int
+	Value  Amount
+	Height int
+	// Coinbase outputs only become spendable once they mature
+	Coinbase bool
+	Mature   bool
+}
+
+func addrIndexAddressPrefix(pubKeyHash []byte) []byte {
+	prefix := append([]byte{}, addrIndexPrefix...)
+	prefix = append(prefix, byte(len(pubKeyHash)))
+	return append(prefix, pubKeyHash...)
+}
+
+func addrIndexKey(pubKeyHash []byte, height, index int) []byte {
+	key := addrIndexAddressPrefix(pubKeyHash)
+	var pos [8]byte
+	binary.BigEndian.PutUint32(pos[:4], uint32(height))
+	binary.BigEndian.PutUint32(pos[4:], uint32(index))
+	return append(key, pos[:]...)
+}
+
+// touchedAddresses returns the public key hashes tx pays or spends from
+func touchedAddresses(tx *Transaction) [][]byte {
+	var hashes [][]byte
+	seen := make(map[string]bool)
+	add := func(pubKeyHash []byte) {
+		if len(pubKeyHash) == 0 || len(pubKeyHash) > 255 || seen[string(pubKeyHash)] {
+			return
+		}
+		seen[string(pubKeyHash)] = true
+		hashes = append(hashes, pubKeyHash)
+	}
+
+	if !tx.IsMinerTx() {
+		for _, in := range tx.Inputs {
+			add(wallet.PublicKeyHash(in.PubKey))
+		}
+	}
+	for _, out := range tx.Outputs {
+		add(out.PubKeyHash)
+	}
+	return hashes
+}
+
+func indexBlockAddresses(txn StoreTxn, block *Block) error {
+	for i, tx := range block.Transactions {
+		for _, pubKeyHash := range touchedAddresses(tx) {
+			if err := txn.Set(addrIndexKey(pubKeyHash, block.Height, i), tx.ID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// unindexBlockAddresses removes a block that left the main chain. It runs
+// before the block replacing it at the same height is indexed.
+func unindexBlockAddresses(txn StoreTxn, block *Block) error {
+	for i, tx := range block.Transactions {
+		for _, pubKeyHash := range touchedAddresses(tx) {
+			if err := txn.Delete(addrIndexKey(pubKeyHash, block.Height, i)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+type addrIndexEntry struct {
+	txID   []byte
+	height int
+	index  int
+}
+
+// addressEntries returns the index entries of pubKeyHash, newest first when
+// reverse is set
+func (chain *Blockchain) addressEntries(pubKeyHash []byte, reverse bool) ([]addrIndexEntry, error) {
+	var entries []addrIndexEntry
+	prefix := addrIndexAddressPrefix(pubKeyHash)
+
+	err := chain.Database.View(func(txn StoreTxn) error {
+		enabled, err := indexEnabled(txn, addrIndexFlag)
+		if err != nil {
+			return err
+		}
+		if !enabled {
+			return ErrAddrIndexDisabled
+		}
+
+		return txn.Iterate(prefix, reverse, func(key, txID []byte) error {
+			if len(key) != len(prefix)+8 {
+				return errors.New("corrupt address index entry")
+			}
+			entries = append(entries, addrIndexEntry{
+				txID:   txID,
+				height: int(binary.BigEndian.Uint32(key[len(prefix):])),
+				index:  int(binary.BigEndian.Uint32(key[len(prefix)+4:])),
+			})
+			return nil
+		})
+	})
+
+	return entries, err
+}
+
+func pageBounds(total, skip, limit int) (int, int, error) {
+	if skip < 0 || limit < 0 {
+		return 0, 0, fmt.Errorf("invalid page, skip %d limit %d", skip, limit)
+	}
+	if limit == 0 {
+		limit = DefaultAddressPageSize
+	}
+	if limit > MaxAddressPageSize {
+		return 0, 0, fmt.Errorf("page of %d entries is larger than %d", limit, MaxAddressPageSize)
+	}
+	if skip > total {
+		skip = total
+	}
+	end := skip + limit
+	if end > total {
+		end = total
+	}
+	return skip, end, nil
+}
+
+// GetAddressHistory returns a page of the main chain transactions paying
+// or spending from pubKeyHash, newest first, along with the total number of
+// transactions of the address. A limit of 0 returns DefaultAddressPageSize
+// transactions.
+func (chain *Blockchain) GetAddressHistory(pubKeyHash []byte, skip, limit int) ([]AddressTx, int, error) {
+	entries, err := chain.addressEntries(pubKeyHash, true)
+	if err != nil {
+		return nil, 0, err
+	}
+	start, end, err := pageBounds(len(entries), skip, limit)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	history := make([]AddressTx, 0, end-start)
+	for _, entry := range entries[start:end] {
+		block, err := chain.GetBlockByHeight(entry.height)
+		if err != nil {
+			return nil, 0, err
+		}
+		if entry.index >= len(block.Transactions) || !bytes.Equal(block.Transactions[entry.index].ID, entry.txID) {
+			return nil, 0, errors.New("corrupt address index entry")
+		}
+		tx := block.Transactions[entry.index]
+
+		record := AddressTx{TxID: tx.ID, BlockHash: block.Hash, Height: block.Height}
+		for _, out := range tx.Outputs {
+			if out.IsLockWithKey(pubKeyHash) {
+				record.Received += out.Value
+			}
+		}
+		if !tx.IsMinerTx() {
+			spent, err := chain.spentOutputs(&block, entry.index)
+			if err != nil {
+				return nil, 0, err
+			}
+			for i, in := range tx.Inputs {
+				if bytes.Equal(wallet.PublicKeyHash(in.PubKey), pubKeyHash) {
+					record.Sent += spent[i].Output.Value
+				}
+			}
+		}
+		history = append(history, record)
+	}
+
+	return history, len(entries), nil
+}
+
+// spentOutputs returns the outputs spent by the inputs of the transaction
+// at index of a main chain block, read from the undo record of the block
+// instead of looking each one up in the chain
+func (chain *Blockchain) spentOutputs(block *Block, index int) ([]SpentOutput, error) {
+	var spent []SpentOutput
+	err := chain.Database.View(func(txn StoreTxn) error {
+		var err error
+		spent, err = getUndo(txn, block)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The undo record lists the inputs of the transactions in block order
+	offset := 0
+	for _, tx := range block.Transactions[:index] {
+		if !tx.IsMinerTx() {
+			offset += len(tx.Inputs)
+		}
+	}
+	inputs := block.Transactions[index].Inputs
+	if offset+len(inputs) > len(spent) {
+		return nil, fmt.Errorf("%w: undo record of block %x is short", ErrMalformedData, block.Hash)
+	}
+	spent = spent[offset : offset+len(inputs)]
+	for i, in := range inputs {
+		if !bytes.Equal(spent[i].TxID, in.ID) || spent[i].Out != in.Out {
+			return nil, fmt.Errorf("%w: undo record of block %x doesn't match its inputs", ErrMalformedData, block.Hash)
+		}
+	}
+	return spent, nil
+}
+
+// GetAddressUTXOs returns a page of the unspent outputs locked to
+// pubKeyHash, oldest first, along with the total number of them
+func (chain *Blockchain) GetAddressUTXOs(pubKeyHash []byte, skip, limit int) ([]AddressUTXO, int, error) {
+	entries, err := chain.addressEntries(pubKeyHash, false)
+	if err != nil {
+		return nil, 0, err
+	}
+	height, err := chain.GetBestHeight()
+	if err != nil {
+		return nil, 0, err
+	}
+	height++
+
+	var utxos []AddressUTXO
+	err = chain.Database.View(func(txn StoreTxn) error {
+		for _, entry := range entries {
+			outs, err := getUTXOs(txn, entry.txID)
+			if errors.Is(err, ErrKeyNotFound) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+
+			for i, out := range outs.Outputs {
+				if out.IsSpent() || !out.IsLockWithKey(pubKeyHash) {
+					continue
+				}
+				utxos = append(utxos, AddressUTXO{
+					TxID:     entry.txID,
+					Out:      i,
+					Value:    out.Value,
+					Height:   outs.Height,
+					Coinbase: outs.Coinbase,
+					Mature:   outs.IsMature(height),
+				})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	start, end, err := pageBounds(len(utxos), skip, limit)
+	if err != nil {
+		return nil, 0, err
+	}
+	return utxos[start:end], len(utxos), nil
+}
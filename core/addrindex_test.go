@@ -0,0 +1,56 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/workspace/the-crypto-project/wallet"
+)
+
+func TestAddressHistorySpentValues(t *testing.T) {
+	a, b := newTestWallet(t), newTestWallet(t)
+	chain := newTestChain(t, a)
+	if _, err := chain.Reindex(false, true); err != nil {
+		t.Fatal(err)
+	}
+	coinbase := genesisCoinbase(t, chain)
+	value := coinbase.Outputs[0].Value
+
+	pay := spendTx(t, a, coinbase, 0, []string{b.address, a.address}, []Amount{value / 2, value/2 - 1000})
+	addTestBlock(t, chain, chain.LastHash, a, pay)
+
+	// The inputs of back come first in the undo record of the block, the
+	// spend of a is read after them
+	back := spendTx(t, b, pay, 0, []string{a.address}, []Amount{value/2 - 1000})
+	change := spendTx(t, a, pay, 1, []string{b.address}, []Amount{value/2 - 2000})
+	addTestBlock(t, chain, chain.LastHash, a, back, change)
+
+	history, total, err := chain.GetAddressHistory(wallet.PublicKeyHash(a.PublicKey), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := make(map[string]AddressTx)
+	for _, record := range history {
+		records[hex.EncodeToString(record.TxID)] = record
+	}
+	if len(records) != total {
+		t.Fatalf("%d records of %d", len(records), total)
+	}
+	for _, want := range []struct {
+		tx             *Transaction
+		received, sent Amount
+	}{
+		{pay, value/2 - 1000, value},
+		{back, value/2 - 1000, 0},
+		{change, 0, value/2 - 1000},
+	} {
+		record, ok := records[hex.EncodeToString(want.tx.ID)]
+		if !ok {
+			t.Fatalf("transaction %x missing from the history", want.tx.ID)
+		}
+		if record.Received != want.received || record.Sent != want.sent {
+			t.Fatalf("transaction %x received %d sent %d, want %d and %d",
+				want.tx.ID, record.Received, record.Sent, want.received, want.sent)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package blockchain
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Amount is a quantity of token counted in indivisible base units,
+// one token is BaseUnitsPerCoin base units
+type Amount int64
+
+const (
+	// Number of decimal places a token can be divided into
+	Decimals = 8
+	// Base units in one token
+	BaseUnitsPerCoin Amount = 100000000
+	// No amount, in a single output or a whole transaction, may exceed the
+	// total supply of token
+	MaxMoney = 21000000 * BaseUnitsPerCoin
+)
+
+var (
+	ErrAmountOverflow = errors.New("amount overflow")
+	ErrInvalidAmount  = errors.New("invalid amount")
+)
+
+// IsValid reports whether the amount is between zero and MaxMoney
+func (a Amount) IsValid() bool {
+	return a >= 0 && a <= MaxMoney
+}
+
+// Add returns a + b, or ErrAmountOverflow if the result doesn't fit
+func (a Amount) Add(b Amount) (Amount, error) {
+	if (b > 0 && a > math.MaxInt64-b) || (b < 0 && a < math.MinInt64-b) {
+		return 0, ErrAmountOverflow
+	}
+	return a + b, nil
+}
+
+// Sub returns a - b, or ErrAmountOverflow if the result doesn't fit
+func (a Amount) Sub(b Amount) (Amount, error) {
+	if (b < 0 && a > math.MaxInt64+b) || (b > 0 && a < math.MinInt64+b) {
+		return 0, ErrAmountOverflow
+	}
+	return a - b, nil
+}
+
+// MulInt returns a * n, or ErrAmountOverflow if the result doesn't fit
+func (a Amount) MulInt(n int64) (Amount, error) {
+	if a == 0 || n == 0 {
+		return 0, nil
+	}
+	result := a * Amount(n)
+	if result/Amount(n) != a || (a == -1 && n == math.MinInt64) || (n == -1 && a == math.MinInt64) {
+		return 0, ErrAmountOverflow
+	}
+	return result, nil
+}
+
+// SumAmounts adds up amounts and fails if the total overflows
+func SumAmounts(amounts ...Amount) (Amount, error) {
+	var total Amount
+	var err error
+	for _, a := range amounts {
+		if total, err = total.Add(a); err != nil {
+			return 0, err
+		}
+	}
+	return total, nil
+}
+
+// ToCoins converts the amount to a floating point number of tokens,
+// for display only
+func (a Amount) ToCoins() float64 {
+	return float64(a) / float64(BaseUnitsPerCoin)
+}
+
+// String formats the amount in tokens with all the decimal places, e.g.
+// 20.00000000
+func (a Amount) String() string {
+	sign := ""
+	units := uint64(a)
+	if a < 0 {
+		sign = "-"
+		units = uint64(-(a + 1)) + 1
+	}
+	return fmt.Sprintf("%s%d.%0*d", sign, units/uint64(BaseUnitsPerCoin), Decimals, units%uint64(BaseUnitsPerCoin))
+}
+
+// ParseAmount parses a decimal number of tokens such as "20", "0.5" or
+// "1.00000001" without going through floating point. Negative amounts,
+// more than Decimals decimal places and amounts above MaxMoney are rejected.
+func ParseAmount(s string) (Amount, error) {
+	s = strings.TrimSpace(s)
+	whole, frac := s, ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		whole, frac = s[:i], s[i+1:]
+	}
+	if whole == "" && frac == "" {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidAmount, s)
+	}
+	if len(frac) > Decimals {
+		return 0, fmt.Errorf("%w: %q has more than %d decimal places", ErrInvalidAmount, s, Decimals)
+	}
+	if !isDigits(whole) || !isDigits(frac) {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidAmount, s)
+	}
+
+	var coins, units int64
+	var err error
+	if whole != "" {
+		if coins, err = strconv.ParseInt(whole, 10, 64); err != nil {
+			return 0, fmt.Errorf("%w: %q", ErrInvalidAmount, s)
+		}
+	}
+	if frac != "" {
+		frac += strings.Repeat("0", Decimals-len(frac))
+		if units, err = strconv.ParseInt(frac, 10, 64); err != nil {
+			return 0, fmt.Errorf("%w: %q", ErrInvalidAmount, s)
+		}
+	}
+
+	amount, err := BaseUnitsPerCoin.MulInt(coins)
+	if err == nil {
+		amount, err = amount.Add(Amount(units))
+	}
+	if err != nil || !amount.IsValid() {
+		return 0, fmt.Errorf("%w: %q exceeds the maximum of %s", ErrInvalidAmount, s, MaxMoney)
+	}
+	return amount, nil
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Set parses s with ParseAmount, so an Amount can be used as a command line
+// flag
+func (a *Amount) Set(s string) error {
+	amount, err := ParseAmount(s)
+	if err != nil {
+		return err
+	}
+	*a = amount
+	return nil
+}
+
+// Type is the flag type shown in command line help
+func (a *Amount) Type() string {
+	return "amount"
+}
+
+// MarshalJSON writes the amount as a JSON number of tokens
+func (a Amount) MarshalJSON() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+// UnmarshalJSON accepts a JSON number or string of tokens, e.g. 0.5 or "0.5"
+func (a *Amount) UnmarshalJSON(data []byte) error {
+	s := strings.Trim(string(data), `"`)
+	if s == "null" {
+		return nil
+	}
+	amount, err := ParseAmount(s)
+	if err != nil {
+		return err
+	}
+	*a = amount
+	return nil
+}
@@ -0,0 +1,99 @@
+package blockchain
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestParseAmount(t *testing.T) {
+	for _, test := range []struct {
+		in   string
+		want Amount
+		err  error
+	}{
+		{"20", 20 * BaseUnitsPerCoin, nil},
+		{"0.5", BaseUnitsPerCoin / 2, nil},
+		{".5", BaseUnitsPerCoin / 2, nil},
+		{"1.", BaseUnitsPerCoin, nil},
+		{" 1.00000001 ", BaseUnitsPerCoin + 1, nil},
+		{"0.00000001", 1, nil},
+		{"0", 0, nil},
+		{"21000000", MaxMoney, nil},
+		{"20999999.99999999", MaxMoney - 1, nil},
+
+		// Too many decimal places, even zeros
+		{"0.000000001", 0, ErrInvalidAmount},
+		{"1.000000000", 0, ErrInvalidAmount},
+		// Negative amounts
+		{"-1", 0, ErrInvalidAmount},
+		{"-0.5", 0, ErrInvalidAmount},
+		{"+1", 0, ErrInvalidAmount},
+		// Above the maximum
+		{"21000000.00000001", 0, ErrInvalidAmount},
+		{"92233720368", 0, ErrInvalidAmount},
+		{"9223372036854775808", 0, ErrInvalidAmount},
+		// Not a number
+		{"", 0, ErrInvalidAmount},
+		{".", 0, ErrInvalidAmount},
+		{"1e8", 0, ErrInvalidAmount},
+		{"1.2.3", 0, ErrInvalidAmount},
+		{"0x10", 0, ErrInvalidAmount},
+	} {
+		got, err := ParseAmount(test.in)
+		if !errors.Is(err, test.err) {
+			t.Errorf("ParseAmount(%q) returned error %v, want %v", test.in, err, test.err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("ParseAmount(%q) = %d, want %d", test.in, got, test.want)
+		}
+	}
+}
+
+func TestAmountOverflow(t *testing.T) {
+	for _, test := range []struct {
+		a, b Amount
+		want Amount
+		err  error
+	}{
+		{1, 2, 3, nil},
+		{MaxMoney, MaxMoney, 2 * MaxMoney, nil},
+		{math.MaxInt64 - 1, 1, math.MaxInt64, nil},
+		{math.MaxInt64, 1, 0, ErrAmountOverflow},
+		{math.MaxInt64 / 2, math.MaxInt64/2 + 2, 0, ErrAmountOverflow},
+		{math.MinInt64, -1, 0, ErrAmountOverflow},
+		{math.MinInt64, 1, math.MinInt64 + 1, nil},
+	} {
+		got, err := test.a.Add(test.b)
+		if !errors.Is(err, test.err) || got != test.want {
+			t.Errorf("%d + %d = %d, %v, want %d, %v", test.a, test.b, got, err, test.want, test.err)
+		}
+	}
+
+	if _, err := SumAmounts(MaxMoney, math.MaxInt64-MaxMoney, 1); !errors.Is(err, ErrAmountOverflow) {
+		t.Errorf("an overflowing sum returned %v, want ErrAmountOverflow", err)
+	}
+}
+
+func TestFeeForSize(t *testing.T) {
+	for _, test := range []struct {
+		rate Amount
+		size int
+		want Amount
+		err  error
+	}{
+		{10, 250, 2500, nil},
+		{0, 250, 0, nil},
+		{10, 0, 0, nil},
+		{MaxMoney, 1000, 1000 * MaxMoney, nil},
+		{math.MaxInt64 / 1000, 1001, 0, ErrAmountOverflow},
+		{math.MaxInt64, 2, 0, ErrAmountOverflow},
+		{math.MaxInt64 / 2, 3, 0, ErrAmountOverflow},
+	} {
+		got, err := FeeForSize(test.rate, test.size)
+		if !errors.Is(err, test.err) || got != test.want {
+			t.Errorf("FeeForSize(%d, %d) = %d, %v, want %d, %v", test.rate, test.size, got, err, test.want, test.err)
+		}
+	}
+}
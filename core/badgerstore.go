@@ -0,0 +1,153 @@
+package blockchain
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	badger "github.com/dgraph-io/badger"
+	log "github.com/sirupsen/logrus"
+)
+
+// BadgerStore is a ChainStore kept on disk in a badger database
+type BadgerStore struct {
+	DB *badger.DB
+}
+
+// OpenBadgerStore opens or creates the badger database in dir
+func OpenBadgerStore(dir string) (*BadgerStore, error) {
+	opts := badger.DefaultOptions(dir)
+	opts.ValueDir = dir
+	db, err := OpenDB(dir, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &BadgerStore{db}, nil
+}
+
+func (store *BadgerStore) View(fn func(txn StoreTxn) error) error {
+	return store.DB.View(func(txn *badger.Txn) error {
+		return fn(badgerTxn{txn, false})
+	})
+}
+
+func (store *BadgerStore) Update(fn func(txn StoreTxn) error) error {
+	return store.DB.Update(func(txn *badger.Txn) error {
+		return fn(badgerTxn{txn, true})
+	})
+}
+
+func (store *BadgerStore) DropPrefix(prefixes ...[]byte) error {
+	for _, prefix := range prefixes {
+		if err := store.DB.DropPrefix(prefix); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (store *BadgerStore) Close() error {
+	return store.DB.Close()
+}
+
+type badgerTxn struct {
+	txn      *badger.Txn
+	writable bool
+}
+
+func (t badgerTxn) Get(key []byte) ([]byte, error) {
+	item, err := t.txn.Get(key)
+	if err == badger.ErrKeyNotFound {
+		return nil, ErrKeyNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return item.ValueCopy(nil)
+}
+
+func (t badgerTxn) Set(key, value []byte) error {
+	if !t.writable {
+		return ErrReadOnlyTxn
+	}
+	// Badger keeps the slices until the transaction commits
+	return t.txn.Set(append([]byte{}, key...), append([]byte{}, value...))
+}
+
+func (t badgerTxn) Delete(key []byte) error {
+	if !t.writable {
+		return ErrReadOnlyTxn
+	}
+	return t.txn.Delete(append([]byte{}, key...))
+}
+
+func (t badgerTxn) Iterate(prefix []byte, reverse bool, fn func(key, value []byte) error) error {
+	opts := badger.DefaultIteratorOptions
+	opts.Reverse = reverse
+	it := t.txn.NewIterator(opts)
+	defer it.Close()
+
+	// A reverse iterator seeks to the largest key at or before the one
+	// given, start right after the last key of the prefix
+	if !reverse {
+		it.Seek(prefix)
+	} else if end := successor(prefix); end != nil {
+		it.Seek(end)
+		if it.Valid() && bytes.Equal(it.Item().Key(), end) {
+			it.Next()
+		}
+	} else {
+		it.Rewind()
+	}
+
+	for ; it.ValidForPrefix(prefix); it.Next() {
+		item := it.Item()
+		value, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		if err := fn(item.KeyCopy(nil), value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func retry(dir string, originalOpts badger.Options) (*badger.DB, error) {
+	lockPath := filepath.Join(dir, "LOCK")
+
+	if err := os.Remove(lockPath); err != nil {
+		return nil, fmt.Errorf(`removing "LOCK": %s`, err)
+	}
+
+	retryOpts := originalOpts
+	retryOpts.Truncate = true
+	db, err := badger.Open(retryOpts)
+	return db, err
+}
+
+func OpenDB(dir string, opts badger.Options) (*badger.DB, error) {
+	// The directory of the network may not exist yet
+	if err := os.MkdirAll(filepath.Dir(dir), 0755); err != nil {
+		return nil, err
+	}
+
+	if db, err := badger.Open(opts); err != nil {
+
+		if strings.Contains(err.Error(), "LOCK") {
+
+			db, err := retry(dir, opts)
+			if err != nil {
+				return nil, fmt.Errorf("could not unlock database: %w", err)
+			}
+			log.Warn("database unlocked , value log truncated ")
+			return db, nil
+		}
+
+		return nil, err
+	} else {
+		return db, nil
+	}
+}
@@ -2,20 +2,19 @@ package blockchain
 
 import (
 	"bytes"
-	"encoding/gob"
 	"fmt"
 	"time"
+
+	"github.com/workspace/the-crypto-project/params"
 )
 
+// The hash of a block is the hash of its header alone, the transactions
+// are committed to through the merkle root
 type Block struct {
-	Timestamp    int64          `json:"Timestamp"`
+	BlockHeader
 	Hash         []byte         `json:"Hash"`
-	PrevHash     []byte         `json:"PrevHash"`
 	Transactions []*Transaction `json:"Transactions"`
-	Nonce        int            `json:"Nonce"`
 	Height       int            `json:"Height"`
-	MerkleRoot   []byte         `json:"MerkleRoot"`
-	Difficulty   int            `json:"Difficulty"`
 	TxCount      int            `json:"TxCount"`
 }
 
@@ -27,85 +26,114 @@ func (block *Block) HashTransactions() []byte {
 		txHashes = append(txHashes, tx.Serializer())
 	}
 
-	tree := NewMerkleTree(txHashes)
+	tree, err := NewMerkleTree(txHashes)
+	if err != nil {
+		// A block without transactions commits to nothing, CheckBlock
+		// rejects it
+		return nil
+	}
 	return tree.RootNode.Data
 }
 
-func CreateBlock(txs []*Transaction, prevHash []byte, height int) *Block {
+// CreateBlock mines a block stamped with the current time
+func CreateBlock(txs []*Transaction, prevHash []byte, height int, bits uint32) *Block {
+	return CreateBlockAt(txs, prevHash, height, bits, time.Now().Unix())
+}
+
+// CreateBlockAt mines a block stamped with timestamp, see
+// Blockchain.NextTimestamp
+func CreateBlockAt(txs []*Transaction, prevHash []byte, height int, bits uint32, timestamp int64) *Block {
 	block := &Block{
-		time.Now().Unix(),
-		[]byte{},
-		prevHash,
-		txs,
-		0,
-		height,
-		[]byte{},
-		Difficulty,
-		len(txs),
+		BlockHeader: BlockHeader{
+			Version:   BlockVersion,
+			PrevHash:  prevHash,
+			Timestamp: timestamp,
+			Bits:      bits,
+		},
+		Hash:         []byte{},
+		Transactions: txs,
+		Height:       height,
+		TxCount:      len(txs),
 	}
+	//Set MerkleRoot, the proof of work commits to it through the header
+	block.MerkleRoot = block.HashTransactions()
+
 	pow := NewProof(block)
 	nonce, hash := pow.Run()
 
 	block.Hash = hash[:]
 	block.Nonce = nonce
-	//Set MerkleRoot
-	block.MerkleRoot = block.HashTransactions()
 
 	return block
 }
 
+// Height of the first block of the chain
+const GenesisHeight = 1
+
 // Genesis block
 func Genesis(MinerTx *Transaction) *Block {
-	return CreateBlock([]*Transaction{MinerTx}, []byte{}, 1)
+	return CreateBlock([]*Transaction{MinerTx}, []byte{}, GenesisHeight, PowLimitBits())
 }
 
-// Util function for serializing blockchain data
-func (b *Block) Serialize() []byte {
-	var res bytes.Buffer
-	encoder := gob.NewEncoder(&res)
+// NetworkGenesis builds the genesis block pinned by the active network, or
+// returns nil when every chain of the network mines its own
+func NetworkGenesis() *Block {
+	p := params.Active
+	if len(p.GenesisHash) == 0 {
+		return nil
+	}
+	coinbase := &Transaction{
+		Inputs:  []TxInput{{ID: []byte{}, Out: -1, PubKey: []byte(p.GenesisData)}},
+		Outputs: []TxOutput{{Value: CalcBlockSubsidy(GenesisHeight), PubKeyHash: p.GenesisPubKeyHash}},
+	}
+	coinbase.ID = coinbase.Hash()
+
+	block := &Block{
+		BlockHeader: BlockHeader{
+			Version:   BlockVersion,
+			PrevHash:  []byte{},
+			Timestamp: p.GenesisTime,
+			Bits:      PowLimitBits(),
+			Nonce:     p.GenesisNonce,
+		},
+		Transactions: []*Transaction{coinbase},
+		Height:       GenesisHeight,
+		TxCount:      1,
+	}
+	block.MerkleRoot = block.HashTransactions()
+	block.Hash = block.BlockHeader.Hash()
+	return block
+}
 
-	err := encoder.Encode(b)
-	Handle(err)
-	return res.Bytes()
+// Util function for serializing blockchain data, see encoding.go
+// for the layout
+func (b *Block) Serialize() []byte {
+	return encodeBlock(b)
 }
 
 // Util function for De-serializing blockchain data
-func DeSerialize(data []byte) *Block {
-	var block Block
-	encoder := gob.NewDecoder(bytes.NewReader(data))
-
-	err := encoder.Decode(&block)
-	Handle(err)
-	return &block
+func DeSerialize(data []byte) (*Block, error) {
+	block, err := decodeBlock(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformedData, err)
+	}
+	return block, nil
 }
 func (b *Block) IsGenesis() bool {
-	return b.PrevHash == nil
-}
-
-// Check if the block is valid by confirming variety of information
-// in the block
-func (b *Block) IsBlockValid(oldBlock Block) bool {
-	if oldBlock.Height+1 != b.Height {
-		return false
-	}
-	res := bytes.Compare(oldBlock.Hash, b.PrevHash)
-	if res != 0 {
-		return false
-	}
-	// pow := NewProof(b)
-	// validate := pow.Validate()
-
-	return true
+	return len(b.PrevHash) == 0
 }
 
 func ConstructJSON(buffer *bytes.Buffer, block *Block) {
 	buffer.WriteString("{")
+	buffer.WriteString(fmt.Sprintf("\"%s\":%d,", "Version", block.Version))
 	buffer.WriteString(fmt.Sprintf("\"%s\":\"%d\",", "Timestamp", block.Timestamp))
 	buffer.WriteString(fmt.Sprintf("\"%s\":\"%x\",", "PrevHash", block.PrevHash))
 
 	buffer.WriteString(fmt.Sprintf("\"%s\":\"%x\",", "Hash", block.Hash))
 
-	buffer.WriteString(fmt.Sprintf("\"%s\":%d,", "Difficulty", block.Difficulty))
+	buffer.WriteString(fmt.Sprintf("\"%s\":\"%08x\",", "Bits", block.Bits))
+
+	buffer.WriteString(fmt.Sprintf("\"%s\":%f,", "Difficulty", block.Difficulty()))
 
 	buffer.WriteString(fmt.Sprintf("\"%s\":%d,", "Nonce", block.Nonce))
 
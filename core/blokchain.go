@@ -3,36 +3,28 @@ package blockchain
 import (
 	"bytes"
 	"crypto/ecdsa"
-	"encoding/gob"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"os"
-	"path/filepath"
-	"runtime"
-	"strings"
 	"sync"
 
-	badger "github.com/dgraph-io/badger"
 	log "github.com/sirupsen/logrus"
+	"github.com/workspace/the-crypto-project/params"
+	"github.com/workspace/the-crypto-project/util/datadir"
 )
 
 // Blockchain struct such that lastHash represents the lastblock hash
 // on the ledger
 type Blockchain struct {
 	LastHash   []byte
-	Database   *badger.DB
+	Database   ChainStore
 	InstanceId string
-}
 
-var (
-	mutex      = &sync.Mutex{}
-	_, b, _, _ = runtime.Caller(0)
+	reorgHandlers []func(*ReorgEvent)
+}
 
-	// Root folder of this project
-	Root        = filepath.Join(filepath.Dir(b), "../")
-	genesisData = "genesis"
-)
+var mutex = &sync.Mutex{}
 
 // Check if Blockchain Database already exist
 func DBExists(path string) bool {
@@ -46,14 +38,12 @@ func Exists(instanceId string) bool {
 	return DBExists(GetDatabasePath(instanceId))
 }
 
-func GetDatabasePath(port string) string {
-	if port != "" {
-		return filepath.Join(Root, fmt.Sprintf("./tmp/blocks_%s", port))
-	}
-	return filepath.Join(Root, "./tmp/blocks")
+// Every network keeps its blocks in its own directory of the data directory
+func GetDatabasePath(instanceId string) string {
+	return datadir.ChainDB(instanceId)
 }
 
-func OpenBardgerDB(instanceId string) *badger.DB {
+func OpenBardgerDB(instanceId string) (ChainStore, error) {
 	path := GetDatabasePath(instanceId)
 
 	// if DBExists(path) == false {
@@ -61,268 +51,375 @@ func OpenBardgerDB(instanceId string) *badger.DB {
 	// 	runtime.Goexit()
 	// }
 
-	opts := badger.DefaultOptions(path)
-	db, err := OpenDB(path, opts)
-	Handle(err)
-
-	return db
+	return OpenBadgerStore(path)
 }
 
-func (chain *Blockchain) ContinueBlockchain() *Blockchain {
+// ContinueBlockchain opens the chain of the instance, a chain that already
+// has a Database, like an in-memory one, keeps it
+func (chain *Blockchain) ContinueBlockchain() (*Blockchain, error) {
 	var lastHash []byte
-	var db *badger.DB
+	var db ChainStore
 	if chain.Database == nil {
-		db = OpenBardgerDB(chain.InstanceId)
+		var err error
+		if db, err = OpenBardgerDB(chain.InstanceId); err != nil {
+			return nil, err
+		}
 	} else {
 		db = chain.Database
 	}
 
+	report, err := Migrate(db, false)
+	if err != nil {
+		if chain.Database == nil {
+			db.Close()
+		}
+		return nil, err
+	}
+	if len(report.Steps) > 0 {
+		log.Infof("Database upgraded from schema version %d to %d", report.From, report.To)
+	}
+
 	//Read-Write Operations
-	err := db.Update(func(txn *badger.Txn) error {
-		item, err := txn.Get([]byte("lh"))
+	err = db.Update(func(txn StoreTxn) error {
+		var err error
+		lastHash, err = getLastHash(txn)
+		if errors.Is(err, ErrKeyNotFound) {
+			return ErrNoBlockchain
+		}
 		if err == nil {
-			lastHash, err = item.ValueCopy(nil)
+			// Databases created before the height index existed get
+			// it built here
+			err = indexMainChain(txn, lastHash)
+		}
+		if err == nil {
+			warnForeignGenesis(txn)
+			err = warnRepairInterrupted(txn)
 		}
 
 		return err
 	})
 
-	if err != nil {
-		lastHash = nil
+	// An empty database is a chain waiting for its first block
+	if err != nil && !errors.Is(err, ErrNoBlockchain) {
+		return nil, err
 	}
 	// log.Infof("LastHash: %x", lastHash)
-	return &Blockchain{lastHash, db, chain.InstanceId}
+	return &Blockchain{
+		LastHash:      lastHash,
+		Database:      db,
+		InstanceId:    chain.InstanceId,
+		reorgHandlers: chain.reorgHandlers,
+	}, nil
+}
+
+// warnForeignGenesis logs when the chain starts from another genesis than
+// the one the network pins, chains initialized before the genesis was
+// pinned do, peers reject their blocks
+func warnForeignGenesis(txn StoreTxn) {
+	want := params.Active.GenesisHash
+	if len(want) == 0 {
+		return
+	}
+	if hash, err := getHashAtHeight(txn, GenesisHeight); err == nil && !bytes.Equal(hash, want) {
+		log.Warnf("The chain starts from genesis block %x, not the %s genesis %x, peers will reject its blocks. Initialize a new chain to join the network.",
+			hash, params.Active.Name, want)
+	}
+}
+
+// warnRepairInterrupted logs when the last repair of the chain didn't
+// complete, the UTXO set and the indexes can't be trusted until it is run
+// again
+func warnRepairInterrupted(txn StoreTxn) error {
+	interrupted, err := repairInterrupted(txn)
+	if interrupted {
+		log.Warn("A repair of the chain was interrupted, run verifychain --repair before using it")
+	}
+	return err
 }
 
 // Initialize the blockchain by creating the blockchain database
-// with a genesis block with an address
-func InitBlockchain(address string, instanceId string) *Blockchain {
-	var lastHash []byte
+// with the genesis block of the network, or one paying address on networks
+// without a pinned genesis
+func InitBlockchain(address string, instanceId string) (*Blockchain, error) {
 	path := GetDatabasePath(instanceId)
 
 	if DBExists(path) {
-		log.Info("Blockchain already exist")
-		runtime.Goexit()
+		return nil, fmt.Errorf("blockchain already exists at %s", path)
 	}
-	// Open the Badger database located in the /tmp/blocks directory.
+	// Open the Badger database in the blocks directory of the network.
 	// It will be created if it doesn't exist.
-	opts := badger.DefaultOptions(path)
-	opts.ValueDir = path
-	db, err := OpenDB(path, opts)
-	Handle(err)
+	db, err := OpenBadgerStore(path)
+	if err != nil {
+		return nil, err
+	}
+
+	chain, err := initChain(db, address)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	chain.InstanceId = instanceId
+	return chain, nil
+}
+
+// NewMemoryBlockchain starts a chain kept in memory with the genesis block
+// of the network, or one paying address, it is lost when the process exits
+func NewMemoryBlockchain(address string) (*Blockchain, error) {
+	return initChain(NewMemoryStore(), address)
+}
+
+// initChain stores the genesis block of the network in an empty store, on
+// networks that don't pin one a new genesis paying address is mined
+func initChain(db ChainStore, address string) (*Blockchain, error) {
+	var lastHash []byte
 
 	//Read-Write Operations
-	err = db.Update(func(txn *badger.Txn) error {
-		cbtx := MinerTx(address, genesisData)
+	err := db.Update(func(txn StoreTxn) error {
+		if _, err := getLastHash(txn); err == nil {
+			return errors.New("blockchain already exists")
+		}
+		if err := setSchemaVersion(txn, SchemaVersion); err != nil {
+			return err
+		}
+
 		log.Info("No existing blockchain found")
-		genesis := Genesis(cbtx)
-		err = txn.Set(genesis.Hash, genesis.Serialize())
-		Handle(err)
-		err = txn.Set([]byte("lh"), genesis.Hash)
+		genesis := NetworkGenesis()
+		if genesis == nil {
+			cbtx, err := MinerTx(address, params.Active.GenesisData, GenesisHeight, 0)
+			if err != nil {
+				return err
+			}
+			genesis = Genesis(cbtx)
+		}
+		if err := putBlock(txn, genesis); err != nil {
+			return err
+		}
+		if _, err := setChainWork(txn, genesis); err != nil {
+			return err
+		}
 		lastHash = genesis.Hash
 
+		_, err := setMainChain(txn, genesis.Hash)
 		return err
 	})
-	Handle(err)
+	if err != nil {
+		return nil, err
+	}
 
-	return &Blockchain{lastHash, db, instanceId}
+	return &Blockchain{LastHash: lastHash, Database: db}, nil
 }
 
-// Add a block to the blockchain
+// Add a block to the blockchain, blocks that don't extend the tip are kept
+// as side chains and the chain reorganizes to whichever branch has the most
+// cumulative work. The block is stored together with the UTXO set and index
+// changes of the blocks it connects and disconnects.
 //https://github.com/dgraph-io/badger#read-write-transactions
-func (chain *Blockchain) AddBlock(block *Block) *Block {
+func (chain *Blockchain) AddBlock(block *Block) error {
+	var reorg *ReorgEvent
+	var tip []byte
 	mutex.Lock()
 
 	//Read-Write Operations
-	err := chain.Database.Update(func(txn *badger.Txn) error {
-		if _, err := txn.Get(block.Hash); err == nil {
-			return nil
+	err := chain.Database.Update(func(txn StoreTxn) error {
+		if known, err := hasBlock(txn, block.Hash); known || err != nil {
+			return err
 		}
 
-		blockData := block.Serialize()
-		err := txn.Set(block.Hash, blockData)
-		Handle(err)
+		if err := putBlock(txn, block); err != nil {
+			return err
+		}
+
+		work, err := setChainWork(txn, block)
+		if err != nil {
+			return err
+		}
 
 		// get the last block
-		item, err := txn.Get([]byte("lh"))
+		lastHash, err := getLastHash(txn)
 		if err == nil {
-			lastHash, _ := item.ValueCopy(nil)
-			item, err = txn.Get(lastHash)
-			Handle(err)
-			lastBlockData, _ := item.ValueCopy(nil)
-			lastBlock := DeSerialize(lastBlockData)
-
-			// check if the current block height is
-			// greater than the lastBlock Height
-			if block.Height > lastBlock.Height {
-				err := txn.Set([]byte("lh"), block.Hash)
-				Handle(err)
-				chain.LastHash = block.Hash
+			lastWork, err := getChainWork(txn, lastHash)
+			if err != nil {
+				return err
+			}
+			// Only a branch with more work than the current one takes over
+			if work.Cmp(lastWork) <= 0 {
+				return nil
 			}
-		} else {
-			err = txn.Set([]byte("lh"), block.Hash)
-			chain.LastHash = block.Hash
+		} else if !errors.Is(err, ErrKeyNotFound) {
+			return err
 		}
 
-		return err
-	})
+		event, err := setMainChain(txn, block.Hash)
+		if err != nil {
+			return err
+		}
+		if len(event.Disconnected) > 0 {
+			reorg = event
+		}
+		tip = block.Hash
 
-	Handle(err)
+		return nil
+	})
+	if err == nil && tip != nil {
+		chain.LastHash = tip
+	}
 	mutex.Unlock()
-	return block
+	if err != nil {
+		return fmt.Errorf("adding block %x: %w", block.Hash, err)
+	}
+
+	if reorg != nil {
+		log.Warnf("Chain reorganization: %d blocks disconnected, %d connected, fork at %x",
+			len(reorg.Disconnected), len(reorg.Connected), reorg.ForkPoint)
+		chain.notifyReorg(reorg)
+	}
+	return nil
 }
 
 // Get Block from the blockchain
 func (chain *Blockchain) GetBlock(blockHash []byte) (Block, error) {
-	var block Block
+	var block *Block
 	//Read Operations
-	err := chain.Database.View(func(txn *badger.Txn) error {
-		if item, err := txn.Get(blockHash); err != nil {
-			return errors.New("Block does not exist")
-		} else {
-			blockData, _ := item.ValueCopy(nil)
-			// Deserialize the block data
-			block = *DeSerialize(blockData)
-		}
-		return nil
+	err := chain.Database.View(func(txn StoreTxn) error {
+		var err error
+		block, err = getBlockTxn(txn, blockHash)
+		return err
 	})
 
 	if err != nil {
-		return block, err
+		return Block{}, err
 	}
 
-	return block, nil
+	return *block, nil
 }
 
-//Aggregate and get all block hashes in the blockchain
-func (chain *Blockchain) GetBlockHashes(height int) [][]byte {
+//Aggregate and get the hashes of the main chain blocks above height, lowest first
+func (chain *Blockchain) GetBlockHashes(height int) ([][]byte, error) {
 	var blocks [][]byte
 
-	iter := chain.Iterator()
-	if iter == nil {
-		return blocks
-	}
-	for {
-		block := iter.Next()
-		prevHash := block.PrevHash
-		if block.Height == height {
-			break
-		}
-		blocks = append([][]byte{block.Hash}, blocks...)
-
-		if prevHash == nil {
-			break
+	err := chain.Database.View(func(txn StoreTxn) error {
+		for h := height + 1; ; h++ {
+			hash, err := getHashAtHeight(txn, h)
+			if errors.Is(err, ErrKeyNotFound) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			blocks = append(blocks, hash)
 		}
-	}
+	})
 
-	return blocks
+	return blocks, err
 }
 
-// Get Best height basically gets the height(Index) of the lastBlock
-func (chain *Blockchain) GetBestHeight() int {
-	var lastBlock Block
+// Get Best height basically gets the height(Index) of the lastBlock, 0
+// when the chain has no blocks yet
+func (chain *Blockchain) GetBestHeight() (int, error) {
+	var lastBlock *Block
 
-	err := chain.Database.View(func(txn *badger.Txn) error {
-		item, err := txn.Get([]byte("lh"))
-		if err == nil {
-			lastHash, _ := item.ValueCopy(nil)
-
-			item, err = txn.Get(lastHash)
-			Handle(err)
-			lastBlockData, _ := item.ValueCopy(nil)
-			lastBlock = *DeSerialize(lastBlockData)
+	err := chain.Database.View(func(txn StoreTxn) error {
+		lastHash, err := getLastHash(txn)
+		if errors.Is(err, ErrKeyNotFound) {
+			return nil
 		}
-
+		if err != nil {
+			return err
+		}
+		lastBlock, err = getBlockTxn(txn, lastHash)
 		return err
 	})
 
-	if err == nil {
-		return lastBlock.Height
+	if err != nil || lastBlock == nil {
+		return 0, err
 	}
-
-	return 0
+	return lastBlock.Height, nil
 }
 
-//Mine Block Creates a new block and add it to the blockchain
-func (chain *Blockchain) MineBlock(transactions []*Transaction) *Block {
+//Mine Block Creates a new block on top of the tip and adds it to the
+// blockchain the way AddBlock adds the blocks of peers, a block of a peer
+// extending the tip meanwhile leaves the mined one on a side chain. The
+// block is checked like the blocks of peers, so transactions may spend the
+// outputs of the ones before them.
+func (chain *Blockchain) MineBlock(transactions []*Transaction) (*Block, error) {
 	var lastHash []byte
-	var lastHeight int
+	var lastBlock *Block
 
-	for _, tx := range transactions {
-		if chain.VerifyTransaction(tx) != true {
-			log.Panic("Invalid Transaction")
-		}
-	}
-	lastHash = chain.LastHash
 	//Populate lastHeight
-	err := chain.Database.View(func(txn *badger.Txn) error {
-		item, err := txn.Get([]byte("lh"))
-		Handle(err)
-		lastHash, err = item.ValueCopy(nil)
-
-		item, err = txn.Get(lastHash)
-		Handle(err)
-		lastBlockData, _ := item.ValueCopy(nil)
-
-		lastBlock := DeSerialize(lastBlockData)
+	err := chain.Database.View(func(txn StoreTxn) error {
+		var err error
+		lastHash, err = getLastHash(txn)
+		if errors.Is(err, ErrKeyNotFound) {
+			return ErrNoBlockchain
+		}
+		if err != nil {
+			return err
+		}
 
-		lastHeight = lastBlock.Height
+		lastBlock, err = getBlockTxn(txn, lastHash)
 		return err
 	})
+	if err != nil {
+		return nil, err
+	}
 
-	Handle(err)
-
-	block := CreateBlock(transactions, lastHash, lastHeight+1)
-	// Read-write
-	err = chain.Database.Update(func(txn *badger.Txn) error {
-		err := txn.Set(block.Hash, block.Serialize())
-		Handle(err)
-		err = txn.Set([]byte("lh"), block.Hash)
-
-		chain.LastHash = lastHash
+	bits, err := chain.CalcNextBits(lastBlock)
+	if err != nil {
+		return nil, err
+	}
 
-		return err
-	})
+	timestamp, err := chain.NextTimestamp(lastBlock)
+	if err != nil {
+		return nil, err
+	}
 
-	Handle(err)
-	return block
+	block := CreateBlockAt(transactions, lastHash, lastBlock.Height+1, bits, timestamp)
+	if err := chain.ValidateBlock(block); err != nil {
+		return nil, err
+	}
+	if err := chain.AddBlock(block); err != nil {
+		return nil, err
+	}
+	return block, nil
 }
 
-func DeserializeTransaction(data []byte) Transaction {
-	var transaction Transaction
-
-	dec := gob.NewDecoder(bytes.NewReader(data))
-	err := dec.Decode(&transaction)
-	Handle(err)
-	return transaction
+func DeserializeTransaction(data []byte) (Transaction, error) {
+	transaction, err := decodeTransaction(data)
+	if err != nil {
+		return Transaction{}, fmt.Errorf("%w: %v", ErrMalformedData, err)
+	}
+	return *transaction, nil
 }
 
 // Aggregate all Unspent Transaction output from the blockchain
-func (chain *Blockchain) FindUTXO() map[string]TxOutputs {
+func (chain *Blockchain) FindUTXO() (map[string]TxOutputs, error) {
 	UTXOs := make(map[string]TxOutputs)
 	spentTXOs := make(map[string][]int)
 
 	iter := chain.Iterator()
+	if iter == nil {
+		return UTXOs, nil
+	}
 
 	for {
-		block := iter.Next()
+		block, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
 
-		for _, tx := range block.Transactions {
+		// Blocks and their transactions are visited backwards, every spend
+		// of the outputs of tx has been seen already
+		for i := len(block.Transactions) - 1; i >= 0; i-- {
+			tx := block.Transactions[i]
 			//Convert transaction ID to string
 			txID := hex.EncodeToString(tx.ID)
 
-		Outputs:
-			for outIdx, out := range tx.Outputs {
-				if spentTXOs[txID] != nil {
-					for _, spentOut := range spentTXOs[txID] {
-						if spentOut == outIdx {
-							continue Outputs
-						}
-					}
-				}
+			outs := NewTxOutputs(tx, block.Height)
+			for _, spentOut := range spentTXOs[txID] {
+				outs.Spend(spentOut)
+			}
+			if !outs.IsEmpty() {
 				//Add to UTXO
-				outs := UTXOs[txID]
-				outs.Outputs = append(outs.Outputs, out)
 				UTXOs[txID] = outs
 			}
 			if !tx.IsMinerTx() {
@@ -337,88 +434,99 @@ func (chain *Blockchain) FindUTXO() map[string]TxOutputs {
 			break
 		}
 	}
-	return UTXOs
+	return UTXOs, nil
 }
 
 //Find a specific transaction by ID
 func (chain *Blockchain) FindTransaction(ID []byte) (Transaction, error) {
-	iter := chain.Iterator()
+	tx, _, err := chain.LocateTransaction(ID)
+	return tx, err
+}
 
-	for {
-		block := iter.Next()
+// LocateTransaction finds a main chain transaction by ID along with the
+// block it is in. It is a single lookup when the transaction index is
+// enabled and a scan from the tip otherwise.
+func (chain *Blockchain) LocateTransaction(ID []byte) (Transaction, TxLocation, error) {
+	if chain.LastHash == nil {
+		return Transaction{}, TxLocation{}, fmt.Errorf("%w: %x", ErrTxNotFound, ID)
+	}
+	return chain.findTransactionFrom(chain.LastHash, ID)
+}
+
+// Find a transaction by ID in the branch that ends with the block blockHash
+func (chain *Blockchain) findTransactionFrom(blockHash, ID []byte) (Transaction, TxLocation, error) {
+	var tx Transaction
+	var loc TxLocation
+	err := chain.Database.View(func(txn StoreTxn) error {
+		var err error
+		tx, loc, err = findTransactionTxn(txn, blockHash, ID)
+		return err
+	})
+	return tx, loc, err
+}
+
+func findTransactionTxn(txn StoreTxn, blockHash, ID []byte) (Transaction, TxLocation, error) {
+	tx, loc, indexed, err := findIndexedTransaction(txn, blockHash, ID)
+	if indexed {
+		return tx, loc, err
+	}
+	if err != nil {
+		log.Warnf("Transaction index lookup failed, scanning the chain: %v", err)
+	}
+
+	for hash := blockHash; ; {
+		block, err := getBlockTxn(txn, hash)
+		if err != nil {
+			return Transaction{}, TxLocation{}, err
+		}
 
-		for _, tx := range block.Transactions {
+		for i, tx := range block.Transactions {
 			if bytes.Compare(tx.ID, ID) == 0 {
-				return *tx, nil
+				return *tx, TxLocation{block.Hash, block.Height, i}, nil
 			}
 		}
 		if len(block.PrevHash) == 0 {
 			break
 		}
+		hash = block.PrevHash
 	}
-	log.Error("Error: No Transaction with ID")
 
-	return Transaction{}, errors.New("No transaction with id")
+	return Transaction{}, TxLocation{}, fmt.Errorf("%w: %x", ErrTxNotFound, ID)
 }
 
-func (chain *Blockchain) GetTransaction(transaction *Transaction) map[string]Transaction {
+// GetTransaction returns the main chain transactions whose outputs the inputs
+// of transaction spend, by hex encoded ID
+func (chain *Blockchain) GetTransaction(transaction *Transaction) (map[string]Transaction, error) {
 	txs := make(map[string]Transaction)
 	for _, in := range transaction.Inputs {
 		// get all transaction with in.ID
 		tx, err := chain.FindTransaction(in.ID)
 		if err != nil {
-			log.Error("Error: Invalid Transaction Ewwww")
+			return nil, err
 		}
-		Handle(err)
 		txs[hex.EncodeToString(tx.ID)] = tx
 	}
 
-	return txs
+	return txs, nil
 }
 
-func (chain *Blockchain) SignTransaction(privKey ecdsa.PrivateKey, tx *Transaction) {
-	prevTxs := chain.GetTransaction(tx)
-	tx.Sign(privKey, prevTxs)
+func (chain *Blockchain) SignTransaction(privKey ecdsa.PrivateKey, tx *Transaction) error {
+	prevTxs, err := chain.GetTransaction(tx)
+	if err != nil {
+		return err
+	}
+	return tx.Sign(privKey, prevTxs)
 }
 
-func (chain *Blockchain) VerifyTransaction(tx *Transaction) bool {
+// VerifyTransaction checks the signatures of tx against the main chain
+func (chain *Blockchain) VerifyTransaction(tx *Transaction) error {
 	if tx.IsMinerTx() {
-		return true
+		return nil
 	}
-	prevTxs := chain.GetTransaction(tx)
-
-	return tx.Verify(prevTxs)
-}
-
-func retry(dir string, originalOpts badger.Options) (*badger.DB, error) {
-	lockPath := filepath.Join(dir, "LOCK")
-
-	if err := os.Remove(lockPath); err != nil {
-		return nil, fmt.Errorf(`removing "LOCK": %s`, err)
+	prevTxs, err := chain.GetTransaction(tx)
+	if err != nil {
+		return err
 	}
 
-	retryOpts := originalOpts
-	retryOpts.Truncate = true
-	db, err := badger.Open(retryOpts)
-	return db, err
-}
-
-func OpenDB(dir string, opts badger.Options) (*badger.DB, error) {
-
-	if db, err := badger.Open(opts); err != nil {
-
-		if strings.Contains(err.Error(), "LOCK") {
-
-			if db, err := retry(dir, opts); err == nil {
-				log.Panicln("database unlocked , value log truncated ")
-				return db, nil
-			}
-
-			log.Panicln("could not unlock database", err)
-		}
-
-		return nil, err
-	} else {
-		return db, nil
-	}
+	return tx.Verify(prevTxs)
 }
@@ -0,0 +1,46 @@
+package blockchain
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMineBlockParentAndChild(t *testing.T) {
+	a, b := newTestWallet(t), newTestWallet(t)
+	chain := newTestChain(t, a)
+	coinbase := genesisCoinbase(t, chain)
+	value := coinbase.Outputs[0].Value
+
+	// The child pays for its parent, both go in the same block
+	parent := spendTx(t, a, coinbase, 0, []string{b.address}, []Amount{value - 100})
+	child := spendTx(t, b, parent, 0, []string{a.address}, []Amount{value - 10000})
+	txs, err := chain.AssembleBlock(a.address, []*Transaction{child, parent})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(txs) != 3 {
+		t.Fatalf("assembled %d transactions, want the coinbase, the parent and the child", len(txs))
+	}
+	block, err := chain.MineBlock(txs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(chain.LastHash, block.Hash) {
+		t.Fatal("the mined block is not the tip")
+	}
+	if _, err := chain.FindTransaction(child.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// Blocks breaking the rules are refused before they are added
+	respend := spendTx(t, a, coinbase, 0, []string{a.address}, []Amount{value - 1000})
+	miner, err := MinerTx(a.address, "", block.Height+1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = chain.MineBlock([]*Transaction{miner, respend})
+	wantRule(t, err, RejectMissingInputs)
+	if !bytes.Equal(chain.LastHash, block.Hash) {
+		t.Fatal("an invalid mined block moved the tip")
+	}
+}
@@ -0,0 +1,138 @@
+package blockchain
+
+import (
+	"math/big"
+
+	"github.com/workspace/the-crypto-project/params"
+)
+
+// PowLimitBits returns the easiest target of the active network in its
+// compact form, used by the genesis block
+func PowLimitBits() uint32 {
+	return BigToCompact(params.Active.PowLimit)
+}
+
+// CompactToBig converts the compact "bits" representation of a target to a
+// big integer. Like in bitcoin the most significant byte is a base 256
+// exponent and the lower 23 bits are the mantissa, bit 24 is the sign:
+//
+//	target = mantissa * 256^(exponent-3)
+func CompactToBig(compact uint32) *big.Int {
+	mantissa := compact & 0x007fffff
+	isNegative := compact&0x00800000 != 0
+	exponent := uint(compact >> 24)
+
+	var bn *big.Int
+	if exponent <= 3 {
+		mantissa >>= 8 * (3 - exponent)
+		bn = big.NewInt(int64(mantissa))
+	} else {
+		bn = big.NewInt(int64(mantissa))
+		bn.Lsh(bn, 8*(exponent-3))
+	}
+
+	if isNegative {
+		bn = bn.Neg(bn)
+	}
+
+	return bn
+}
+
+// BigToCompact converts a target to its compact "bits" representation,
+// precision beyond the 3 byte mantissa is lost
+func BigToCompact(n *big.Int) uint32 {
+	if n.Sign() == 0 {
+		return 0
+	}
+
+	var mantissa uint32
+	exponent := uint(len(n.Bytes()))
+	if exponent <= 3 {
+		mantissa = uint32(new(big.Int).Abs(n).Uint64())
+		mantissa <<= 8 * (3 - exponent)
+	} else {
+		tn := new(big.Int).Abs(n)
+		mantissa = uint32(tn.Rsh(tn, 8*(exponent-3)).Uint64())
+	}
+
+	// The sign bit is set, move the mantissa one byte down
+	if mantissa&0x00800000 != 0 {
+		mantissa >>= 8
+		exponent++
+	}
+
+	compact := uint32(exponent<<24) | mantissa
+	if n.Sign() < 0 {
+		compact |= 0x00800000
+	}
+
+	return compact
+}
+
+// CalcNextBits returns the bits the block following parent must carry.
+// Every RetargetInterval blocks of the active network the target is scaled by
+// how far the last interval drifted from TargetBlockTime, in between it stays
+// the same.
+func (chain *Blockchain) CalcNextBits(parent *Block) (uint32, error) {
+	if parent == nil {
+		return PowLimitBits(), nil
+	}
+
+	interval := params.Active.RetargetInterval
+	height := parent.Height + 1
+	if interval == 0 || (height-1)%interval != 0 {
+		return parent.Bits, nil
+	}
+
+	first := parent
+	for i := 0; i < interval-1 && !first.IsGenesis(); i++ {
+		block, err := chain.GetBlock(first.PrevHash)
+		if err != nil {
+			return 0, err
+		}
+		first = &block
+	}
+
+	return calcRetarget(parent.Bits, first.Timestamp, parent.Timestamp,
+		int64(parent.Height-first.Height)), nil
+}
+
+// calcRetarget scales the target of bits by the actual time it took to mine
+// the given number of intervals over the time it should have taken
+func calcRetarget(bits uint32, firstTime, lastTime, intervals int64) uint32 {
+	if intervals <= 0 {
+		return bits
+	}
+
+	p := params.Active
+	expected := intervals * p.TargetBlockTime
+	actual := lastTime - firstTime
+	if actual < expected/p.MaxRetargetFactor {
+		actual = expected / p.MaxRetargetFactor
+	}
+	if actual > expected*p.MaxRetargetFactor {
+		actual = expected * p.MaxRetargetFactor
+	}
+
+	target := CompactToBig(bits)
+	target.Mul(target, big.NewInt(actual))
+	target.Div(target, big.NewInt(expected))
+
+	if target.Cmp(p.PowLimit) > 0 {
+		target.Set(p.PowLimit)
+	}
+
+	return BigToCompact(target)
+}
+
+// Difficulty expresses the target of the block as a multiple of the
+// easiest target allowed
+func (b *Block) Difficulty() float64 {
+	target := CompactToBig(b.Bits)
+	if target.Sign() <= 0 {
+		return 0
+	}
+
+	difficulty, _ := new(big.Float).Quo(new(big.Float).SetInt(params.Active.PowLimit), new(big.Float).SetInt(target)).Float64()
+	return difficulty
+}
@@ -0,0 +1,372 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Version of the transaction encoding
+const TxVersion = 1
+
+// Blocks and transactions are stored and sent over the wire in a fixed,
+// deterministic binary layout so any client can rebuild them byte for byte.
+// All integers are big endian, byte strings are prefixed with their length
+// as a uint32 ("varbytes").
+//
+// Block:
+//
+//	header        88 bytes, see BlockHeader
+//	height        uint32
+//	tx count      uint32
+//	transactions  tx count times Transaction
+//
+// Transaction, the transaction ID is the sha256 of this encoding. It
+// covers the signatures, and an ECDSA signature (r, s) is just as valid as
+// (r, n-s), so whoever relays a transaction can change its ID without
+// invalidating it. Only the ID of a confirmed transaction is final, senders
+// should follow an unconfirmed payment by the outputs it spends. IDs of the
+// stored chains depend on this layout, it can't drop the signatures without
+// a new TxVersion.
+//
+//	version       uint32 (TxVersion)
+//	input count   uint32
+//	inputs        input count times TxInput
+//	output count  uint32
+//	outputs       output count times TxOutput
+//
+// TxInput:
+//
+//	txid          varbytes, empty for the coinbase
+//	out           int32, -1 for the coinbase
+//	signature     varbytes
+//	pubkey        varbytes, arbitrary data for the coinbase
+//
+// TxOutput:
+//
+//	value         int64, Amount in base units
+//	pubkeyhash    varbytes
+//
+// TxOutputs, the value of an entry in the UTXO set, spent outputs are empty
+// TxOutputs (zero value and no pubkeyhash):
+//
+//	height        uint32, height of the block of the transaction
+//	coinbase      uint8, 1 if the transaction is a coinbase
+//	output count  uint32
+//	outputs       output count times TxOutput
+//
+// Undo record of a block, the outputs it spent in the order it spent them:
+//
+//	spent count   uint32
+//	spent         spent count times SpentOutput
+//
+// SpentOutput:
+//
+//	txid          varbytes
+//	out           uint32
+//	height        uint32, height of the block of the transaction
+//	coinbase      uint8, 1 if the transaction is a coinbase
+//	output        TxOutput
+
+var errShortRead = errors.New("unexpected end of data")
+
+type encoder struct {
+	buf bytes.Buffer
+}
+
+func (e *encoder) uint32(v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	e.buf.Write(b[:])
+}
+
+func (e *encoder) uint8(v uint8) {
+	e.buf.WriteByte(v)
+}
+
+func (e *encoder) uint64(v uint64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	e.buf.Write(b[:])
+}
+
+func (e *encoder) varBytes(v []byte) {
+	e.uint32(uint32(len(v)))
+	e.buf.Write(v)
+}
+
+func (e *encoder) input(in *TxInput) {
+	e.varBytes(in.ID)
+	e.uint32(uint32(int32(in.Out)))
+	e.varBytes(in.Signature)
+	e.varBytes(in.PubKey)
+}
+
+func (e *encoder) output(out *TxOutput) {
+	e.uint64(uint64(out.Value))
+	e.varBytes(out.PubKeyHash)
+}
+
+func (e *encoder) transaction(tx *Transaction) {
+	e.uint32(TxVersion)
+	e.uint32(uint32(len(tx.Inputs)))
+	for i := range tx.Inputs {
+		e.input(&tx.Inputs[i])
+	}
+	e.uint32(uint32(len(tx.Outputs)))
+	for i := range tx.Outputs {
+		e.output(&tx.Outputs[i])
+	}
+}
+
+// decoder reads the layout written by encoder, the first error sticks and
+// every later read returns zero values
+type decoder struct {
+	data []byte
+	err  error
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || len(d.data) < n {
+		d.err = errShortRead
+		return nil
+	}
+	b := d.data[:n]
+	d.data = d.data[n:]
+	return b
+}
+
+func (d *decoder) uint32() uint32 {
+	b := d.next(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func (d *decoder) uint8() uint8 {
+	b := d.next(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (d *decoder) uint64() uint64 {
+	b := d.next(8)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b)
+}
+
+func (d *decoder) varBytes() []byte {
+	n := d.uint32()
+	if d.err != nil {
+		return nil
+	}
+	if uint64(n) > uint64(len(d.data)) {
+		d.err = errShortRead
+		return nil
+	}
+	if n == 0 {
+		d.next(0)
+		return nil
+	}
+	return append([]byte{}, d.next(int(n))...)
+}
+
+// count reads an element count and makes sure the remaining data can hold
+// that many elements of at least minSize bytes
+func (d *decoder) count(minSize int) int {
+	n := d.uint32()
+	if d.err != nil {
+		return 0
+	}
+	if uint64(n)*uint64(minSize) > uint64(len(d.data)) {
+		d.err = errShortRead
+		return 0
+	}
+	return int(n)
+}
+
+func (d *decoder) input() TxInput {
+	var in TxInput
+	in.ID = d.varBytes()
+	in.Out = int(int32(d.uint32()))
+	in.Signature = d.varBytes()
+	in.PubKey = d.varBytes()
+	return in
+}
+
+func (d *decoder) output() TxOutput {
+	var out TxOutput
+	out.Value = Amount(d.uint64())
+	out.PubKeyHash = d.varBytes()
+	return out
+}
+
+func (d *decoder) outputs() []TxOutput {
+	n := d.count(12)
+	outputs := make([]TxOutput, 0, n)
+	for i := 0; i < n && d.err == nil; i++ {
+		outputs = append(outputs, d.output())
+	}
+	return outputs
+}
+
+func (d *decoder) transaction() *Transaction {
+	var tx Transaction
+	start := d.data
+
+	if version := d.uint32(); d.err == nil && version != TxVersion {
+		d.err = fmt.Errorf("unknown transaction version %d", version)
+		return nil
+	}
+	n := d.count(16)
+	tx.Inputs = make([]TxInput, 0, n)
+	for i := 0; i < n && d.err == nil; i++ {
+		tx.Inputs = append(tx.Inputs, d.input())
+	}
+	tx.Outputs = d.outputs()
+	if d.err != nil {
+		return nil
+	}
+
+	// The ID is not part of the encoding, it is the hash of it
+	tx.ID = hashBytes(start[:len(start)-len(d.data)])
+	return &tx
+}
+
+func (d *decoder) finish() error {
+	if d.err == nil && len(d.data) != 0 {
+		d.err = fmt.Errorf("%d unexpected trailing bytes", len(d.data))
+	}
+	return d.err
+}
+
+func hashBytes(data []byte) []byte {
+	hash := sha256.Sum256(data)
+	return hash[:]
+}
+
+func encodeTransaction(tx *Transaction) []byte {
+	var e encoder
+	e.transaction(tx)
+	return e.buf.Bytes()
+}
+
+func decodeTransaction(data []byte) (*Transaction, error) {
+	d := decoder{data: data}
+	tx := d.transaction()
+	if err := d.finish(); err != nil {
+		return nil, fmt.Errorf("decoding transaction: %w", err)
+	}
+	return tx, nil
+}
+
+func encodeBlock(b *Block) []byte {
+	var e encoder
+	e.buf.Write(b.BlockHeader.Serialize())
+	e.uint32(uint32(b.Height))
+	e.uint32(uint32(len(b.Transactions)))
+	for _, tx := range b.Transactions {
+		e.transaction(tx)
+	}
+	return e.buf.Bytes()
+}
+
+func decodeBlock(data []byte) (*Block, error) {
+	var block Block
+	var err error
+
+	if len(data) < BlockHeaderSize {
+		return nil, fmt.Errorf("decoding block: %w", errShortRead)
+	}
+	if block.BlockHeader, err = DeserializeBlockHeader(data[:BlockHeaderSize]); err != nil {
+		return nil, fmt.Errorf("decoding block: %w", err)
+	}
+
+	d := decoder{data: data[BlockHeaderSize:]}
+	block.Height = int(d.uint32())
+	n := d.count(12)
+	block.Transactions = make([]*Transaction, 0, n)
+	for i := 0; i < n && d.err == nil; i++ {
+		block.Transactions = append(block.Transactions, d.transaction())
+	}
+	if err := d.finish(); err != nil {
+		return nil, fmt.Errorf("decoding block: %w", err)
+	}
+
+	block.TxCount = len(block.Transactions)
+	block.Hash = block.BlockHeader.Hash()
+	return &block, nil
+}
+
+func encodeOutputs(outputs *TxOutputs) []byte {
+	var e encoder
+	e.uint32(uint32(outputs.Height))
+	if outputs.Coinbase {
+		e.uint8(1)
+	} else {
+		e.uint8(0)
+	}
+	e.uint32(uint32(len(outputs.Outputs)))
+	for i := range outputs.Outputs {
+		e.output(&outputs.Outputs[i])
+	}
+	return e.buf.Bytes()
+}
+
+func decodeOutputs(data []byte) (TxOutputs, error) {
+	var outputs TxOutputs
+	d := decoder{data: data}
+	outputs.Height = int(d.uint32())
+	outputs.Coinbase = d.uint8() == 1
+	outputs.Outputs = d.outputs()
+	if err := d.finish(); err != nil {
+		return TxOutputs{}, fmt.Errorf("decoding outputs: %w", err)
+	}
+	return outputs, nil
+}
+
+func encodeUndo(spent []SpentOutput) []byte {
+	var e encoder
+	e.uint32(uint32(len(spent)))
+	for i := range spent {
+		e.varBytes(spent[i].TxID)
+		e.uint32(uint32(spent[i].Out))
+		e.uint32(uint32(spent[i].Height))
+		if spent[i].Coinbase {
+			e.uint8(1)
+		} else {
+			e.uint8(0)
+		}
+		e.output(&spent[i].Output)
+	}
+	return e.buf.Bytes()
+}
+
+func decodeUndo(data []byte) ([]SpentOutput, error) {
+	d := decoder{data: data}
+	n := d.count(25)
+	spent := make([]SpentOutput, 0, n)
+	for i := 0; i < n && d.err == nil; i++ {
+		var s SpentOutput
+		s.TxID = d.varBytes()
+		s.Out = int(d.uint32())
+		s.Height = int(d.uint32())
+		s.Coinbase = d.uint8() == 1
+		s.Output = d.output()
+		spent = append(spent, s)
+	}
+	if err := d.finish(); err != nil {
+		return nil, fmt.Errorf("decoding undo record: %w", err)
+	}
+	return spent, nil
+}
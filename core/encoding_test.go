@@ -0,0 +1,184 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func testTransaction() *Transaction {
+	tx := &Transaction{
+		Inputs: []TxInput{
+			{ID: bytes.Repeat([]byte{0x11}, 32), Out: 0, Signature: bytes.Repeat([]byte{0x22}, 64), PubKey: bytes.Repeat([]byte{0x33}, 64)},
+			{ID: bytes.Repeat([]byte{0x44}, 32), Out: 7, Signature: bytes.Repeat([]byte{0x55}, 64), PubKey: bytes.Repeat([]byte{0x66}, 64)},
+		},
+		Outputs: []TxOutput{
+			{Value: 150000000, PubKeyHash: bytes.Repeat([]byte{0x77}, 20)},
+			{Value: 1, PubKeyHash: bytes.Repeat([]byte{0x88}, 20)},
+		},
+	}
+	tx.ID = tx.Hash()
+	return tx
+}
+
+// The coinbase examples/python/tx.py builds, clients in other languages
+// must produce the same bytes
+func TestTransactionVector(t *testing.T) {
+	tx := &Transaction{
+		Inputs:  []TxInput{{ID: []byte{}, Out: -1, PubKey: []byte("abc")}},
+		Outputs: []TxOutput{{Value: 20 * 100000000, PubKeyHash: mustHex(t, "bdde8b26b7a209e75bdb744f5dfd2d5b0f9dad03")}},
+	}
+	want := mustHex(t, "000000010000000100000000ffffffff000000000000000361626300000001000000007735940000000014bdde8b26b7a209e75bdb744f5dfd2d5b0f9dad03")
+	if got := tx.Serializer(); !bytes.Equal(got, want) {
+		t.Fatalf("encoded as %x, want %x", got, want)
+	}
+	if got, want := tx.Hash(), mustHex(t, "6be69451dc179a8f30ba98045415f7c9069628c233184dd6dffa617c99cb09d4"); !bytes.Equal(got, want) {
+		t.Fatalf("ID %x, want %x", got, want)
+	}
+	decoded, err := DeserializeTransaction(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decoded.ID, tx.Hash()) || !decoded.IsMinerTx() {
+		t.Fatalf("decoded %v", &decoded)
+	}
+}
+
+func TestBlockHeaderVector(t *testing.T) {
+	h := BlockHeader{
+		Version:    1,
+		PrevHash:   mustHex(t, "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"),
+		MerkleRoot: mustHex(t, "202122232425262728292a2b2c2d2e2f303132333435363738393a3b3c3d3e3f"),
+		Timestamp:  1600000000,
+		Bits:       0x207fffff,
+		Nonce:      42,
+	}
+	want := mustHex(t, "00000001000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"+
+		"202122232425262728292a2b2c2d2e2f303132333435363738393a3b3c3d3e3f000000005f5e1000207fffff000000000000002a")
+	if got := h.Serialize(); !bytes.Equal(got, want) {
+		t.Fatalf("encoded as %x, want %x", got, want)
+	}
+	if got, want := h.Hash(), mustHex(t, "02bc2570b33b645366eb31698122e60988a6b175a19b7b2182ad0033a654973c"); !bytes.Equal(got, want) {
+		t.Fatalf("hash %x, want %x", got, want)
+	}
+
+	decoded, err := DeserializeBlockHeader(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, h) {
+		t.Fatalf("decoded %+v, want %+v", decoded, h)
+	}
+}
+
+func TestTransactionRoundTrip(t *testing.T) {
+	tx := testTransaction()
+	decoded, err := DeserializeTransaction(tx.Serializer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&decoded, tx) {
+		t.Fatalf("decoded %v, want %v", &decoded, tx)
+	}
+}
+
+func TestBlockRoundTrip(t *testing.T) {
+	w := newTestWallet(t)
+	coinbase, err := MinerTx(w.address, "round trip", 2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := CreateBlock([]*Transaction{coinbase, testTransaction()}, bytes.Repeat([]byte{0x99}, 32), 2, PowLimitBits())
+
+	decoded, err := DeSerialize(block.Serialize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Empty byte strings decode as nil, compare the encodings
+	if !bytes.Equal(decoded.Serialize(), block.Serialize()) || !bytes.Equal(decoded.Hash, block.Hash) ||
+		decoded.Height != block.Height || decoded.TxCount != block.TxCount {
+		t.Fatalf("decoded %+v, want %+v", decoded, block)
+	}
+	if !reflect.DeepEqual(decoded.BlockHeader, block.BlockHeader) || !reflect.DeepEqual(decoded.Transactions[1], block.Transactions[1]) {
+		t.Fatalf("decoded %+v, want %+v", decoded, block)
+	}
+	if !bytes.Equal(decoded.HashTransactions(), block.MerkleRoot) {
+		t.Fatal("decoded transactions don't match the merkle root")
+	}
+
+	genesis := Genesis(coinbase)
+	decoded, err = DeSerialize(genesis.Serialize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.IsGenesis() || !bytes.Equal(decoded.Hash, genesis.Hash) {
+		t.Fatalf("genesis decoded as %+v", decoded)
+	}
+}
+
+func TestOutputsRoundTrip(t *testing.T) {
+	outputs := TxOutputs{
+		Outputs: []TxOutput{
+			{Value: 5, PubKeyHash: bytes.Repeat([]byte{0x01}, 20)},
+			{},
+			{Value: MaxMoney, PubKeyHash: bytes.Repeat([]byte{0x02}, 20)},
+		},
+		Height:   12,
+		Coinbase: true,
+	}
+	decoded, err := DeSerializeOutputs(outputs.Serialize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.Outputs[1].IsSpent() || decoded.Height != 12 || !decoded.Coinbase {
+		t.Fatalf("decoded %+v, want %+v", decoded, outputs)
+	}
+	decoded.Outputs[1] = TxOutput{}
+	if !reflect.DeepEqual(decoded, outputs) {
+		t.Fatalf("decoded %+v, want %+v", decoded, outputs)
+	}
+
+	spent := []SpentOutput{{TxID: bytes.Repeat([]byte{0x03}, 32), Out: 2, Output: outputs.Outputs[0], Height: 3, Coinbase: true}}
+	undo, err := decodeUndo(encodeUndo(spent))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(undo, spent) {
+		t.Fatalf("decoded undo record %+v, want %+v", undo, spent)
+	}
+}
+
+func TestDecodeRejectsMalformedData(t *testing.T) {
+	data := testTransaction().Serializer()
+	for _, bad := range [][]byte{
+		nil,
+		data[:len(data)-1],
+		append(append([]byte{}, data...), 0),
+		// Unknown version
+		append([]byte{0, 0, 0, 2}, data[4:]...),
+		// Claims more inputs than there are bytes for
+		append(append([]byte{}, data[:4]...), 0xff, 0xff, 0xff, 0xff),
+	} {
+		if _, err := DeserializeTransaction(bad); err == nil {
+			t.Fatalf("decoded %x", bad)
+		}
+	}
+
+	block := CreateBlock([]*Transaction{testTransaction()}, nil, 1, PowLimitBits()).Serialize()
+	if _, err := DeSerialize(block[:len(block)-1]); err == nil {
+		t.Fatal("decoded a truncated block")
+	}
+	if _, err := DeSerialize(block[:BlockHeaderSize-1]); err == nil {
+		t.Fatal("decoded a truncated header")
+	}
+}
@@ -1,12 +1,25 @@
 package blockchain
 
-import (
-	log "github.com/sirupsen/logrus"
-)
-
-func Handle(err error) {
+import "errors"
 
-	if err != nil {
-		log.Panic(err)
-	}
-}
+// Errors returned by the blockchain, they are wrapped with the details of
+// the failure so compare them with errors.Is
+var (
+	// No blockchain database has been initialized
+	ErrNoBlockchain  = errors.New("no existing blockchain found")
+	ErrBlockNotFound = errors.New("block not found")
+	ErrTxNotFound    = errors.New("transaction not found")
+	// An input spends an output that is not in the UTXO set
+	ErrOutputNotFound = errors.New("output not found")
+	// Stored or received bytes that don't decode
+	ErrMalformedData    = errors.New("malformed data")
+	ErrInvalidSignature = errors.New("invalid signature")
+	// A store this node can neither read nor upgrade, its chain must be
+	// synced again
+	ErrIncompatibleStore = errors.New("incompatible store, resync required")
+	// The last repair of the chain didn't complete, the UTXO set and the
+	// indexes are partial until it is run again
+	ErrRepairInterrupted = errors.New("a repair of the chain was interrupted")
+	// The wallet doesn't have the outputs to pay an amount and its fee
+	ErrInsufficientFunds = errors.New("insufficient funds")
+)
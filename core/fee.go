@@ -0,0 +1,239 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	"math/bits"
+)
+
+const (
+	// Fee rate in base units per byte used when the sender doesn't set one
+	DefaultFeeRate Amount = 10
+	// Largest serialized block, in bytes, the network accepts
+	MaxBlockSize = 1 << 20
+
+	// Sizes of the parts of a signed transaction, see core/encoding.go
+	txOverheadSize = 4 + 4 + 4
+	txInputSize    = 4 + 32 + 4 + 4 + 64 + 4 + 64
+	txOutputSize   = 8 + 4 + 20
+)
+
+// Size of the serialized transaction in bytes, fees are charged on it
+func (tx *Transaction) Size() int {
+	return len(tx.Serializer())
+}
+
+// estimateTxSize returns the size of a signed transaction with the given
+// number of inputs and outputs, before it is built
+func estimateTxSize(inputs, outputs int) int {
+	return txOverheadSize + inputs*txInputSize + outputs*txOutputSize
+}
+
+// FeeForSize returns the fee a transaction of size bytes pays at feeRate
+func FeeForSize(feeRate Amount, size int) (Amount, error) {
+	return feeRate.MulInt(int64(size))
+}
+
+// TransactionFee returns what tx leaves to the miner, the value of its
+// inputs minus the value of its outputs, checked against the current tip
+func (chain *Blockchain) TransactionFee(tx *Transaction) (Amount, error) {
+	if tx.IsMinerTx() {
+		return 0, nil
+	}
+	if err := checkTransactionSanity(tx); err != nil {
+		return 0, err
+	}
+	tip, err := chain.GetBlock(chain.LastHash)
+	if err != nil {
+		return 0, err
+	}
+	return chain.validateAtTip(tx, &tip, map[string]Transaction{})
+}
+
+// validateAtTip runs validateTransaction for a block on top of tip
+func (chain *Blockchain) validateAtTip(tx *Transaction, tip *Block, inBlock map[string]Transaction) (Amount, error) {
+	var fee Amount
+	err := chain.Database.View(func(txn StoreTxn) error {
+		var err error
+		fee, err = validateTransaction(txn, tx, tip.Height+1, inBlock)
+		return err
+	})
+	return fee, err
+}
+
+// HigherFeeRate reports whether feeA/sizeA is greater than feeB/sizeB
+// without losing precision to a division
+func HigherFeeRate(feeA Amount, sizeA int, feeB Amount, sizeB int) bool {
+	hiA, loA := bits.Mul64(uint64(feeA), uint64(sizeB))
+	hiB, loB := bits.Mul64(uint64(feeB), uint64(sizeA))
+	return hiA > hiB || (hiA == hiB && loA > loB)
+}
+
+type blockCandidate struct {
+	tx   *Transaction
+	fee  Amount
+	size int
+	// Candidates whose outputs tx spends, by hex encoded ID
+	parents []string
+}
+
+// AssembleBlock picks the transactions of the next block from candidates
+// until the block is full. A candidate goes in together with the candidates
+// it spends, its package, and packages are taken highest combined fee rate
+// first, so a child paying a high fee gets its parent mined. Invalid and
+// conflicting candidates are left out. The returned list starts with a
+// coinbase paying the subsidy of the next block plus the collected fees to
+// the address to.
+func (chain *Blockchain) AssembleBlock(to string, candidates []*Transaction) ([]*Transaction, error) {
+	tip, err := chain.GetBlock(chain.LastHash)
+	if err != nil {
+		return nil, err
+	}
+
+	all := make(map[string]Transaction)
+	for _, tx := range candidates {
+		if tx.IsMinerTx() || checkTransactionSanity(tx) != nil {
+			continue
+		}
+		all[hex.EncodeToString(tx.ID)] = *tx
+	}
+
+	// Fees are known once the inputs are, the ones spending other
+	// candidates are computed as if these were in the block. Candidates
+	// that are invalid even then are left out.
+	pending := make(map[string]*blockCandidate)
+	var order []string
+	for _, tx := range candidates {
+		id := hex.EncodeToString(tx.ID)
+		if _, ok := all[id]; !ok || pending[id] != nil {
+			continue
+		}
+		fee, err := chain.validateAtTip(tx, &tip, all)
+		if err != nil {
+			continue
+		}
+		c := &blockCandidate{tx: tx, fee: fee, size: tx.Size()}
+		for _, in := range tx.Inputs {
+			if parent := hex.EncodeToString(in.ID); all[parent].ID != nil {
+				c.parents = append(c.parents, parent)
+			}
+		}
+		pending[id] = c
+		order = append(order, id)
+	}
+
+	// Leave room for the header, height, tx count and the coinbase
+	size := BlockHeaderSize + 8 + estimateTxSize(1, 1) + 64
+	inBlock := make(map[string]Transaction)
+	spent := make(map[string]bool)
+	var selected []*Transaction
+	var fees Amount
+
+	for len(pending) > 0 {
+		// The package of highest fee rate, the first candidate among equals
+		var best []*blockCandidate
+		var bestFee Amount
+		var bestSize int
+		for _, id := range order {
+			if pending[id] == nil {
+				continue
+			}
+			pkg := candidatePackage(id, pending)
+			var pkgFee Amount
+			pkgSize := 0
+			for _, c := range pkg {
+				pkgFee += c.fee
+				pkgSize += c.size
+			}
+			if best == nil || HigherFeeRate(pkgFee, pkgSize, bestFee, bestSize) {
+				best, bestFee, bestSize = pkg, pkgFee, pkgSize
+			}
+		}
+
+		// The package goes in whole or not at all, the candidate it was
+		// picked for is dropped when it doesn't
+		target := best[len(best)-1]
+		if size+bestSize > MaxBlockSize {
+			delete(pending, hex.EncodeToString(target.tx.ID))
+			continue
+		}
+		pkgInBlock := make(map[string]Transaction, len(inBlock)+len(best))
+		for id, tx := range inBlock {
+			pkgInBlock[id] = tx
+		}
+		pkgSpent := make(map[string]bool)
+		var pkgFees Amount
+		var failed *blockCandidate
+		for _, c := range best {
+			fee, err := chain.validateAtTip(c.tx, &tip, pkgInBlock)
+			if err == nil && (conflicts(c.tx, spent) || conflicts(c.tx, pkgSpent)) {
+				err = ruleError(RejectDoubleSpend, "transaction %x conflicts with the block", c.tx.ID)
+			}
+			if err == nil {
+				pkgFees, err = pkgFees.Add(fee)
+			}
+			if err != nil {
+				failed = c
+				break
+			}
+			for _, in := range c.tx.Inputs {
+				pkgSpent[outpoint(in.ID, in.Out)] = true
+			}
+			pkgInBlock[hex.EncodeToString(c.tx.ID)] = *c.tx
+		}
+		total, err := fees.Add(pkgFees)
+		if failed == nil && err != nil {
+			failed = target
+		}
+		if failed != nil {
+			delete(pending, hex.EncodeToString(failed.tx.ID))
+			continue
+		}
+
+		fees = total
+		size += bestSize
+		inBlock = pkgInBlock
+		for outpoint := range pkgSpent {
+			spent[outpoint] = true
+		}
+		for _, c := range best {
+			delete(pending, hex.EncodeToString(c.tx.ID))
+			selected = append(selected, c.tx)
+		}
+	}
+
+	coinbase, err := MinerTx(to, "", tip.Height+1, fees)
+	if err != nil {
+		return nil, err
+	}
+	return append([]*Transaction{coinbase}, selected...), nil
+}
+
+// candidatePackage returns the candidate id and the pending candidates it
+// spends, directly or not, parents before their children
+func candidatePackage(id string, pending map[string]*blockCandidate) []*blockCandidate {
+	var pkg []*blockCandidate
+	seen := make(map[string]bool)
+	var visit func(id string)
+	visit = func(id string) {
+		c := pending[id]
+		if c == nil || seen[id] {
+			return
+		}
+		seen[id] = true
+		for _, parent := range c.parents {
+			visit(parent)
+		}
+		pkg = append(pkg, c)
+	}
+	visit(id)
+	return pkg
+}
+
+func conflicts(tx *Transaction, spent map[string]bool) bool {
+	for _, in := range tx.Inputs {
+		if spent[outpoint(in.ID, in.Out)] {
+			return true
+		}
+	}
+	return false
+}
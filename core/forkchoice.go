@@ -0,0 +1,135 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+var workPrefix = []byte("work/")
+
+// ReorgEvent describes a switch of the main chain to a heavier branch.
+// Disconnected holds the blocks that left the main chain starting from the
+// old tip, Connected holds the blocks that joined it starting right after
+// the fork point.
+type ReorgEvent struct {
+	ForkPoint    []byte
+	OldTip       []byte
+	NewTip       []byte
+	Disconnected []*Block
+	Connected    []*Block
+}
+
+// Register a function that is called after every chain reorganization
+func (chain *Blockchain) OnReorg(fn func(*ReorgEvent)) {
+	chain.reorgHandlers = append(chain.reorgHandlers, fn)
+}
+
+func (chain *Blockchain) notifyReorg(event *ReorgEvent) {
+	for _, fn := range chain.reorgHandlers {
+		fn(event)
+	}
+}
+
+func workKey(hash []byte) []byte {
+	return append(append([]byte{}, workPrefix...), hash...)
+}
+
+func getBlockTxn(txn StoreTxn, hash []byte) (*Block, error) {
+	data, err := txn.Get(blockKey(hash))
+	if errors.Is(err, ErrKeyNotFound) {
+		return nil, fmt.Errorf("%w: %x", ErrBlockNotFound, hash)
+	}
+	if err != nil {
+		return nil, err
+	}
+	block, err := DeSerialize(data)
+	if err != nil {
+		return nil, fmt.Errorf("block %x: %w", hash, err)
+	}
+	return block, nil
+}
+
+// getChainWork returns the total work of the branch ending with the block
+// hash. Databases created before work was tracked are filled in on the way.
+func getChainWork(txn StoreTxn, hash []byte) (*big.Int, error) {
+	var pending []*Block
+	work := new(big.Int)
+
+	for {
+		stored, err := txn.Get(workKey(hash))
+		if err == nil {
+			work.SetBytes(stored)
+			break
+		}
+		if !errors.Is(err, ErrKeyNotFound) {
+			return nil, err
+		}
+
+		block, err := getBlockTxn(txn, hash)
+		if err != nil {
+			return nil, err
+		}
+		pending = append(pending, block)
+		if block.IsGenesis() {
+			break
+		}
+		hash = block.PrevHash
+	}
+
+	for i := len(pending) - 1; i >= 0; i-- {
+		work.Add(work, pending[i].Work())
+		if err := txn.Set(workKey(pending[i].Hash), work.Bytes()); err != nil {
+			return nil, err
+		}
+	}
+
+	return new(big.Int).Set(work), nil
+}
+
+// setChainWork stores the total work of the branch ending with block
+func setChainWork(txn StoreTxn, block *Block) (*big.Int, error) {
+	work := block.Work()
+	if !block.IsGenesis() {
+		parentWork, err := getChainWork(txn, block.PrevHash)
+		if err != nil {
+			return nil, err
+		}
+		work.Add(work, parentWork)
+	}
+
+	return work, txn.Set(workKey(block.Hash), work.Bytes())
+}
+
+// findFork walks both branches back until they meet and returns the
+// reorganization needed to move the tip from oldTip to newTip
+func findFork(txn StoreTxn, oldTip, newTip []byte) (*ReorgEvent, error) {
+	event := &ReorgEvent{OldTip: oldTip, NewTip: newTip}
+
+	oldBlock, err := getBlockTxn(txn, oldTip)
+	if err != nil {
+		return nil, err
+	}
+	newBlock, err := getBlockTxn(txn, newTip)
+	if err != nil {
+		return nil, err
+	}
+
+	for !bytes.Equal(oldBlock.Hash, newBlock.Hash) {
+		if oldBlock.Height >= newBlock.Height {
+			event.Disconnected = append(event.Disconnected, oldBlock)
+			if oldBlock, err = getBlockTxn(txn, oldBlock.PrevHash); err != nil {
+				return nil, err
+			}
+		} else {
+			event.Connected = append([]*Block{newBlock}, event.Connected...)
+			if newBlock, err = getBlockTxn(txn, newBlock.PrevHash); err != nil {
+				return nil, err
+			}
+		}
+	}
+	event.ForkPoint = oldBlock.Hash
+
+	return event, nil
+}
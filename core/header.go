@@ -0,0 +1,86 @@
+package blockchain
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	// Version of the block header layout
+	BlockVersion = 1
+	// Size in bytes of a serialized block header
+	BlockHeaderSize = 88
+	// Size in bytes of block and merkle root hashes
+	HashSize = 32
+)
+
+// BlockHeader holds everything the hash of a block commits to. It is hashed
+// with a fixed big endian layout, all integers are big endian:
+//
+//	offset  size  field
+//	0       4     Version
+//	4       32    PrevHash (all zeros for the genesis block)
+//	36      32    MerkleRoot
+//	68      8     Timestamp (unix seconds)
+//	76      4     Bits
+//	80      8     Nonce
+type BlockHeader struct {
+	Version    int32
+	PrevHash   []byte
+	MerkleRoot []byte
+	Timestamp  int64
+	Bits       uint32
+	Nonce      uint64
+}
+
+// Serialize the header in its canonical layout
+func (h *BlockHeader) Serialize() []byte {
+	buf := make([]byte, BlockHeaderSize)
+
+	binary.BigEndian.PutUint32(buf[0:4], uint32(h.Version))
+	copy(buf[4:36], h.PrevHash)
+	copy(buf[36:68], h.MerkleRoot)
+	binary.BigEndian.PutUint64(buf[68:76], uint64(h.Timestamp))
+	binary.BigEndian.PutUint32(buf[76:80], h.Bits)
+	binary.BigEndian.PutUint64(buf[80:88], h.Nonce)
+
+	return buf
+}
+
+// Hash of the header, this is the hash of the block
+func (h *BlockHeader) Hash() []byte {
+	hash := sha256.Sum256(h.Serialize())
+	return hash[:]
+}
+
+// DeserializeBlockHeader parses a header serialized with BlockHeader.Serialize
+func DeserializeBlockHeader(data []byte) (BlockHeader, error) {
+	var h BlockHeader
+	if len(data) != BlockHeaderSize {
+		return h, fmt.Errorf("block header must be %d bytes, got %d", BlockHeaderSize, len(data))
+	}
+
+	h.Version = int32(binary.BigEndian.Uint32(data[0:4]))
+	h.PrevHash = append([]byte{}, data[4:36]...)
+	h.MerkleRoot = append([]byte{}, data[36:68]...)
+	h.Timestamp = int64(binary.BigEndian.Uint64(data[68:76]))
+	h.Bits = binary.BigEndian.Uint32(data[76:80])
+	h.Nonce = binary.BigEndian.Uint64(data[80:88])
+
+	// The genesis block has no parent
+	if isZeroHash(h.PrevHash) {
+		h.PrevHash = []byte{}
+	}
+
+	return h, nil
+}
+
+func isZeroHash(hash []byte) bool {
+	for _, b := range hash {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
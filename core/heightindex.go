@@ -0,0 +1,255 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The height index maps the height of every block of the main chain to its
+// hash, side chain blocks are not in it
+var heightPrefix = []byte("index/height/")
+
+// Largest number of blocks GetBlockRange returns at once
+const MaxBlockRange = 1000
+
+func heightKey(height int) []byte {
+	key := make([]byte, len(heightPrefix)+4)
+	copy(key, heightPrefix)
+	binary.BigEndian.PutUint32(key[len(heightPrefix):], uint32(height))
+	return key
+}
+
+func getHashAtHeight(txn StoreTxn, height int) ([]byte, error) {
+	return txn.Get(heightKey(height))
+}
+
+// indexMainChain fills in the height index of databases created before it
+// existed. It walks back from tip until it meets a height that already
+// points at the main chain, blocks connected since then keep it up to date
+// through connectBlock.
+func indexMainChain(txn StoreTxn, tip []byte) error {
+	block, err := getBlockTxn(txn, tip)
+	if err != nil {
+		return err
+	}
+
+	for {
+		hash, err := getHashAtHeight(txn, block.Height)
+		if err == nil && bytes.Equal(hash, block.Hash) {
+			return nil
+		}
+		if err != nil && !errors.Is(err, ErrKeyNotFound) {
+			return err
+		}
+		if err := txn.Set(heightKey(block.Height), block.Hash); err != nil {
+			return err
+		}
+		if block.IsGenesis() {
+			return nil
+		}
+		if block, err = getBlockTxn(txn, block.PrevHash); err != nil {
+			return err
+		}
+	}
+}
+
+// chainIndexes tells which of the optional indexes are kept up to date
+type chainIndexes struct {
+	tx   bool
+	addr bool
+}
+
+func loadChainIndexes(txn StoreTxn) (chainIndexes, error) {
+	var indexes chainIndexes
+	var err error
+	if indexes.tx, err = indexEnabled(txn, txIndexFlag); err != nil {
+		return indexes, err
+	}
+	indexes.addr, err = indexEnabled(txn, addrIndexFlag)
+	return indexes, err
+}
+
+func indexEnabled(txn StoreTxn, flag []byte) (bool, error) {
+	_, err := txn.Get(flag)
+	if errors.Is(err, ErrKeyNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// connect adds block, which joined the main chain, to the indexes
+func (indexes chainIndexes) connect(txn StoreTxn, block *Block) error {
+	if indexes.tx {
+		if err := indexBlockTransactions(txn, block); err != nil {
+			return err
+		}
+	}
+	if indexes.addr {
+		return indexBlockAddresses(txn, block)
+	}
+	return nil
+}
+
+// disconnect removes block, which left the main chain, from the indexes
+func (indexes chainIndexes) disconnect(txn StoreTxn, block *Block) error {
+	if indexes.tx {
+		if err := unindexBlockTransactions(txn, block); err != nil {
+			return err
+		}
+	}
+	if indexes.addr {
+		return unindexBlockAddresses(txn, block)
+	}
+	return nil
+}
+
+// Reindex drops the selected optional indexes and builds them again from the
+// main chain, then keeps them up to date as blocks are connected. It returns
+// the number of transactions indexed.
+func (chain *Blockchain) Reindex(txIndex, addrIndex bool) (int, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	indexes := chainIndexes{tx: txIndex, addr: addrIndex}
+	var flags [][]byte
+	if txIndex {
+		if err := chain.Database.DropPrefix(txIndexPrefix); err != nil {
+			return 0, err
+		}
+		flags = append(flags, txIndexFlag)
+	}
+	if addrIndex {
+		if err := chain.Database.DropPrefix(addrIndexPrefix); err != nil {
+			return 0, err
+		}
+		flags = append(flags, addrIndexFlag)
+	}
+
+	count := 0
+	iter := chain.ForwardIterator(GenesisHeight)
+	for {
+		block, err := iter.Next()
+		if err != nil {
+			return count, err
+		}
+		if block == nil {
+			break
+		}
+		err = chain.Database.Update(func(txn StoreTxn) error {
+			return indexes.connect(txn, block)
+		})
+		if err != nil {
+			return count, err
+		}
+		count += len(block.Transactions)
+		if block.Height%1000 == 0 {
+			log.Infof("Indexed transactions up to height %d", block.Height)
+		}
+	}
+
+	err := chain.Database.Update(func(txn StoreTxn) error {
+		for _, flag := range flags {
+			if err := txn.Set(flag, []byte{1}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return count, err
+}
+
+// GetBlockHashAtHeight returns the hash of the main chain block at height
+func (chain *Blockchain) GetBlockHashAtHeight(height int) ([]byte, error) {
+	var hash []byte
+	err := chain.Database.View(func(txn StoreTxn) error {
+		var err error
+		hash, err = getHashAtHeight(txn, height)
+		return err
+	})
+	if errors.Is(err, ErrKeyNotFound) {
+		return nil, fmt.Errorf("%w: no block at height %d", ErrBlockNotFound, height)
+	}
+	return hash, err
+}
+
+// GetBlockByHeight returns the main chain block at height
+func (chain *Blockchain) GetBlockByHeight(height int) (Block, error) {
+	hash, err := chain.GetBlockHashAtHeight(height)
+	if err != nil {
+		return Block{}, err
+	}
+	return chain.GetBlock(hash)
+}
+
+// GetBlockRange returns the main chain blocks from height from to height to,
+// both included, in ascending order. The range stops at the tip and may not
+// span more than MaxBlockRange blocks.
+func (chain *Blockchain) GetBlockRange(from, to int) ([]*Block, error) {
+	if from < GenesisHeight || to < from {
+		return nil, fmt.Errorf("invalid block range %d to %d", from, to)
+	}
+	if to-from+1 > MaxBlockRange {
+		return nil, fmt.Errorf("block range %d to %d spans more than %d blocks", from, to, MaxBlockRange)
+	}
+
+	var blocks []*Block
+	err := chain.Database.View(func(txn StoreTxn) error {
+		for height := from; height <= to; height++ {
+			hash, err := getHashAtHeight(txn, height)
+			if errors.Is(err, ErrKeyNotFound) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			block, err := getBlockTxn(txn, hash)
+			if err != nil {
+				return err
+			}
+			blocks = append(blocks, block)
+		}
+		return nil
+	})
+
+	return blocks, err
+}
+
+// ForwardIterator walks the main chain from a height towards the tip
+type ForwardIterator struct {
+	Height   int
+	Database ChainStore
+}
+
+// ForwardIterator starts at the main chain block at height
+func (chain *Blockchain) ForwardIterator(height int) *ForwardIterator {
+	return &ForwardIterator{height, chain.Database}
+}
+
+// Next returns the next block, or nil once the tip has been passed
+func (iter *ForwardIterator) Next() (*Block, error) {
+	var block *Block
+
+	err := iter.Database.View(func(txn StoreTxn) error {
+		hash, err := getHashAtHeight(txn, iter.Height)
+		if errors.Is(err, ErrKeyNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		block, err = getBlockTxn(txn, hash)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if block != nil {
+		iter.Height++
+	}
+	return block, nil
+}
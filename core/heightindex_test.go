@@ -0,0 +1,67 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// A reorganization points the heights of the new branch at its blocks, none
+// is left pointing at the old one
+func TestHeightIndexReorg(t *testing.T) {
+	a, b := newTestWallet(t), newTestWallet(t)
+	chain := newTestChain(t, a)
+	fork := chain.LastHash
+	forkHeight, err := chain.GetBestHeight()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var old []*Block
+	for parent := fork; len(old) < 2; parent = chain.LastHash {
+		old = append(old, addTestBlock(t, chain, parent, a))
+	}
+	var branch []*Block
+	for parent := fork; len(branch) < 3; parent = branch[len(branch)-1].Hash {
+		block := testBlock(t, chain, parent, b)
+		if err := chain.AddBlock(block); err != nil {
+			t.Fatal(err)
+		}
+		branch = append(branch, block)
+	}
+	if !bytes.Equal(chain.LastHash, branch[2].Hash) {
+		t.Fatal("the longer branch didn't take over")
+	}
+
+	for i, block := range branch {
+		hash, err := chain.GetBlockHashAtHeight(forkHeight + 1 + i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(hash, block.Hash) {
+			t.Fatalf("height %d points at %x, want %x", forkHeight+1+i, hash, block.Hash)
+		}
+	}
+	if _, err := chain.GetBlockHashAtHeight(forkHeight + 4); !errors.Is(err, ErrBlockNotFound) {
+		t.Fatalf("height %d above the tip returned %v", forkHeight+4, err)
+	}
+
+	keys, err := storeKeys(chain.Database, heightPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != forkHeight+3 {
+		t.Fatalf("%d heights indexed, want %d", len(keys), forkHeight+3)
+	}
+	for height := GenesisHeight; height <= forkHeight+3; height++ {
+		hash, err := chain.GetBlockHashAtHeight(height)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, block := range old {
+			if bytes.Equal(hash, block.Hash) {
+				t.Fatalf("height %d still points at the disconnected block %x", height, block.Hash)
+			}
+		}
+	}
+}
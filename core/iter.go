@@ -1,10 +1,8 @@
 package blockchain
 
-import badger "github.com/dgraph-io/badger"
-
 type BlockchainIterator struct {
 	CurrentHash []byte
-	Database    *badger.DB
+	Database    ChainStore
 }
 
 func (chain *Blockchain) Iterator() *BlockchainIterator {
@@ -14,20 +12,19 @@ func (chain *Blockchain) Iterator() *BlockchainIterator {
 	return &BlockchainIterator{chain.LastHash, chain.Database}
 }
 
-func (iter *BlockchainIterator) Next() *Block {
+func (iter *BlockchainIterator) Next() (*Block, error) {
 	var block *Block
-	var encodedBlock []byte
 
 	//Read
-	err := iter.Database.View(func(txn *badger.Txn) error {
-		item, err := txn.Get(iter.CurrentHash)
-		Handle(err)
-		encodedBlock, err = item.ValueCopy(nil)
-		block = DeSerialize(encodedBlock)
+	err := iter.Database.View(func(txn StoreTxn) error {
+		var err error
+		block, err = getBlockTxn(txn, iter.CurrentHash)
 		return err
 	})
-	Handle(err)
+	if err != nil {
+		return nil, err
+	}
 
 	iter.CurrentHash = block.PrevHash
-	return block
+	return block, nil
 }
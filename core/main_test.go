@@ -0,0 +1,130 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/workspace/the-crypto-project/params"
+	"github.com/workspace/the-crypto-project/wallet"
+)
+
+// Tests run on regtest, blocks are mined instantly and coinbases mature
+// after CoinbaseMaturity blocks
+func TestMain(m *testing.M) {
+	if err := params.Select(params.RegTest.Name); err != nil {
+		panic(err)
+	}
+	log.SetOutput(ioutil.Discard)
+	os.Exit(m.Run())
+}
+
+type testWallet struct {
+	*wallet.Wallet
+	address string
+}
+
+func newTestWallet(t *testing.T) testWallet {
+	t.Helper()
+	w, err := wallet.MakeWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testWallet{w, string(w.Address())}
+}
+
+// newTestChain returns an in-memory chain whose genesis pays w, with
+// enough blocks on top of it for the genesis coinbase to be spendable
+func newTestChain(t *testing.T, w testWallet) *Blockchain {
+	t.Helper()
+	chain, err := NewMemoryBlockchain(w.address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { chain.Database.Close() })
+	for i := 0; i < params.Active.CoinbaseMaturity; i++ {
+		addTestBlock(t, chain, chain.LastHash, w)
+	}
+	return chain
+}
+
+// testBlock mines a block on top of parent holding a coinbase paying miner
+// and txs, without validating them
+func testBlock(t *testing.T, chain *Blockchain, parent []byte, miner testWallet, txs ...*Transaction) *Block {
+	t.Helper()
+	prev, err := chain.GetBlock(parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bits, err := chain.CalcNextBits(&prev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	coinbase, err := MinerTx(miner.address, "", prev.Height+1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	timestamp, err := chain.NextTimestamp(&prev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return CreateBlockAt(append([]*Transaction{coinbase}, txs...), parent, prev.Height+1, bits, timestamp)
+}
+
+// addTestBlock validates and adds a block of txs on top of parent
+func addTestBlock(t *testing.T, chain *Blockchain, parent []byte, miner testWallet, txs ...*Transaction) *Block {
+	t.Helper()
+	block := testBlock(t, chain, parent, miner, txs...)
+	if err := chain.ValidateBlock(block); err != nil {
+		t.Fatalf("block of height %d: %v", block.Height, err)
+	}
+	if err := chain.AddBlock(block); err != nil {
+		t.Fatal(err)
+	}
+	return block
+}
+
+// spendTx signs a transaction from w spending output out of prev, paying
+// values to the addresses in order
+func spendTx(t *testing.T, w testWallet, prev *Transaction, out int, to []string, values []Amount) *Transaction {
+	t.Helper()
+	tx := &Transaction{Inputs: []TxInput{{ID: prev.ID, Out: out, PubKey: w.PublicKey}}}
+	for i, address := range to {
+		o, err := NewTXOutput(values[i], address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tx.Outputs = append(tx.Outputs, *o)
+	}
+	prevTxs := map[string]Transaction{hex.EncodeToString(prev.ID): *prev}
+	if err := tx.Sign(w.PrivateKey, prevTxs); err != nil {
+		t.Fatal(err)
+	}
+	tx.ID = tx.Hash()
+	return tx
+}
+
+// genesisCoinbase returns the coinbase of the genesis block of chain
+func genesisCoinbase(t *testing.T, chain *Blockchain) *Transaction {
+	t.Helper()
+	hash, err := chain.GetBlockHashAtHeight(GenesisHeight)
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesis, err := chain.GetBlock(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return genesis.Transactions[0]
+}
+
+// wantRule fails unless err is a RuleError with code
+func wantRule(t *testing.T, err error, code RejectCode) {
+	t.Helper()
+	ruleErr, ok := err.(RuleError)
+	if !ok || ruleErr.Code != code {
+		t.Fatalf("got error %v, want %s", err, code)
+	}
+}
@@ -0,0 +1,151 @@
+package blockchain
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var errStoreClosed = errors.New("store is closed")
+
+// MemoryStore is a ChainStore kept in memory, it is gone once the process
+// exits. Update transactions run one at a time, View transactions run
+// alongside each other.
+type MemoryStore struct {
+	lock   sync.RWMutex
+	data   map[string][]byte
+	closed bool
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{data: make(map[string][]byte)}
+}
+
+func (store *MemoryStore) View(fn func(txn StoreTxn) error) error {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	if store.closed {
+		return errStoreClosed
+	}
+	return fn(&memoryTxn{store: store})
+}
+
+func (store *MemoryStore) Update(fn func(txn StoreTxn) error) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if store.closed {
+		return errStoreClosed
+	}
+
+	txn := &memoryTxn{store: store, pending: make(map[string][]byte)}
+	if err := fn(txn); err != nil {
+		return err
+	}
+	for key, value := range txn.pending {
+		if value == nil {
+			delete(store.data, key)
+		} else {
+			store.data[key] = value
+		}
+	}
+	return nil
+}
+
+func (store *MemoryStore) DropPrefix(prefixes ...[]byte) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if store.closed {
+		return errStoreClosed
+	}
+
+	for key := range store.data {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(key, string(prefix)) {
+				delete(store.data, key)
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func (store *MemoryStore) Close() error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.closed = true
+	store.data = nil
+	return nil
+}
+
+// memoryTxn holds the writes of an Update until it commits, a nil value is
+// a deleted key. pending is nil in a View.
+type memoryTxn struct {
+	store   *MemoryStore
+	pending map[string][]byte
+}
+
+func (t *memoryTxn) get(key string) ([]byte, bool) {
+	if value, ok := t.pending[key]; ok {
+		return value, value != nil
+	}
+	value, ok := t.store.data[key]
+	return value, ok
+}
+
+func (t *memoryTxn) Get(key []byte) ([]byte, error) {
+	value, ok := t.get(string(key))
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	return append([]byte{}, value...), nil
+}
+
+func (t *memoryTxn) Set(key, value []byte) error {
+	if t.pending == nil {
+		return ErrReadOnlyTxn
+	}
+	// An empty value is still a value, nil marks deletes
+	t.pending[string(key)] = append([]byte{}, value...)
+	return nil
+}
+
+func (t *memoryTxn) Delete(key []byte) error {
+	if t.pending == nil {
+		return ErrReadOnlyTxn
+	}
+	t.pending[string(key)] = nil
+	return nil
+}
+
+func (t *memoryTxn) Iterate(prefix []byte, reverse bool, fn func(key, value []byte) error) error {
+	seen := make(map[string]bool)
+	var keys []string
+	collect := func(key string) {
+		if !seen[key] && strings.HasPrefix(key, string(prefix)) {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	for key := range t.store.data {
+		collect(key)
+	}
+	for key := range t.pending {
+		collect(key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		// Strings compare byte by byte like badger keys
+		return (keys[i] < keys[j]) != reverse
+	})
+
+	for _, key := range keys {
+		value, ok := t.get(key)
+		if !ok {
+			continue
+		}
+		if err := fn([]byte(key), append([]byte{}, value...)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -2,8 +2,7 @@ package blockchain
 
 import (
 	"crypto/sha256"
-
-	log "github.com/sirupsen/logrus"
+	"errors"
 )
 
 type MerkleTree struct {
@@ -34,7 +33,7 @@ func NewMerkleNode(left, right *MerkleNode, data []byte) *MerkleNode {
 }
 
 // Binary Tree-like Implementation
-func NewMerkleTree(data [][]byte) *MerkleTree {
+func NewMerkleTree(data [][]byte) (*MerkleTree, error) {
 
 	var nodes []MerkleNode
 
@@ -44,7 +43,7 @@ func NewMerkleTree(data [][]byte) *MerkleTree {
 	}
 
 	if len(nodes) == 0 {
-		log.Panic("No merkle Tree node")
+		return nil, errors.New("No merkle Tree node")
 	}
 
 	for len(nodes) > 1 {
@@ -66,5 +65,5 @@ func NewMerkleTree(data [][]byte) *MerkleTree {
 
 	tree := MerkleTree{&nodes[0]}
 
-	return &tree
+	return &tree, nil
 }
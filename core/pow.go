@@ -10,8 +10,6 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-const Difficulty = 5
-
 type ProofOfWork struct {
 	Block  *Block
 	Target *big.Int
@@ -20,8 +18,7 @@ type ProofOfWork struct {
 // /https://imil.net/blog/posts/2019/proof-of-work-based-blockchain-explained-with-golang/
 // Create a new Proof.
 func NewProof(b *Block) *ProofOfWork {
-	target := big.NewInt(1)
-	target.Lsh(target, uint(256-Difficulty))
+	target := CompactToBig(b.Bits)
 
 	pow := &ProofOfWork{b, target}
 	log.Infof("Target: %x\n", target)
@@ -29,29 +26,38 @@ func NewProof(b *Block) *ProofOfWork {
 	return pow
 }
 
-// Initialize the block data by concatenating
-// the transaction hash + prevHash + nonce + POW Difficulty
-func (pow *ProofOfWork) InitData(nonce int) []byte {
-	info := bytes.Join(
-		[][]byte{
-			pow.Block.HashTransactions(),
-			pow.Block.PrevHash,
-			ToByte(int64(nonce)),
-			ToByte(int64(Difficulty)),
-		}, []byte{})
-
-	return info
+// The expected number of hashes needed to find a block below target,
+// 2^256 / (target+1). Chains are compared by the sum of their blocks work.
+func CalcWork(target *big.Int) *big.Int {
+	numerator := new(big.Int).Lsh(big.NewInt(1), 256)
+	denominator := new(big.Int).Add(target, big.NewInt(1))
+
+	return numerator.Div(numerator, denominator)
+}
+
+// Work done on the block
+func (b *Block) Work() *big.Int {
+	return CalcWork(CompactToBig(b.Bits))
+}
+
+// Initialize the block data by serializing the block header
+// with the given nonce
+func (pow *ProofOfWork) InitData(nonce uint64) []byte {
+	header := pow.Block.BlockHeader
+	header.Nonce = nonce
+
+	return header.Serialize()
 }
 
 // Execute the Proof Of Work by incrementing the nonce
-// util the  hash falls below the the target value base on the Difficulty level
-func (pow *ProofOfWork) Run() (int, []byte) {
+// util the  hash falls below the the target value encoded in the block bits
+func (pow *ProofOfWork) Run() (uint64, []byte) {
 	var initHash big.Int
 	var hash [32]byte
 
-	nonce := 0
+	var nonce uint64
 
-	for nonce = 0; nonce < math.MaxInt64; nonce++ {
+	for nonce = 0; nonce < math.MaxUint64; nonce++ {
 		info := pow.InitData(nonce)
 		hash = sha256.Sum256(info)
 
@@ -75,19 +81,16 @@ func (pow *ProofOfWork) Validate() bool {
 
 	initHash.SetBytes(hash[:])
 
-	return initHash.Cmp(pow.Target) == -1
-}
-
-func check(e error) {
-	if e != nil {
-		panic(e)
+	// The stored hash must be the one the proof of work produced
+	if !bytes.Equal(hash[:], pow.Block.Hash) {
+		return false
 	}
+	return initHash.Cmp(pow.Target) == -1
 }
 
 func ToByte(num int64) []byte {
-	buff := new(bytes.Buffer)
-	err := binary.Write(buff, binary.BigEndian, num)
-	check(err)
+	buff := make([]byte, 8)
+	binary.BigEndian.PutUint64(buff, uint64(num))
 
-	return buff.Bytes()
+	return buff
 }
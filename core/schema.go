@@ -0,0 +1,283 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Version of the chain store layout this node reads and writes. Every
+// change to the keys or to the encoding of a stored record bumps it and adds
+// a migration that upgrades the previous version.
+const SchemaVersion = 2
+
+// Development builds between the binary encoding and the recording of the
+// version wrote the layout of version 1, see unversionedSchema
+const legacySchemaVersion = 1
+
+var schemaVersionKey = []byte("meta/version")
+
+// Keys a migration moves or rewrites in one store transaction, badger
+// refuses transactions that grow too big
+const migrationBatchSize = 10000
+
+// A Migration upgrades a store from Version-1 to Version. It runs in
+// batches and is resumed after a crash, so it must skip what it already
+// did. With dryRun set it only counts the keys it would change.
+//
+// Records carry no version of their own, the whole store is at the version
+// in meta/version and it only moves once a migration is done. A migration
+// that changes the encoding of a record must also move it to a key the
+// previous version doesn't use, so a resumed run tells the records it
+// already rewrote from the rest.
+type Migration struct {
+	Version     int
+	Description string
+	migrate     func(store ChainStore, dryRun bool) (int, error)
+}
+
+// Migrations, oldest first. Each one keeps the key layouts of its own
+// versions, the variables used by the rest of the package follow the
+// current version only.
+var migrations = []Migration{
+	{2, "Move every record under a namespaced key prefix", migrateNamespaces},
+}
+
+// MigrationStep is a migration Migrate ran, or would run in a dry run
+type MigrationStep struct {
+	Version     int
+	Description string
+	// Keys the migration changed or would change
+	Keys int
+}
+
+// MigrationReport tells how Migrate upgraded a store
+type MigrationReport struct {
+	From   int
+	To     int
+	DryRun bool
+	Steps  []MigrationStep
+}
+
+func getSchemaVersion(txn StoreTxn) (int, error) {
+	data, err := txn.Get(schemaVersionKey)
+	if errors.Is(err, ErrKeyNotFound) {
+		// Only an empty store has no key at all
+		empty := true
+		err = txn.Iterate(nil, false, func(_, _ []byte) error {
+			empty = false
+			return errStopIteration
+		})
+		if err != nil && err != errStopIteration {
+			return 0, err
+		}
+		if empty {
+			return 0, nil
+		}
+		return unversionedSchema(txn)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(data) != 4 {
+		return 0, fmt.Errorf("%w: schema version", ErrMalformedData)
+	}
+	return int(binary.BigEndian.Uint32(data)), nil
+}
+
+// unversionedSchema tells the version of a store that has records but no
+// version. Only stores whose tip block decodes and hashes as it does now
+// are version 1. Releases before them encoded records with gob and hashed
+// blocks differently, no migration can rebuild those chains, they are
+// refused before anything is written.
+func unversionedSchema(txn StoreTxn) (int, error) {
+	err := checkLegacyTip(txn)
+	if err != nil {
+		return 0, fmt.Errorf("%w: the store has no schema version and was written by an older release (%v), "+
+			"move the database away and sync the chain again", ErrIncompatibleStore, err)
+	}
+	return legacySchemaVersion, nil
+}
+
+// checkLegacyTip reads the tip block of a version 1 store, an interrupted
+// upgrade may have moved it to the keys of version 2 already
+func checkLegacyTip(txn StoreTxn) error {
+	tip, err := txn.Get([]byte("lh"))
+	if errors.Is(err, ErrKeyNotFound) {
+		tip, err = txn.Get(lastHashKey)
+	}
+	if err != nil {
+		return fmt.Errorf("tip: %w", err)
+	}
+	data, err := txn.Get(tip)
+	if errors.Is(err, ErrKeyNotFound) {
+		data, err = txn.Get(blockKey(tip))
+	}
+	if err != nil {
+		return fmt.Errorf("tip block %x: %w", tip, err)
+	}
+	block, err := decodeBlock(data)
+	if err != nil {
+		return fmt.Errorf("tip block %x: %w", tip, err)
+	}
+	if !bytes.Equal(block.Hash, tip) {
+		return fmt.Errorf("tip block %x hashes to %x", tip, block.Hash)
+	}
+	return nil
+}
+
+func setSchemaVersion(txn StoreTxn, version int) error {
+	var data [4]byte
+	binary.BigEndian.PutUint32(data[:], uint32(version))
+	return txn.Set(schemaVersionKey, data[:])
+}
+
+var errStopIteration = errors.New("stop iteration")
+
+// Migrate upgrades store to SchemaVersion in place, an empty store is only
+// stamped with the version. With dryRun set nothing is written and the
+// report tells what would change.
+func Migrate(store ChainStore, dryRun bool) (*MigrationReport, error) {
+	var version int
+	err := store.View(func(txn StoreTxn) error {
+		var err error
+		version, err = getSchemaVersion(txn)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	report := &MigrationReport{From: version, To: SchemaVersion, DryRun: dryRun}
+	if version > SchemaVersion {
+		return nil, fmt.Errorf("the database has schema version %d, this node only knows up to %d", version, SchemaVersion)
+	}
+	if version == 0 {
+		report.From = SchemaVersion
+		if dryRun {
+			return report, nil
+		}
+		return report, store.Update(func(txn StoreTxn) error {
+			return setSchemaVersion(txn, SchemaVersion)
+		})
+	}
+
+	for _, migration := range migrations {
+		if migration.Version <= version {
+			continue
+		}
+		if !dryRun {
+			log.Infof("Upgrading the database to schema version %d: %s", migration.Version, migration.Description)
+		}
+		keys, err := migration.migrate(store, dryRun)
+		if err != nil {
+			return report, fmt.Errorf("migrating to schema version %d: %w", migration.Version, err)
+		}
+		report.Steps = append(report.Steps, MigrationStep{migration.Version, migration.Description, keys})
+		if dryRun {
+			continue
+		}
+		// The version only moves once the whole migration is done, an
+		// interrupted one runs again on the next start
+		err = store.Update(func(txn StoreTxn) error {
+			return setSchemaVersion(txn, migration.Version)
+		})
+		if err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// rewriteKeys moves, in batches, every key rename maps to a new key. It
+// returns the number of keys moved, or that would move in a dry run.
+func rewriteKeys(store ChainStore, dryRun bool, rename func(key []byte) []byte) (int, error) {
+	type move struct {
+		from, to, value []byte
+	}
+	errBatchFull := errors.New("batch full")
+	total := 0
+
+	for {
+		var batch []move
+		err := store.View(func(txn StoreTxn) error {
+			return txn.Iterate(nil, false, func(key, value []byte) error {
+				to := rename(key)
+				if to == nil {
+					return nil
+				}
+				if dryRun {
+					total++
+					return nil
+				}
+				batch = append(batch, move{key, to, value})
+				if len(batch) == migrationBatchSize {
+					return errBatchFull
+				}
+				return nil
+			})
+		})
+		if err != nil && err != errBatchFull {
+			return total, err
+		}
+		if dryRun || len(batch) == 0 {
+			return total, nil
+		}
+
+		err = store.Update(func(txn StoreTxn) error {
+			for _, m := range batch {
+				if err := txn.Set(m.to, m.value); err != nil {
+					return err
+				}
+				if err := txn.Delete(m.from); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return total, err
+		}
+		total += len(batch)
+		log.Infof("Moved %d keys", total)
+	}
+}
+
+// Version 1 kept blocks under their bare 32 byte hash next to lh, txindex,
+// addrindex and records with dash separated prefixes. Only the keys move,
+// a key that was moved no longer matches any version 1 layout.
+func migrateNamespaces(store ChainStore, dryRun bool) (int, error) {
+	renamed := map[string]string{
+		"lh":        "meta/tip",
+		"txindex":   "meta/txindex",
+		"addrindex": "meta/addrindex",
+	}
+	prefixes := []struct{ from, to string }{
+		{"work-", "work/"},
+		{"utxo-", "utxo/"},
+		{"height-", "index/height/"},
+		{"undo-", "undo/"},
+		{"tx-", "index/tx/"},
+		{"addr-", "index/addr/"},
+	}
+
+	return rewriteKeys(store, dryRun, func(key []byte) []byte {
+		if to, ok := renamed[string(key)]; ok {
+			return []byte(to)
+		}
+		// None of the prefixed keys of version 1 or 2 are 32 bytes long,
+		// look at them first as a block hash may start like a prefix
+		if len(key) == 32 {
+			return append([]byte("block/"), key...)
+		}
+		for _, prefix := range prefixes {
+			if bytes.HasPrefix(key, []byte(prefix.from)) {
+				return append([]byte(prefix.to), key[len(prefix.from):]...)
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,266 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/workspace/the-crypto-project/wallet"
+)
+
+// Records of the releases before the binary encoding, they were gob encoded
+type baselineInput struct {
+	ID        []byte
+	Out       int
+	Signature []byte
+	PubKey    []byte
+}
+
+type baselineOutput struct {
+	Value      float64
+	PubKeyHash []byte
+}
+
+type baselineTransaction struct {
+	ID      []byte
+	Inputs  []baselineInput
+	Outputs []baselineOutput
+}
+
+type baselineBlock struct {
+	Timestamp    int64
+	Hash         []byte
+	PrevHash     []byte
+	Transactions []*baselineTransaction
+	Nonce        int
+	Height       int
+	MerkleRoot   []byte
+	Difficulty   int
+	TxCount      int
+}
+
+type baselineOutputs struct {
+	Outputs []baselineOutput
+}
+
+func gobEncode(t *testing.T, v interface{}) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// storeContent returns every key of store with its value
+func storeContent(t *testing.T, store ChainStore) map[string]string {
+	t.Helper()
+	content := make(map[string]string)
+	err := store.View(func(txn StoreTxn) error {
+		return txn.Iterate(nil, false, func(key, value []byte) error {
+			content[string(key)] = string(value)
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
+
+// A store of the releases before the binary encoding can't be upgraded,
+// it is refused without writing anything
+func TestMigrateRefusesBaselineStore(t *testing.T) {
+	coinbase := &baselineTransaction{
+		ID:      bytes.Repeat([]byte{0x01}, 32),
+		Inputs:  []baselineInput{{ID: []byte{}, Out: -1, PubKey: []byte("genesis")}},
+		Outputs: []baselineOutput{{Value: 20, PubKeyHash: bytes.Repeat([]byte{0x02}, 20)}},
+	}
+	genesis := baselineBlock{Timestamp: 1600000000, Transactions: []*baselineTransaction{coinbase}, Height: 1, TxCount: 1}
+	hash := sha256.Sum256(gobEncode(t, genesis))
+	genesis.Hash = hash[:]
+
+	store := NewMemoryStore()
+	defer store.Close()
+	err := store.Update(func(txn StoreTxn) error {
+		if err := txn.Set(genesis.Hash, gobEncode(t, genesis)); err != nil {
+			return err
+		}
+		if err := txn.Set([]byte("lh"), genesis.Hash); err != nil {
+			return err
+		}
+		return txn.Set(append([]byte("utxo-"), coinbase.ID...), gobEncode(t, baselineOutputs{coinbase.Outputs}))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := storeContent(t, store)
+
+	for _, dryRun := range []bool{true, false} {
+		if _, err := Migrate(store, dryRun); !errors.Is(err, ErrIncompatibleStore) {
+			t.Fatalf("migrating with dry run %v returned %v, want ErrIncompatibleStore", dryRun, err)
+		}
+	}
+	if _, err := (&Blockchain{Database: store}).ContinueBlockchain(); !errors.Is(err, ErrIncompatibleStore) {
+		t.Fatalf("opening the store returned %v, want ErrIncompatibleStore", err)
+	}
+	after := storeContent(t, store)
+	if len(after) != len(before) {
+		t.Fatalf("the store holds %d keys, it held %d", len(after), len(before))
+	}
+	for key, value := range before {
+		if after[key] != value {
+			t.Fatalf("key %q was changed", key)
+		}
+	}
+}
+
+// v1Key maps a key of the current layout back to the one schema version 1
+// stored the record under
+func v1Key(t *testing.T, key []byte) []byte {
+	t.Helper()
+	renamed := map[string]string{
+		"meta/tip":       "lh",
+		"meta/txindex":   "txindex",
+		"meta/addrindex": "addrindex",
+	}
+	if from, ok := renamed[string(key)]; ok {
+		return []byte(from)
+	}
+	if bytes.HasPrefix(key, blockPrefix) {
+		return key[len(blockPrefix):]
+	}
+	for _, prefix := range []struct{ from, to string }{
+		{"work/", "work-"},
+		{"utxo/", "utxo-"},
+		{"index/height/", "height-"},
+		{"undo/", "undo-"},
+		{"index/tx/", "tx-"},
+		{"index/addr/", "addr-"},
+	} {
+		if strings.HasPrefix(string(key), prefix.from) {
+			return append([]byte(prefix.to), key[len(prefix.from):]...)
+		}
+	}
+	t.Fatalf("key %q has no version 1 layout", key)
+	return nil
+}
+
+// downgrade rewrites the records of the first n keys of store in the
+// layout of schema version 1, all of them when n is negative
+func downgrade(t *testing.T, store ChainStore, n int) {
+	t.Helper()
+	keys, err := storeKeys(store, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Update(func(txn StoreTxn) error {
+		if err := txn.Delete(schemaVersionKey); err != nil {
+			return err
+		}
+		moved := 0
+		for _, key := range keys {
+			if key == string(schemaVersionKey) || moved == n {
+				continue
+			}
+			value, err := txn.Get([]byte(key))
+			if err != nil {
+				return err
+			}
+			if err := txn.Set(v1Key(t, []byte(key)), value); err != nil {
+				return err
+			}
+			if err := txn.Delete([]byte(key)); err != nil {
+				return err
+			}
+			moved++
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Version 1 was written by development builds only, the test downgrades a
+// store of the current version to it
+func TestMigrateVersion1(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		// Keys still in the version 1 layout, the rest were moved by an
+		// upgrade that was interrupted
+		v1Keys int
+	}{
+		{"version 1 store", -1},
+		{"interrupted upgrade", 5},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			a, b := newTestWallet(t), newTestWallet(t)
+			chain := newTestChain(t, a)
+			if _, err := chain.Reindex(true, true); err != nil {
+				t.Fatal(err)
+			}
+			coinbase := genesisCoinbase(t, chain)
+			value := coinbase.Outputs[0].Value
+			pay := spendTx(t, a, coinbase, 0, []string{b.address, a.address}, []Amount{value / 2, value/2 - 1000})
+			addTestBlock(t, chain, chain.LastHash, a, pay)
+			tip := chain.LastHash
+			height, err := chain.GetBestHeight()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			store := chain.Database
+			keys, err := storeKeys(store, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			downgrade(t, store, test.v1Keys)
+
+			report, err := Migrate(store, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := len(keys) - 1
+			if test.v1Keys >= 0 {
+				want = test.v1Keys
+			}
+			if report.From != legacySchemaVersion || len(report.Steps) != 1 || report.Steps[0].Keys != want {
+				t.Fatalf("dry run report %+v, want %d keys to move", report, want)
+			}
+
+			if _, err := Migrate(store, false); err != nil {
+				t.Fatal(err)
+			}
+			migrated, err := storeKeys(store, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(migrated, "\n") != strings.Join(keys, "\n") {
+				t.Fatalf("migrated store holds %q, want %q", migrated, keys)
+			}
+
+			// The records read back as they were written, and the chain
+			// keeps growing on top of them
+			reopened, err := (&Blockchain{Database: store}).ContinueBlockchain()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, _ := reopened.GetBestHeight(); !bytes.Equal(reopened.LastHash, tip) || got != height {
+				t.Fatalf("tip %x at height %d, want %x at %d", reopened.LastHash, got, tip, height)
+			}
+			if _, err := reopened.FindTransaction(pay.ID); err != nil {
+				t.Fatal(err)
+			}
+			history, _, err := reopened.GetAddressHistory(wallet.PublicKeyHash(b.PublicKey), 0, 0)
+			if err != nil || len(history) != 1 || history[0].Received != value/2 {
+				t.Fatalf("history of the payee %+v: %v", history, err)
+			}
+			spend := spendTx(t, b, pay, 0, []string{a.address}, []Amount{value/2 - 1000})
+			addTestBlock(t, reopened, reopened.LastHash, a, spend)
+		})
+	}
+}
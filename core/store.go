@@ -0,0 +1,89 @@
+package blockchain
+
+import "errors"
+
+// ChainStore keeps the blocks, the tip, the UTXO set and the indexes of a
+// chain. Every record lives under its own key prefix, the helpers next to
+// each record (getBlockTxn, getLastHash, getUTXOs, getHashAtHeight...) do the
+// encoding so implementations only move bytes around. Reads and writes go
+// through transactions so a block and everything it changes are stored
+// together or not at all.
+//
+// BadgerStore keeps the chain on disk, MemoryStore keeps it in memory for
+// tests and throwaway regtest nodes. Both must pass the checks of TestChainStores.
+type ChainStore interface {
+	// View runs fn in a read only transaction
+	View(fn func(txn StoreTxn) error) error
+	// Update runs fn in a read-write transaction, nothing fn wrote is kept
+	// if it returns an error
+	Update(fn func(txn StoreTxn) error) error
+	// DropPrefix deletes every key starting with one of the prefixes
+	DropPrefix(prefixes ...[]byte) error
+	Close() error
+}
+
+// StoreTxn is a transaction on a ChainStore. Values passed in and returned
+// are copies, callers may keep and modify them.
+type StoreTxn interface {
+	// Get returns ErrKeyNotFound when there is no value for key
+	Get(key []byte) ([]byte, error)
+	Set(key, value []byte) error
+	Delete(key []byte) error
+	// Iterate calls fn with the keys starting with prefix and their values
+	// in ascending key order, or descending when reverse is set. It sees the
+	// writes made earlier in the same transaction and stops at the first
+	// error fn returns.
+	Iterate(prefix []byte, reverse bool, fn func(key, value []byte) error) error
+}
+
+var (
+	ErrKeyNotFound = errors.New("key not found")
+	// Writes in a transaction opened with View
+	ErrReadOnlyTxn = errors.New("write in a read only transaction")
+)
+
+var (
+	// Blocks are stored under block/<hash>
+	blockPrefix = []byte("block/")
+	// The hash of the tip of the main chain
+	lastHashKey = []byte("meta/tip")
+)
+
+func blockKey(hash []byte) []byte {
+	return append(append([]byte{}, blockPrefix...), hash...)
+}
+
+// getLastHash returns the hash of the tip, ErrKeyNotFound before the first
+// block is stored
+func getLastHash(txn StoreTxn) ([]byte, error) {
+	return txn.Get(lastHashKey)
+}
+
+func setLastHash(txn StoreTxn, hash []byte) error {
+	return txn.Set(lastHashKey, hash)
+}
+
+func putBlock(txn StoreTxn, block *Block) error {
+	return txn.Set(blockKey(block.Hash), block.Serialize())
+}
+
+func hasBlock(txn StoreTxn, hash []byte) (bool, error) {
+	_, err := txn.Get(blockKey(hash))
+	if errors.Is(err, ErrKeyNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// successor returns the smallest key greater than every key starting with
+// prefix, nil when there is none
+func successor(prefix []byte) []byte {
+	end := append([]byte{}, prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,574 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// The checks every ChainStore implementation must pass, in order. Each one
+// leaves the store as it found it.
+var storeChecks = []struct {
+	name string
+	fn   func(store ChainStore) error
+}{
+	{"missing keys", checkMissingKeys},
+	{"set and get", checkSetGet},
+	{"values are copies", checkValueCopies},
+	{"rollback", checkRollback},
+	{"read only view", checkReadOnlyView},
+	{"iteration order", checkIterate},
+	{"iteration sees pending writes", checkIteratePending},
+	{"drop prefix", checkDropPrefix},
+	{"blocks, tip and undo records", checkBlocksAndTip},
+	{"UTXO entries", checkUTXOEntries},
+}
+
+// Every ChainStore implementation must pass the checks
+func TestChainStores(t *testing.T) {
+	t.Run("memory", func(t *testing.T) {
+		store := NewMemoryStore()
+		defer store.Close()
+		checkChainStore(t, store)
+	})
+	t.Run("badger", func(t *testing.T) {
+		store, err := OpenBadgerStore(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer store.Close()
+		checkChainStore(t, store)
+	})
+}
+
+// checkChainStore runs the checks against an empty store and stops at the
+// first one it fails
+func checkChainStore(t *testing.T, store ChainStore) {
+	t.Helper()
+	empty, err := storeKeys(store, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(empty) > 0 {
+		t.Fatal("the store is not empty")
+	}
+
+	for _, check := range storeChecks {
+		if err := check.fn(store); err != nil {
+			t.Fatalf("%s: %v", check.name, err)
+		}
+	}
+}
+
+// storeKeys lists the keys starting with prefix in the order Iterate visits
+// them
+func storeKeys(store ChainStore, prefix []byte) ([]string, error) {
+	var keys []string
+	err := store.View(func(txn StoreTxn) error {
+		return txn.Iterate(prefix, false, func(key, _ []byte) error {
+			keys = append(keys, string(key))
+			return nil
+		})
+	})
+	return keys, err
+}
+
+func setKeys(store ChainStore, keys ...string) error {
+	return store.Update(func(txn StoreTxn) error {
+		for _, key := range keys {
+			if err := txn.Set([]byte(key), []byte("v-"+key)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func deleteKeys(store ChainStore, keys ...string) error {
+	return store.Update(func(txn StoreTxn) error {
+		for _, key := range keys {
+			if err := txn.Delete([]byte(key)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func expectValue(txn StoreTxn, key, want string) error {
+	value, err := txn.Get([]byte(key))
+	if err != nil {
+		return fmt.Errorf("get %q: %w", key, err)
+	}
+	if string(value) != want {
+		return fmt.Errorf("get %q returned %q, want %q", key, value, want)
+	}
+	return nil
+}
+
+func expectMissing(txn StoreTxn, key string) error {
+	if _, err := txn.Get([]byte(key)); !errors.Is(err, ErrKeyNotFound) {
+		return fmt.Errorf("get %q returned %v, want ErrKeyNotFound", key, err)
+	}
+	return nil
+}
+
+func checkMissingKeys(store ChainStore) error {
+	err := store.View(func(txn StoreTxn) error {
+		return expectMissing(txn, "missing")
+	})
+	if err != nil {
+		return err
+	}
+	// Deleting what isn't there is not an error
+	return deleteKeys(store, "missing")
+}
+
+func checkSetGet(store ChainStore) error {
+	err := store.Update(func(txn StoreTxn) error {
+		if err := txn.Set([]byte("a"), []byte("1")); err != nil {
+			return err
+		}
+		if err := txn.Set([]byte("empty"), []byte{}); err != nil {
+			return err
+		}
+		// Writes are visible in the transaction that made them
+		return expectValue(txn, "a", "1")
+	})
+	if err != nil {
+		return err
+	}
+
+	err = store.Update(func(txn StoreTxn) error {
+		if err := expectValue(txn, "a", "1"); err != nil {
+			return err
+		}
+		if err := expectValue(txn, "empty", ""); err != nil {
+			return err
+		}
+		if err := txn.Set([]byte("a"), []byte("2")); err != nil {
+			return err
+		}
+		if err := expectValue(txn, "a", "2"); err != nil {
+			return err
+		}
+		if err := txn.Delete([]byte("a")); err != nil {
+			return err
+		}
+		return expectMissing(txn, "a")
+	})
+	if err != nil {
+		return err
+	}
+
+	err = store.View(func(txn StoreTxn) error {
+		return expectMissing(txn, "a")
+	})
+	if err != nil {
+		return err
+	}
+	return deleteKeys(store, "empty")
+}
+
+func checkValueCopies(store ChainStore) error {
+	value := []byte("original")
+	err := store.Update(func(txn StoreTxn) error {
+		err := txn.Set([]byte("copy"), value)
+		copy(value, "modified")
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	err = store.View(func(txn StoreTxn) error {
+		got, err := txn.Get([]byte("copy"))
+		if err != nil {
+			return err
+		}
+		copy(got, "modified")
+		return expectValue(txn, "copy", "original")
+	})
+	if err != nil {
+		return err
+	}
+	return deleteKeys(store, "copy")
+}
+
+func checkRollback(store ChainStore) error {
+	if err := setKeys(store, "kept"); err != nil {
+		return err
+	}
+
+	failure := errors.New("failure")
+	err := store.Update(func(txn StoreTxn) error {
+		if err := txn.Set([]byte("rolled-back"), []byte("1")); err != nil {
+			return err
+		}
+		if err := txn.Delete([]byte("kept")); err != nil {
+			return err
+		}
+		return failure
+	})
+	if err != failure {
+		return fmt.Errorf("update returned %v, want the error of the transaction", err)
+	}
+
+	err = store.View(func(txn StoreTxn) error {
+		if err := expectMissing(txn, "rolled-back"); err != nil {
+			return err
+		}
+		return expectValue(txn, "kept", "v-kept")
+	})
+	if err != nil {
+		return err
+	}
+	return deleteKeys(store, "kept")
+}
+
+func checkReadOnlyView(store ChainStore) error {
+	err := store.View(func(txn StoreTxn) error {
+		if err := txn.Set([]byte("view"), []byte("1")); err == nil {
+			return errors.New("set succeeded in a view")
+		}
+		if err := txn.Delete([]byte("view")); err == nil {
+			return errors.New("delete succeeded in a view")
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return store.View(func(txn StoreTxn) error {
+		return expectMissing(txn, "view")
+	})
+}
+
+func checkIterate(store ChainStore) error {
+	keys := []string{"it-", "it-a", "it-b", "it-b\x00", "it-b\xff", "it-c", "it-\xff\xff"}
+	// Keys around the prefix must not be visited
+	outside := []string{"it", "it,", "it.", "iu"}
+	if err := setKeys(store, append(append([]string{}, keys...), outside...)...); err != nil {
+		return err
+	}
+
+	forward, err := storeKeys(store, []byte("it-"))
+	if err != nil {
+		return err
+	}
+	if fmt.Sprintf("%q", forward) != fmt.Sprintf("%q", keys) {
+		return fmt.Errorf("iterate visited %q, want %q", forward, keys)
+	}
+
+	var reverse []string
+	err = store.View(func(txn StoreTxn) error {
+		return txn.Iterate([]byte("it-"), true, func(key, value []byte) error {
+			if string(value) != "v-"+string(key) {
+				return fmt.Errorf("iterate returned %q for %q", value, key)
+			}
+			reverse = append(reverse, string(key))
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	for i := range keys {
+		if len(reverse) != len(keys) || reverse[i] != keys[len(keys)-1-i] {
+			return fmt.Errorf("reverse iterate visited %q", reverse)
+		}
+	}
+
+	// An error from fn stops the iteration and is returned
+	stop := errors.New("stop")
+	visited := 0
+	err = store.View(func(txn StoreTxn) error {
+		return txn.Iterate([]byte("it-"), false, func(_, _ []byte) error {
+			visited++
+			return stop
+		})
+	})
+	if err != stop || visited != 1 {
+		return fmt.Errorf("iterate returned %v after %d keys, want the error of fn after 1", err, visited)
+	}
+
+	return deleteKeys(store, append(keys, outside...)...)
+}
+
+func checkIteratePending(store ChainStore) error {
+	if err := setKeys(store, "pending-a", "pending-c"); err != nil {
+		return err
+	}
+
+	return store.Update(func(txn StoreTxn) error {
+		if err := txn.Set([]byte("pending-b"), []byte("v-pending-b")); err != nil {
+			return err
+		}
+		if err := txn.Delete([]byte("pending-c")); err != nil {
+			return err
+		}
+		if err := txn.Set([]byte("pending-a"), []byte("v-new")); err != nil {
+			return err
+		}
+
+		var visited []string
+		err := txn.Iterate([]byte("pending-"), false, func(key, value []byte) error {
+			visited = append(visited, string(key)+"="+string(value))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		want := []string{"pending-a=v-new", "pending-b=v-pending-b"}
+		if fmt.Sprintf("%q", visited) != fmt.Sprintf("%q", want) {
+			return fmt.Errorf("iterate visited %q, want %q", visited, want)
+		}
+
+		for _, key := range []string{"pending-a", "pending-b"} {
+			if err := txn.Delete([]byte(key)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func checkDropPrefix(store ChainStore) error {
+	if err := setKeys(store, "drop-a", "drop-b", "other-a", "dropped"); err != nil {
+		return err
+	}
+	if err := store.DropPrefix([]byte("drop-"), []byte("other-")); err != nil {
+		return err
+	}
+
+	keys, err := storeKeys(store, nil)
+	if err != nil {
+		return err
+	}
+	if len(keys) != 1 || keys[0] != "dropped" {
+		return fmt.Errorf("store holds %q after dropping, want only \"dropped\"", keys)
+	}
+	return deleteKeys(store, "dropped")
+}
+
+// checkStoreBlock returns a block that is never mined, only its encoding
+// and the links between blocks matter to the store. Its coinbase is followed
+// by txs.
+func checkStoreBlock(prev *Block, tag string, txs ...*Transaction) *Block {
+	block := &Block{Height: GenesisHeight}
+	if prev != nil {
+		block.PrevHash = prev.Hash
+		block.Height = prev.Height + 1
+	}
+	tx := &Transaction{
+		Inputs:  []TxInput{{Out: -1, PubKey: []byte(tag)}},
+		Outputs: []TxOutput{{Value: 1, PubKeyHash: []byte("pkh")}},
+	}
+	tx.ID = tx.Hash()
+	block.Transactions = append([]*Transaction{tx}, txs...)
+	block.MerkleRoot = block.HashTransactions()
+	block.Hash = block.BlockHeader.Hash()
+	block.TxCount = len(block.Transactions)
+	return block
+}
+
+func checkBlocksAndTip(store ChainStore) error {
+	genesis := checkStoreBlock(nil, "genesis")
+	a := checkStoreBlock(genesis, "a")
+	// b spends the coinbase of a and the output it creates right away
+	spend := &Transaction{
+		Inputs:  []TxInput{{ID: a.Transactions[0].ID, Out: 0}},
+		Outputs: []TxOutput{{Value: 1, PubKeyHash: []byte("pkh")}},
+	}
+	spend.ID = spend.Hash()
+	spendAgain := &Transaction{
+		Inputs:  []TxInput{{ID: spend.ID, Out: 0}},
+		Outputs: []TxOutput{{Value: 1, PubKeyHash: []byte("pkh")}},
+	}
+	spendAgain.ID = spendAgain.Hash()
+	b := checkStoreBlock(a, "b", spend, spendAgain)
+	fork := checkStoreBlock(genesis, "fork")
+
+	err := store.Update(func(txn StoreTxn) error {
+		if _, err := getLastHash(txn); !errors.Is(err, ErrKeyNotFound) {
+			return fmt.Errorf("tip of an empty store returned %v", err)
+		}
+		for _, block := range []*Block{genesis, a, b, fork} {
+			if err := putBlock(txn, block); err != nil {
+				return err
+			}
+		}
+		_, err := setMainChain(txn, b.Hash)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	err = store.View(func(txn StoreTxn) error {
+		tip, err := getLastHash(txn)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(tip, b.Hash) {
+			return fmt.Errorf("tip is %x, want %x", tip, b.Hash)
+		}
+		stored, err := getBlockTxn(txn, a.Hash)
+		if err != nil {
+			return err
+		}
+		if stored.Height != a.Height || !bytes.Equal(stored.PrevHash, genesis.Hash) ||
+			!bytes.Equal(stored.Transactions[0].ID, a.Transactions[0].ID) {
+			return errors.New("stored block differs from the one put")
+		}
+		if _, err := getBlockTxn(txn, make([]byte, sha256.Size)); !errors.Is(err, ErrBlockNotFound) {
+			return fmt.Errorf("unknown block returned %v, want ErrBlockNotFound", err)
+		}
+		for _, block := range []*Block{genesis, a, b} {
+			hash, err := getHashAtHeight(txn, block.Height)
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(hash, block.Hash) {
+				return fmt.Errorf("height %d points at %x, want %x", block.Height, hash, block.Hash)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := expectUTXOs(store, genesis.Transactions[0], b.Transactions[0], spendAgain); err != nil {
+		return err
+	}
+
+	// Moving the tip to a shorter branch drops the heights above it and
+	// puts back what the disconnected blocks spent
+	err = store.Update(func(txn StoreTxn) error {
+		event, err := setMainChain(txn, fork.Hash)
+		if err == nil && (len(event.Disconnected) != 2 || len(event.Connected) != 1) {
+			err = fmt.Errorf("switching to the fork disconnected %d blocks and connected %d",
+				len(event.Disconnected), len(event.Connected))
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	err = store.View(func(txn StoreTxn) error {
+		hash, err := getHashAtHeight(txn, fork.Height)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(hash, fork.Hash) {
+			return fmt.Errorf("height %d points at %x after the reorganization", fork.Height, hash)
+		}
+		if _, err := getHashAtHeight(txn, b.Height); !errors.Is(err, ErrKeyNotFound) {
+			return fmt.Errorf("height %d is still indexed: %v", b.Height, err)
+		}
+		if _, err := txn.Get(undoKey(b.Hash)); !errors.Is(err, ErrKeyNotFound) {
+			return fmt.Errorf("undo record of a disconnected block returned %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := expectUTXOs(store, genesis.Transactions[0], fork.Transactions[0]); err != nil {
+		return err
+	}
+
+	keys, err := storeKeys(store, nil)
+	if err != nil {
+		return err
+	}
+	return store.Update(func(txn StoreTxn) error {
+		for _, key := range keys {
+			if err := txn.Delete([]byte(key)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// expectUTXOs checks that the UTXO set holds all the outputs of txs and
+// nothing else
+func expectUTXOs(store ChainStore, txs ...*Transaction) error {
+	return store.View(func(txn StoreTxn) error {
+		count := 0
+		err := forEachUTXO(txn, func(_ []byte, outs TxOutputs) error {
+			count++
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if count != len(txs) {
+			return fmt.Errorf("UTXO set holds %d entries, want %d", count, len(txs))
+		}
+		for _, tx := range txs {
+			outs, err := getUTXOs(txn, tx.ID)
+			if err != nil {
+				return fmt.Errorf("outputs of %x: %w", tx.ID, err)
+			}
+			if outs.IsEmpty() || len(outs.Outputs) != len(tx.Outputs) {
+				return fmt.Errorf("outputs of %x are not all unspent", tx.ID)
+			}
+		}
+		return nil
+	})
+}
+
+func checkUTXOEntries(store ChainStore) error {
+	outs := TxOutputs{
+		Outputs:  []TxOutput{{Value: 5, PubKeyHash: []byte("a")}, {Value: 7, PubKeyHash: []byte("b")}},
+		Height:   3,
+		Coinbase: true,
+	}
+
+	err := store.Update(func(txn StoreTxn) error {
+		for _, txID := range []string{"tx-1", "tx-2"} {
+			if err := putUTXOs(txn, []byte(txID), outs); err != nil {
+				return err
+			}
+		}
+		stored, err := getUTXOs(txn, []byte("tx-1"))
+		if err != nil {
+			return err
+		}
+		if stored.Height != outs.Height || !stored.Coinbase || len(stored.Outputs) != 2 || stored.Outputs[1].Value != 7 {
+			return errors.New("stored outputs differ from the ones put")
+		}
+
+		stored.Spend(0)
+		stored.Spend(1)
+		// Spending every output removes the entry
+		if err := putUTXOs(txn, []byte("tx-1"), stored); err != nil {
+			return err
+		}
+		if _, err := getUTXOs(txn, []byte("tx-1")); !errors.Is(err, ErrKeyNotFound) {
+			return fmt.Errorf("spent outputs returned %v, want ErrKeyNotFound", err)
+		}
+
+		var seen []string
+		err = forEachUTXO(txn, func(txID []byte, _ TxOutputs) error {
+			seen = append(seen, string(txID))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if len(seen) != 1 || seen[0] != "tx-2" {
+			return fmt.Errorf("UTXO set holds %q, want only \"tx-2\"", seen)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return store.DropPrefix(utxoPrefix)
+}
@@ -0,0 +1,76 @@
+package blockchain
+
+import "github.com/workspace/the-crypto-project/params"
+
+// CalcBlockSubsidy returns the new token the miner of the block at height
+// may create on top of the fees. It starts at the InitialSubsidy of the
+// active network and halves every SubsidyHalvingInterval blocks until it
+// reaches zero.
+func CalcBlockSubsidy(height int) Amount {
+	halvings := uint(height / params.Active.SubsidyHalvingInterval)
+	if height < 0 || halvings >= 63 {
+		return 0
+	}
+	return Amount(params.Active.InitialSubsidy) >> halvings
+}
+
+// TotalSubsidy returns the token created by the subsidies of all blocks
+// from the genesis up to and including height
+func TotalSubsidy(height int) Amount {
+	interval := params.Active.SubsidyHalvingInterval
+	var total Amount
+	for start := 0; start <= height; start += interval {
+		subsidy := CalcBlockSubsidy(start)
+		if subsidy == 0 {
+			break
+		}
+		first, last := start, start+interval-1
+		if first < GenesisHeight {
+			first = GenesisHeight
+		}
+		if last > height {
+			last = height
+		}
+		total += subsidy * Amount(last-first+1)
+	}
+	return total
+}
+
+// MaxSupply is the token that will exist once the subsidy reaches zero
+func MaxSupply() Amount {
+	height := 0
+	for CalcBlockSubsidy(height) > 0 {
+		height += params.Active.SubsidyHalvingInterval
+	}
+	return TotalSubsidy(height)
+}
+
+// SupplyInfo describes the issuance of token at a height
+type SupplyInfo struct {
+	Height int
+	// Token created by the subsidy up to Height, miners that claim less
+	// than the subsidy burn the difference
+	Supply    Amount
+	MaxSupply Amount
+	// Subsidy of the next block
+	Subsidy           Amount
+	HalvingInterval   int
+	NextHalvingHeight int
+}
+
+// GetSupplyInfo returns the issuance of token at the current tip
+func (chain *Blockchain) GetSupplyInfo() (SupplyInfo, error) {
+	height, err := chain.GetBestHeight()
+	if err != nil {
+		return SupplyInfo{}, err
+	}
+	interval := params.Active.SubsidyHalvingInterval
+	return SupplyInfo{
+		Height:            height,
+		Supply:            TotalSubsidy(height),
+		MaxSupply:         MaxSupply(),
+		Subsidy:           CalcBlockSubsidy(height + 1),
+		HalvingInterval:   interval,
+		NextHalvingHeight: (height/interval + 1) * interval,
+	}, nil
+}
@@ -0,0 +1,106 @@
+package blockchain
+
+import (
+	"math"
+	"testing"
+
+	"github.com/workspace/the-crypto-project/params"
+)
+
+func TestCalcBlockSubsidy(t *testing.T) {
+	interval := params.Active.SubsidyHalvingInterval
+	initial := Amount(params.Active.InitialSubsidy)
+	for _, test := range []struct {
+		height int
+		want   Amount
+	}{
+		{GenesisHeight, initial},
+		{interval - 1, initial},
+		{interval, initial / 2},
+		{2*interval - 1, initial / 2},
+		{2 * interval, initial / 4},
+		{10 * interval, initial >> 10},
+		{64 * interval, 0},
+		{1000 * interval, 0},
+		{-1, 0},
+	} {
+		if got := CalcBlockSubsidy(test.height); got != test.want {
+			t.Errorf("subsidy at height %d is %d, want %d", test.height, got, test.want)
+		}
+	}
+
+	// Even the largest subsidy is gone by the 64th halving, the shift never
+	// wraps around
+	defer func(p *params.ChainParams) { params.Active = p }(params.Active)
+	largest := *params.Active
+	largest.InitialSubsidy = math.MaxInt64
+	params.Active = &largest
+	for _, test := range []struct {
+		halvings int
+		want     Amount
+	}{
+		{0, math.MaxInt64},
+		{62, 1},
+		{63, 0},
+		{64, 0},
+		{65, 0},
+	} {
+		if got := CalcBlockSubsidy(test.halvings * interval); got != test.want {
+			t.Errorf("subsidy after %d halvings is %d, want %d", test.halvings, got, test.want)
+		}
+	}
+}
+
+func TestTotalSubsidy(t *testing.T) {
+	interval := params.Active.SubsidyHalvingInterval
+	var total Amount
+	for height := GenesisHeight; height <= 64*interval; height++ {
+		total += CalcBlockSubsidy(height)
+		if height%interval <= 1 || height%interval == interval-1 {
+			if got := TotalSubsidy(height); got != total {
+				t.Fatalf("total subsidy at height %d is %d, want %d", height, got, total)
+			}
+		}
+	}
+	if got := MaxSupply(); got != total {
+		t.Fatalf("maximum supply is %d, the subsidies add up to %d", got, total)
+	}
+	if total > MaxMoney {
+		t.Fatalf("maximum supply %s is above MaxMoney", total)
+	}
+}
+
+// The supply reported at the tip is what the coinbases of the chain created
+func TestGetSupplyInfo(t *testing.T) {
+	a := newTestWallet(t)
+	chain := newTestChain(t, a)
+	for i := 0; i < 3; i++ {
+		addTestBlock(t, chain, chain.LastHash, a)
+	}
+
+	var created Amount
+	height, err := chain.GetBestHeight()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for h := GenesisHeight; h <= height; h++ {
+		block, err := chain.GetBlockByHeight(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, out := range block.Transactions[0].Outputs {
+			created += out.Value
+		}
+	}
+
+	info, err := chain.GetSupplyInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Height != height || info.Supply != created {
+		t.Fatalf("supply %s at height %d, the coinbases up to height %d created %s", info.Supply, info.Height, height, created)
+	}
+	if info.Subsidy != CalcBlockSubsidy(height+1) || info.MaxSupply != MaxSupply() {
+		t.Fatalf("supply info %+v", info)
+	}
+}
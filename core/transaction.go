@@ -1,19 +1,14 @@
 package blockchain
 
 import (
-	"bytes"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
-	"crypto/sha256"
-	"encoding/gob"
 	"encoding/hex"
-	"errors"
 	"fmt"
 	"math/big"
 	"strings"
 
-	log "github.com/sirupsen/logrus"
 	"github.com/workspace/the-crypto-project/wallet"
 )
 
@@ -23,59 +18,73 @@ type Transaction struct {
 	Outputs []TxOutput
 }
 
+// Serialize the transaction in its canonical binary layout, see encoding.go
 func (tx *Transaction) Serializer() []byte {
-	var encoded bytes.Buffer
-
-	encode := gob.NewEncoder(&encoded)
-	err := encode.Encode(tx)
-	Handle(err)
-
-	return encoded.Bytes()
+	return encodeTransaction(tx)
 }
 
+// The transaction ID, the sha256 of the serialized transaction. It covers
+// the signatures and is only final once mined, see encoding.go
 func (tx *Transaction) Hash() []byte {
-	var hash [32]byte
+	return hashBytes(tx.Serializer())
+}
 
-	txCopy := *tx
-	txCopy.ID = []byte{}
+// The digest signed for input inId, the serialized trimmed copy of the
+// transaction where only that input carries the public key hash of the
+// output it spends
+func (tx *Transaction) sigHash(prevTXs map[string]Transaction, inId int) []byte {
+	txCopy := tx.TrimmedCopy()
+	in := tx.Inputs[inId]
+	prevTX := prevTXs[hex.EncodeToString(in.ID)]
+	txCopy.Inputs[inId].PubKey = prevTX.Outputs[in.Out].PubKeyHash
 
-	hash = sha256.Sum256(txCopy.Serializer())
-	return hash[:]
+	return txCopy.Hash()
 }
 
 func (tx *Transaction) IsMinerTx() bool {
 	return len(tx.Inputs) == 1 && len(tx.Inputs[0].ID) == 0 && tx.Inputs[0].Out == -1
 }
 
-func (tx *Transaction) Sign(privKey ecdsa.PrivateKey, prevTXs map[string]Transaction) {
+func (tx *Transaction) Sign(privKey ecdsa.PrivateKey, prevTXs map[string]Transaction) error {
 
 	if tx.IsMinerTx() {
-		return
+		return nil
 	}
 
-	for _, in := range tx.Inputs {
-		if prevTXs[hex.EncodeToString(in.ID)].ID == nil {
-			log.Fatal("ERROR: Previous Transaction is not correct")
-		}
+	if err := checkPrevTransactions(tx, prevTXs); err != nil {
+		return err
 	}
 
-	txCopy := tx.TrimmedCopy()
-
-	for inId, in := range txCopy.Inputs {
-		prevTX := prevTXs[hex.EncodeToString(in.ID)]
-		txCopy.Inputs[inId].Signature = nil
+	for inId := range tx.Inputs {
 		//look for the transaction output that produced this input, then sign it with
 		// the rest of the data
-		txCopy.Inputs[inId].PubKey = prevTX.Outputs[in.Out].PubKeyHash
-		dataToSign := fmt.Sprintf("%x\n", txCopy)
+		dataToSign := tx.sigHash(prevTXs, inId)
 
-		r, s, err := ecdsa.Sign(rand.Reader, &privKey, []byte(dataToSign))
-		Handle(err)
-		signature := append(r.Bytes(), s.Bytes()...)
+		r, s, err := ecdsa.Sign(rand.Reader, &privKey, dataToSign)
+		if err != nil {
+			return fmt.Errorf("signing input %d of %x: %w", inId, tx.ID, err)
+		}
+		// r and s are padded to 32 bytes each so the signature splits evenly
+		signature := append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
 
 		tx.Inputs[inId].Signature = signature
-		txCopy.Inputs[inId].PubKey = nil
 	}
+	return nil
+}
+
+// checkPrevTransactions makes sure prevTXs holds the outputs every input of
+// tx spends
+func checkPrevTransactions(tx *Transaction, prevTXs map[string]Transaction) error {
+	for _, in := range tx.Inputs {
+		prevTx := prevTXs[hex.EncodeToString(in.ID)]
+		if prevTx.ID == nil {
+			return fmt.Errorf("%w: %x, spent by %x", ErrTxNotFound, in.ID, tx.ID)
+		}
+		if in.Out < 0 || in.Out >= len(prevTx.Outputs) {
+			return fmt.Errorf("%w: %s, spent by %x", ErrOutputNotFound, outpoint(in.ID, in.Out), tx.ID)
+		}
+	}
+	return nil
 }
 
 func (tx *Transaction) TrimmedCopy() Transaction {
@@ -95,63 +104,116 @@ func (tx *Transaction) TrimmedCopy() Transaction {
 	return txCopy
 }
 
-// Create new Transaction
-func NewTransaction(w *wallet.Wallet, to string, amount float64, utxo *UXTOSet) (*Transaction, error) {
+// Create new Transaction paying amount to the address to, the change goes back
+// to the wallet and feeRate base units per byte are left to the miner
+func NewTransaction(w *wallet.Wallet, to string, amount, feeRate Amount, utxo *UXTOSet) (*Transaction, error) {
 	var inputs []TxInput
 	var outputs []TxOutput
 
+	if amount <= 0 || !amount.IsValid() {
+		return nil, fmt.Errorf("%w: cannot send %s", ErrInvalidAmount, amount)
+	}
+	if feeRate < 0 {
+		return nil, fmt.Errorf("%w: negative fee rate %d", ErrInvalidAmount, feeRate)
+	}
+
 	publicKeyHash := wallet.PublicKeyHash(w.PublicKey)
 
-	acc, validoutputs := utxo.FindSpendableOutputs(publicKeyHash, amount)
-	if acc < amount {
-		err := errors.New("You dont have Enough Amount...")
+	// More inputs make the transaction bigger and the fee higher, collect
+	// outputs until they cover the amount and the fee for spending them
+	fee, err := FeeForSize(feeRate, estimateTxSize(1, 2))
+	if err != nil {
 		return nil, err
 	}
+	var acc Amount
+	var validoutputs map[string][]int
+	for {
+		target, err := amount.Add(fee)
+		if err != nil {
+			return nil, err
+		}
+		if acc, validoutputs, err = utxo.FindSpendableOutputs(publicKeyHash, target); err != nil {
+			return nil, err
+		}
+		if acc < target {
+			_, immature, err := utxo.FindBalance(publicKeyHash)
+			if err != nil {
+				return nil, err
+			}
+			if immature > 0 {
+				return nil, fmt.Errorf("%w, %s of mining rewards is not mature yet", ErrInsufficientFunds, immature)
+			}
+			return nil, fmt.Errorf("%w to send %s", ErrInsufficientFunds, amount)
+		}
+
+		count := 0
+		for _, outs := range validoutputs {
+			count += len(outs)
+		}
+		if fee, err = FeeForSize(feeRate, estimateTxSize(count, 2)); err != nil {
+			return nil, err
+		}
+		if acc >= amount+fee {
+			break
+		}
+	}
 
 	from := fmt.Sprintf("%s", w.Address())
 
 	for txId, outs := range validoutputs {
 		txID, err := hex.DecodeString(txId)
-
-		Handle(err)
+		if err != nil {
+			return nil, err
+		}
 		for _, out := range outs {
 			input := TxInput{txID, out, nil, w.PublicKey}
 			inputs = append(inputs, input)
 		}
 	}
 
-	outputs = append(outputs, *NewTXOutput(amount, to))
-	if acc > amount {
-		outputs = append(outputs, *NewTXOutput(acc-amount, from))
+	out, err := NewTXOutput(amount, to)
+	if err != nil {
+		return nil, err
+	}
+	outputs = append(outputs, *out)
+	if change := acc - amount - fee; change > 0 {
+		out, err := NewTXOutput(change, from)
+		if err != nil {
+			return nil, err
+		}
+		outputs = append(outputs, *out)
 	}
 
 	tx := Transaction{nil, inputs, outputs}
-	tx.ID = tx.Hash()
 
-	// Sign the new transaction with wallet Private Key
-	utxo.Blockchain.SignTransaction(w.PrivateKey, &tx)
+	// Sign the new transaction with wallet Private Key, the ID covers the
+	// signatures so it is set last
+	prevTxs, err := utxo.prevTransactions(&tx)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Sign(w.PrivateKey, prevTxs); err != nil {
+		return nil, err
+	}
+	tx.ID = tx.Hash()
 
 	return &tx, nil
 }
 
-func (tx *Transaction) Verify(prevTXs map[string]Transaction) bool {
+// Verify checks the signature of every input of tx against the outputs it
+// spends, found in prevTXs. It returns an error wrapping ErrInvalidSignature
+// when a signature doesn't match.
+func (tx *Transaction) Verify(prevTXs map[string]Transaction) error {
 	if tx.IsMinerTx() {
-		return true
+		return nil
 	}
 
-	for _, in := range tx.Inputs {
-		if prevTXs[hex.EncodeToString(in.ID)].ID == nil {
-			log.Fatal("ERROR: Previous Transaction is not valid")
-		}
+	if err := checkPrevTransactions(tx, prevTXs); err != nil {
+		return err
 	}
 
-	txCopy := tx.TrimmedCopy()
 	curve := elliptic.P256()
 	for inId, in := range tx.Inputs {
-		prevTX := prevTXs[hex.EncodeToString(in.ID)]
-		txCopy.Inputs[inId].Signature = nil
-		txCopy.Inputs[inId].PubKey = prevTX.Outputs[in.Out].PubKeyHash
-
 		r := big.Int{}
 		s := big.Int{}
 		sigLen := len(in.Signature)
@@ -164,16 +226,15 @@ func (tx *Transaction) Verify(prevTXs map[string]Transaction) bool {
 		x.SetBytes(in.PubKey[:(keyLen / 2)])
 		y.SetBytes(in.PubKey[(keyLen / 2):])
 
-		dataToVerify := fmt.Sprintf("%x\n", txCopy)
+		dataToVerify := tx.sigHash(prevTXs, inId)
 
 		rawPubKey := ecdsa.PublicKey{Curve: curve, X: &x, Y: &y}
-		if ecdsa.Verify(&rawPubKey, []byte(dataToVerify), &r, &s) == false {
-			return false
+		if ecdsa.Verify(&rawPubKey, dataToVerify, &r, &s) == false {
+			return fmt.Errorf("%w: input %d of %x", ErrInvalidSignature, inId, tx.ID)
 		}
-		txCopy.Inputs[inId].PubKey = nil
 	}
 
-	return true
+	return nil
 }
 
 // Helper function for displaying transaction data in the console
@@ -192,29 +253,34 @@ func (tx *Transaction) String() string {
 
 	for i, out := range tx.Outputs {
 		lines = append(lines, fmt.Sprintf("	Output (%d):", i))
-		lines = append(lines, fmt.Sprintf(" 	 	Value: %f", out.Value))
+		lines = append(lines, fmt.Sprintf(" 	 	Value: %s", out.Value))
 		lines = append(lines, fmt.Sprintf("		PubkeyHash: %x", out.PubKeyHash))
 	}
 
 	return strings.Join(lines, "\n")
 }
 
-// Miner Transaction with Input && Output credited with 20.000 token for the workdone
+// Miner Transaction with Input && Output credited with the subsidy of the block at
+// height for the workdone plus the fees of the transactions in the block
 // No Signature is required for the miner transaction Input
-func MinerTx(to, data string) *Transaction {
+func MinerTx(to, data string, height int, fees Amount) (*Transaction, error) {
 	if data == "" {
 		randData := make([]byte, 24)
-		_, err := rand.Read(randData)
-		Handle(err)
+		if _, err := rand.Read(randData); err != nil {
+			return nil, err
+		}
 		data = fmt.Sprintf("%x", randData)
 	}
 
 	txIn := TxInput{[]byte{}, -1, nil, []byte(data)}
-	txOut := NewTXOutput(20.000, to)
+	txOut, err := NewTXOutput(CalcBlockSubsidy(height)+fees, to)
+	if err != nil {
+		return nil, err
+	}
 
 	tx := Transaction{nil, []TxInput{txIn}, []TxOutput{*txOut}}
 
 	tx.ID = tx.Hash()
 
-	return &tx
+	return &tx, nil
 }
@@ -2,18 +2,13 @@ package blockchain
 
 import (
 	"bytes"
-	"encoding/gob"
+	"fmt"
 
-	"github.com/workspace/the-crypto-project/util/env"
+	"github.com/workspace/the-crypto-project/config"
+	"github.com/workspace/the-crypto-project/params"
 	"github.com/workspace/the-crypto-project/wallet"
 )
 
-var conf = env.New()
-var (
-	checkSumlength = conf.WalletAddressChecksum
-	version        = byte(0x00) // hexadecimal representation of zero
-)
-
 // Input represents debit
 type TxInput struct {
 	ID        []byte
@@ -22,49 +17,99 @@ type TxInput struct {
 	PubKey    []byte
 }
 
-// output represents credit
+// Unspent outputs of a transaction, the value of an entry in the UTXO set.
+// Spent outputs are kept as empty entries so every output stays at its
+// index in the transaction.
 type TxOutputs struct {
 	Outputs []TxOutput
+	// Height of the block that created the outputs
+	Height int
+	// Set when the outputs were created by a coinbase, they can only be
+	// spent once they are CoinbaseMaturity blocks deep on the active network
+	Coinbase bool
 }
 
 // output represents credit
 type TxOutput struct {
-	Value      float64
+	Value      Amount
 	PubKeyHash []byte
 }
 
-func NewTXOutput(value float64, address string) *TxOutput {
+func NewTXOutput(value Amount, address string) (*TxOutput, error) {
 	txo := &TxOutput{value, nil}
-	txo.Lock([]byte(address))
+	if err := txo.Lock([]byte(address)); err != nil {
+		return nil, err
+	}
 
-	return txo
+	return txo, nil
 }
 
-func (out *TxOutput) Lock(address []byte) {
-	pubKeyHash := wallet.Base58Decode(address)
-	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-checkSumlength]
+func (out *TxOutput) Lock(address []byte) error {
+	pubKeyHash, err := wallet.Base58Decode(address)
+	if err != nil {
+		return fmt.Errorf("%w: %q", wallet.ErrInvalidAddress, address)
+	}
+	checksum := config.Active.Wallet.AddressChecksum
+	if len(pubKeyHash) <= 1+checksum {
+		return fmt.Errorf("%w: %q", wallet.ErrInvalidAddress, address)
+	}
+	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-checksum]
 
 	out.PubKeyHash = pubKeyHash
+	return nil
 }
 
 func (out *TxOutput) IsLockWithKey(pubKeyHash []byte) bool {
 	return bytes.Compare(out.PubKeyHash, pubKeyHash) == 0
 }
 
-func (outputs *TxOutputs) Serialize() []byte {
-	var res bytes.Buffer
-	encoder := gob.NewEncoder(&res)
+// IsSpent reports whether the output is an empty entry left in the UTXO set
+// for an output that has been spent
+func (out *TxOutput) IsSpent() bool {
+	return len(out.PubKeyHash) == 0
+}
 
-	err := encoder.Encode(outputs)
-	Handle(err)
-	return res.Bytes()
+// NewTxOutputs makes the UTXO set entry of a transaction mined at height
+func NewTxOutputs(tx *Transaction, height int) TxOutputs {
+	outputs := TxOutputs{Height: height, Coinbase: tx.IsMinerTx()}
+	outputs.Outputs = append(outputs.Outputs, tx.Outputs...)
+	return outputs
 }
 
-func DeSerializeOutputs(data []byte) TxOutputs {
-	var outputs TxOutputs
-	encoder := gob.NewDecoder(bytes.NewReader(data))
+// Spend replaces the output at index with an empty entry, it returns false if
+// there is no such unspent output
+func (outputs *TxOutputs) Spend(index int) bool {
+	if index < 0 || index >= len(outputs.Outputs) || outputs.Outputs[index].IsSpent() {
+		return false
+	}
+	outputs.Outputs[index] = TxOutput{}
+	return true
+}
 
-	err := encoder.Decode(&outputs)
-	Handle(err)
-	return outputs
+// IsEmpty reports whether every output has been spent
+func (outputs *TxOutputs) IsEmpty() bool {
+	for i := range outputs.Outputs {
+		if !outputs.Outputs[i].IsSpent() {
+			return false
+		}
+	}
+	return true
+}
+
+// IsMature reports whether the outputs can be spent by a transaction in a
+// block at height
+func (outputs *TxOutputs) IsMature(height int) bool {
+	return !outputs.Coinbase || height-outputs.Height >= params.Active.CoinbaseMaturity
+}
+
+func (outputs *TxOutputs) Serialize() []byte {
+	return encodeOutputs(outputs)
+}
+
+func DeSerializeOutputs(data []byte) (TxOutputs, error) {
+	outputs, err := decodeOutputs(data)
+	if err != nil {
+		return TxOutputs{}, fmt.Errorf("%w: %v", ErrMalformedData, err)
+	}
+	return outputs, nil
 }
@@ -0,0 +1,127 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// The transaction index maps the ID of every main chain transaction to the
+// block it is in and its position in that block. It is optional, a node
+// keeps it up to date once txIndexFlag is set, see Reindex.
+var (
+	txIndexPrefix = []byte("index/tx/")
+	txIndexFlag   = []byte("meta/txindex")
+)
+
+// TxLocation tells where a transaction is in the chain
+type TxLocation struct {
+	BlockHash []byte
+	Height    int
+	// Position of the transaction in the block, 0 for the coinbase
+	Index int
+}
+
+func txIndexKey(ID []byte) []byte {
+	return append(append([]byte{}, txIndexPrefix...), ID...)
+}
+
+// indexBlockTransactions points the index at the transactions of block
+func indexBlockTransactions(txn StoreTxn, block *Block) error {
+	for i, tx := range block.Transactions {
+		value := make([]byte, len(block.Hash)+4)
+		copy(value, block.Hash)
+		binary.BigEndian.PutUint32(value[len(block.Hash):], uint32(i))
+		if err := txn.Set(txIndexKey(tx.ID), value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unindexBlockTransactions removes the transactions of a block that left
+// the main chain. Entries already pointing at another block are kept, the
+// transaction is in the new branch too.
+func unindexBlockTransactions(txn StoreTxn, block *Block) error {
+	for _, tx := range block.Transactions {
+		hash, _, err := getTxLocation(txn, tx.ID)
+		if errors.Is(err, ErrKeyNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(hash, block.Hash) {
+			continue
+		}
+		if err := txn.Delete(txIndexKey(tx.ID)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getTxLocation returns the hash of the block holding the transaction ID and
+// the position of the transaction in it
+func getTxLocation(txn StoreTxn, ID []byte) ([]byte, int, error) {
+	value, err := txn.Get(txIndexKey(ID))
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(value) < 4 {
+		return nil, 0, errors.New("corrupt transaction index entry")
+	}
+	split := len(value) - 4
+	return value[:split], int(binary.BigEndian.Uint32(value[split:])), nil
+}
+
+// findIndexedTransaction looks the transaction ID up in the index for the
+// branch ending with blockHash. ok is false when the index can't answer,
+// because it is disabled or the branch is not the main chain.
+func findIndexedTransaction(txn StoreTxn, blockHash, ID []byte) (tx Transaction, loc TxLocation, ok bool, err error) {
+	enabled, err := indexEnabled(txn, txIndexFlag)
+	if err != nil || !enabled {
+		return tx, loc, false, err
+	}
+	tip, err := getBlockTxn(txn, blockHash)
+	if err != nil {
+		return tx, loc, false, err
+	}
+	if hash, err := getHashAtHeight(txn, tip.Height); err != nil || !bytes.Equal(hash, tip.Hash) {
+		return tx, loc, false, nil
+	}
+
+	hash, index, err := getTxLocation(txn, ID)
+	if errors.Is(err, ErrKeyNotFound) {
+		return tx, loc, true, fmt.Errorf("%w: %x", ErrTxNotFound, ID)
+	}
+	if err != nil {
+		return tx, loc, false, err
+	}
+	block, err := getBlockTxn(txn, hash)
+	if err != nil {
+		return tx, loc, false, err
+	}
+	// Confirmed above the end of the branch
+	if block.Height > tip.Height {
+		return tx, loc, true, fmt.Errorf("%w: %x", ErrTxNotFound, ID)
+	}
+	if index >= len(block.Transactions) || !bytes.Equal(block.Transactions[index].ID, ID) {
+		return tx, loc, false, errors.New("corrupt transaction index entry")
+	}
+
+	loc = TxLocation{BlockHash: block.Hash, Height: block.Height, Index: index}
+	return *block.Transactions[index], loc, true, nil
+}
+
+// TxIndexEnabled reports whether the node keeps a transaction index
+func (chain *Blockchain) TxIndexEnabled() (bool, error) {
+	var enabled bool
+	err := chain.Database.View(func(txn StoreTxn) error {
+		var err error
+		enabled, err = indexEnabled(txn, txIndexFlag)
+		return err
+	})
+	return enabled, err
+}
@@ -0,0 +1,90 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// A reorganization removes the transactions of the disconnected blocks from
+// the index and adds those of the new branch, one in both branches points
+// at the block of the new one
+func TestTxIndexReorg(t *testing.T) {
+	a, b := newTestWallet(t), newTestWallet(t)
+	chain := newTestChain(t, a)
+	if _, err := chain.Reindex(true, false); err != nil {
+		t.Fatal(err)
+	}
+	coinbase := genesisCoinbase(t, chain)
+	value := coinbase.Outputs[0].Value
+	fork := chain.LastHash
+
+	pay := spendTx(t, a, coinbase, 0, []string{b.address, a.address}, []Amount{value / 2, value/2 - 1000})
+	back := spendTx(t, b, pay, 0, []string{a.address}, []Amount{value/2 - 1000})
+	old := []*Block{addTestBlock(t, chain, fork, a, pay)}
+	old = append(old, addTestBlock(t, chain, chain.LastHash, a, back))
+
+	change := spendTx(t, a, pay, 1, []string{b.address}, []Amount{value/2 - 2000})
+	var branch []*Block
+	parent := fork
+	for _, txs := range [][]*Transaction{nil, {pay}, {change}} {
+		block := testBlock(t, chain, parent, b, txs...)
+		if err := chain.AddBlock(block); err != nil {
+			t.Fatal(err)
+		}
+		branch = append(branch, block)
+		parent = block.Hash
+	}
+	if !bytes.Equal(chain.LastHash, branch[2].Hash) {
+		t.Fatal("the longer branch didn't take over")
+	}
+
+	location := func(tx *Transaction) ([]byte, int, error) {
+		var hash []byte
+		var index int
+		err := chain.Database.View(func(txn StoreTxn) error {
+			var err error
+			hash, index, err = getTxLocation(txn, tx.ID)
+			return err
+		})
+		return hash, index, err
+	}
+
+	// Only the old branch had them
+	for _, tx := range []*Transaction{back, old[0].Transactions[0], old[1].Transactions[0]} {
+		if _, _, err := location(tx); !errors.Is(err, ErrKeyNotFound) {
+			t.Fatalf("transaction %x of the old branch is still indexed: %v", tx.ID, err)
+		}
+	}
+	for _, want := range []struct {
+		tx    *Transaction
+		block *Block
+		index int
+	}{
+		{branch[0].Transactions[0], branch[0], 0},
+		{pay, branch[1], 1},
+		{change, branch[2], 1},
+	} {
+		hash, index, err := location(want.tx)
+		if err != nil {
+			t.Fatalf("transaction %x: %v", want.tx.ID, err)
+		}
+		if !bytes.Equal(hash, want.block.Hash) || index != want.index {
+			t.Fatalf("transaction %x indexed in block %x at %d, want %x at %d",
+				want.tx.ID, hash, index, want.block.Hash, want.index)
+		}
+	}
+
+	keys, err := storeKeys(chain.Database, txIndexPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	height, err := chain.GetBestHeight()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A coinbase per block, pay and change
+	if want := height + 2; len(keys) != want {
+		t.Fatalf("%d transactions indexed, want %d", len(keys), want)
+	}
+}
@@ -0,0 +1,241 @@
+package blockchain
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Every main chain block has an undo record listing the outputs it spent,
+// stored under undo/<block hash> when the block is connected. Disconnecting
+// the block deletes the outputs it created and puts the spent ones back, so
+// the UTXO set follows the tip without being rebuilt from the whole chain.
+var undoPrefix = []byte("undo/")
+
+// SpentOutput is an output spent by a block along with what it takes to put
+// it back in the UTXO set
+type SpentOutput struct {
+	TxID   []byte
+	Out    int
+	Output TxOutput
+	// Height and kind of the transaction that created the output
+	Height   int
+	Coinbase bool
+}
+
+func undoKey(hash []byte) []byte {
+	return append(append([]byte{}, undoPrefix...), hash...)
+}
+
+// getUndo returns the outputs block spent. Blocks connected before undo
+// records existed get theirs rebuilt from the chain.
+func getUndo(txn StoreTxn, block *Block) ([]SpentOutput, error) {
+	data, err := txn.Get(undoKey(block.Hash))
+	if errors.Is(err, ErrKeyNotFound) {
+		return buildUndo(txn, block)
+	}
+	if err != nil {
+		return nil, err
+	}
+	spent, err := decodeUndo(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: block %x: %v", ErrMalformedData, block.Hash, err)
+	}
+	return spent, nil
+}
+
+// buildUndo finds the outputs block spent in the transactions before it
+func buildUndo(txn StoreTxn, block *Block) ([]SpentOutput, error) {
+	var spent []SpentOutput
+	inBlock := make(map[string]*Transaction)
+
+	for _, tx := range block.Transactions {
+		if !tx.IsMinerTx() {
+			for _, in := range tx.Inputs {
+				prevTx, height := inBlock[string(in.ID)], block.Height
+				if prevTx == nil {
+					found, loc, err := findTransactionTxn(txn, block.PrevHash, in.ID)
+					if err != nil {
+						return nil, fmt.Errorf("rebuilding undo record of block %x: %w", block.Hash, err)
+					}
+					prevTx, height = &found, loc.Height
+				}
+				if in.Out < 0 || in.Out >= len(prevTx.Outputs) {
+					return nil, fmt.Errorf("%w: %s", ErrOutputNotFound, outpoint(in.ID, in.Out))
+				}
+				spent = append(spent, SpentOutput{
+					TxID:     in.ID,
+					Out:      in.Out,
+					Output:   prevTx.Outputs[in.Out],
+					Height:   height,
+					Coinbase: prevTx.IsMinerTx(),
+				})
+			}
+		}
+		inBlock[string(tx.ID)] = tx
+	}
+	return spent, nil
+}
+
+// connectUTXOs spends the outputs the transactions of block spend and adds
+// the ones they create, it returns the spent outputs in the order they were
+// spent
+func connectUTXOs(txn StoreTxn, block *Block) ([]SpentOutput, error) {
+	var spent []SpentOutput
+	for _, tx := range block.Transactions {
+		if !tx.IsMinerTx() {
+			for _, in := range tx.Inputs {
+				outs, err := getUTXOs(txn, in.ID)
+				if errors.Is(err, ErrKeyNotFound) {
+					return nil, fmt.Errorf("%w: %s is not in the UTXO set", ErrOutputNotFound, outpoint(in.ID, in.Out))
+				}
+				if err != nil {
+					return nil, err
+				}
+				var output TxOutput
+				if in.Out >= 0 && in.Out < len(outs.Outputs) {
+					output = outs.Outputs[in.Out]
+				}
+				if !outs.Spend(in.Out) {
+					return nil, fmt.Errorf("%w: %s is not in the UTXO set", ErrOutputNotFound, outpoint(in.ID, in.Out))
+				}
+				spent = append(spent, SpentOutput{
+					TxID:     in.ID,
+					Out:      in.Out,
+					Output:   output,
+					Height:   outs.Height,
+					Coinbase: outs.Coinbase,
+				})
+				if err := putUTXOs(txn, in.ID, outs); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		//Update UXTO for the new outputs, including the Miner(Miner Benefits) transaction
+		if err := putUTXOs(txn, tx.ID, NewTxOutputs(tx, block.Height)); err != nil {
+			return nil, err
+		}
+	}
+	return spent, nil
+}
+
+// disconnectUTXOs undoes connectUTXOs, transactions are walked backwards so
+// outputs spent in the same block are put back before their creator goes
+func disconnectUTXOs(txn StoreTxn, block *Block, spent []SpentOutput) error {
+	for i := len(block.Transactions) - 1; i >= 0; i-- {
+		tx := block.Transactions[i]
+		if err := txn.Delete(utxoKey(tx.ID)); err != nil {
+			return err
+		}
+		if tx.IsMinerTx() {
+			continue
+		}
+
+		for j := len(tx.Inputs) - 1; j >= 0; j-- {
+			if len(spent) == 0 {
+				return fmt.Errorf("%w: undo record of block %x is too short", ErrMalformedData, block.Hash)
+			}
+			s := spent[len(spent)-1]
+			spent = spent[:len(spent)-1]
+
+			outs, err := getUTXOs(txn, s.TxID)
+			if errors.Is(err, ErrKeyNotFound) {
+				outs, err = TxOutputs{Height: s.Height, Coinbase: s.Coinbase}, nil
+			}
+			if err != nil {
+				return err
+			}
+			for len(outs.Outputs) <= s.Out {
+				outs.Outputs = append(outs.Outputs, TxOutput{})
+			}
+			outs.Outputs[s.Out] = s.Output
+			if err := putUTXOs(txn, s.TxID, outs); err != nil {
+				return err
+			}
+		}
+	}
+	if len(spent) != 0 {
+		return fmt.Errorf("%w: undo record of block %x is too long", ErrMalformedData, block.Hash)
+	}
+	return nil
+}
+
+// connectBlock makes block, whose parent is the tip, part of the main chain:
+// its outputs join the UTXO set, its undo record is stored and the indexes
+// point at it
+func connectBlock(txn StoreTxn, block *Block, indexes chainIndexes) error {
+	spent, err := connectUTXOs(txn, block)
+	if err != nil {
+		return fmt.Errorf("connecting block %x: %w", block.Hash, err)
+	}
+	if err := txn.Set(undoKey(block.Hash), encodeUndo(spent)); err != nil {
+		return err
+	}
+	if err := txn.Set(heightKey(block.Height), block.Hash); err != nil {
+		return err
+	}
+	return indexes.connect(txn, block)
+}
+
+// disconnectBlock takes block, the tip, off the main chain
+func disconnectBlock(txn StoreTxn, block *Block, indexes chainIndexes) error {
+	spent, err := getUndo(txn, block)
+	if err != nil {
+		return err
+	}
+	if err := disconnectUTXOs(txn, block, spent); err != nil {
+		return fmt.Errorf("disconnecting block %x: %w", block.Hash, err)
+	}
+	if err := txn.Delete(undoKey(block.Hash)); err != nil {
+		return err
+	}
+	if err := txn.Delete(heightKey(block.Height)); err != nil {
+		return err
+	}
+	return indexes.disconnect(txn, block)
+}
+
+// setMainChain moves the tip to the stored block tip. The blocks leaving the
+// main chain are disconnected from the old tip down to the fork point, then
+// the ones joining it are connected upwards, all in txn so the UTXO set and
+// the indexes always match the tip. It returns the blocks that moved.
+func setMainChain(txn StoreTxn, tip []byte) (*ReorgEvent, error) {
+	var event *ReorgEvent
+	oldTip, err := getLastHash(txn)
+	if errors.Is(err, ErrKeyNotFound) {
+		// The first block stored, every block up to tip is connected
+		event = &ReorgEvent{NewTip: tip}
+		for hash := tip; ; {
+			block, err := getBlockTxn(txn, hash)
+			if err != nil {
+				return nil, err
+			}
+			event.Connected = append([]*Block{block}, event.Connected...)
+			if block.IsGenesis() {
+				break
+			}
+			hash = block.PrevHash
+		}
+	} else if err != nil {
+		return nil, err
+	} else if event, err = findFork(txn, oldTip, tip); err != nil {
+		return nil, err
+	}
+
+	indexes, err := loadChainIndexes(txn)
+	if err != nil {
+		return nil, err
+	}
+	for _, block := range event.Disconnected {
+		if err := disconnectBlock(txn, block, indexes); err != nil {
+			return nil, err
+		}
+	}
+	for _, block := range event.Connected {
+		if err := connectBlock(txn, block, indexes); err != nil {
+			return nil, err
+		}
+	}
+
+	return event, setLastHash(txn, tip)
+}
@@ -0,0 +1,119 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// wantSameStore fails unless store holds exactly the keys and values of want
+func wantSameStore(t *testing.T, store ChainStore, want map[string]string) {
+	t.Helper()
+	got := storeContent(t, store)
+	for key, value := range want {
+		if stored, ok := got[key]; !ok {
+			t.Errorf("key %q is gone", key)
+		} else if stored != value {
+			t.Errorf("key %q was changed", key)
+		}
+	}
+	for key := range got {
+		if _, ok := want[key]; !ok {
+			t.Errorf("key %q was added", key)
+		}
+	}
+}
+
+func TestDisconnectBlockRestoresUTXOs(t *testing.T) {
+	a, b := newTestWallet(t), newTestWallet(t)
+	chain := newTestChain(t, a)
+	coinbase := genesisCoinbase(t, chain)
+	value := coinbase.Outputs[0].Value
+
+	// Leave an output of pay unspent so its entry is put back next to one
+	// that never left
+	pay := spendTx(t, a, coinbase, 0, []string{b.address, a.address}, []Amount{value / 2, value/2 - 1000})
+	addTestBlock(t, chain, chain.LastHash, a, pay)
+	before := storeContent(t, chain.Database)
+
+	// The block spends an output of pay and one created in the block itself
+	spend := spendTx(t, b, pay, 0, []string{a.address}, []Amount{value/2 - 1000})
+	respend := spendTx(t, a, spend, 0, []string{b.address}, []Amount{value/2 - 2000})
+	block := testBlock(t, chain, chain.LastHash, a, spend, respend)
+
+	err := chain.Database.Update(func(txn StoreTxn) error {
+		indexes, err := loadChainIndexes(txn)
+		if err != nil {
+			return err
+		}
+		return connectBlock(txn, block, indexes)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = chain.Database.View(func(txn StoreTxn) error {
+		_, err := txn.Get(undoKey(block.Hash))
+		return err
+	})
+	if err != nil {
+		t.Fatalf("no undo record was stored: %v", err)
+	}
+
+	// Disconnecting reads the spent outputs back from the undo record
+	err = chain.Database.Update(func(txn StoreTxn) error {
+		indexes, err := loadChainIndexes(txn)
+		if err != nil {
+			return err
+		}
+		return disconnectBlock(txn, block, indexes)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantSameStore(t, chain.Database, before)
+}
+
+// A reorganization that fails partway leaves the chain as it was, the
+// blocks already disconnected included
+func TestFailedReorgKeepsTip(t *testing.T) {
+	a, b := newTestWallet(t), newTestWallet(t)
+	chain := newTestChain(t, a)
+	coinbase := genesisCoinbase(t, chain)
+	value := coinbase.Outputs[0].Value
+	fork := chain.LastHash
+
+	pay := spendTx(t, a, coinbase, 0, []string{b.address}, []Amount{value - 1000})
+	tip := addTestBlock(t, chain, fork, a, pay)
+
+	// The heavier branch spends an output only the old branch created,
+	// connecting its second block fails after the tip was disconnected
+	side := testBlock(t, chain, fork, b)
+	if err := chain.AddBlock(side); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(chain.LastHash, tip.Hash) {
+		t.Fatal("a branch of equal work took over")
+	}
+	missing := spendTx(t, b, pay, 0, []string{a.address}, []Amount{value - 2000})
+	before := storeContent(t, chain.Database)
+
+	bad := testBlock(t, chain, side.Hash, b, missing)
+	if err := chain.AddBlock(bad); !errors.Is(err, ErrOutputNotFound) {
+		t.Fatalf("adding the block returned %v, want ErrOutputNotFound", err)
+	}
+	if !bytes.Equal(chain.LastHash, tip.Hash) {
+		t.Fatalf("tip moved to %x", chain.LastHash)
+	}
+	wantSameStore(t, chain.Database, before)
+
+	reopened, err := (&Blockchain{Database: chain.Database}).ContinueBlockchain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(reopened.LastHash, tip.Hash) {
+		t.Fatalf("the stored tip is %x, want %x", reopened.LastHash, tip.Hash)
+	}
+	if _, err := reopened.FindTransaction(pay.ID); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,49 +1,96 @@
 package blockchain
 
 import (
-	"bytes"
 	"encoding/hex"
-
-	badger "github.com/dgraph-io/badger"
-	log "github.com/sirupsen/logrus"
+	"errors"
 )
 
 var (
-	utxoPrefix  = []byte("utxo-")
+	utxoPrefix  = []byte("utxo/")
 	prefiLength = len(utxoPrefix)
 )
 
 type UXTOSet struct {
 	Blockchain *Blockchain
+	// Transactions not mined yet that new ones build on, nil to only see
+	// the chain
+	Unconfirmed UnconfirmedView
+}
+
+// UnconfirmedView is what a wallet sees of a memory pool: the outputs its
+// transactions spend are gone, and the ones they create may be spent
+type UnconfirmedView interface {
+	// IsSpent reports whether a transaction of the pool spends the output
+	IsSpent(txID []byte, out int) bool
+	// Spendable returns the transactions of the pool whose outputs a new
+	// transaction may spend
+	Spendable() []Transaction
+	// Transaction returns a transaction of the pool
+	Transaction(txID []byte) (Transaction, bool)
+}
+
+// The unspent outputs of a transaction are stored under utxo/<txid>
+func utxoKey(txID []byte) []byte {
+	return append(append([]byte{}, utxoPrefix...), txID...)
+}
+
+// getUTXOs returns the unspent outputs of the transaction txID,
+// ErrKeyNotFound when none are left
+func getUTXOs(txn StoreTxn, txID []byte) (TxOutputs, error) {
+	v, err := txn.Get(utxoKey(txID))
+	if err != nil {
+		return TxOutputs{}, err
+	}
+	return DeSerializeOutputs(v)
+}
+
+// putUTXOs stores the unspent outputs of txID, or removes the entry once
+// they are all spent
+func putUTXOs(txn StoreTxn, txID []byte, outs TxOutputs) error {
+	if outs.IsEmpty() {
+		return txn.Delete(utxoKey(txID))
+	}
+	return txn.Set(utxoKey(txID), outs.Serialize())
+}
+
+// forEachUTXO calls fn with every entry of the UTXO set
+func forEachUTXO(txn StoreTxn, fn func(txID []byte, outs TxOutputs) error) error {
+	return txn.Iterate(utxoPrefix, false, func(key, value []byte) error {
+		outs, err := DeSerializeOutputs(value)
+		if err != nil {
+			return err
+		}
+		return fn(key[prefiLength:], outs)
+	})
 }
 
 // Find and aggregate all spendable outputs that corresponds to the specificed publicKeyHash
 // such that the aggragation stops when the aggregated outputs value is greater/equal to the specified amount
-func (u *UXTOSet) FindSpendableOutputs(pubKeyHash []byte, amount float64) (float64, map[string][]int) {
+// Coinbase outputs that are not mature yet for the next block are left out
+// Confirmed outputs come first, then the unconfirmed ones, outputs spent by
+// unconfirmed transactions are left out
+func (u *UXTOSet) FindSpendableOutputs(pubKeyHash []byte, amount Amount) (Amount, map[string][]int, error) {
 	unspentOuts := make(map[string][]int)
-	accumulated := float64(0)
+	accumulated := Amount(0)
 
 	db := u.Blockchain.Database
+	height, err := u.Blockchain.GetBestHeight()
+	if err != nil {
+		return 0, nil, err
+	}
+	height++
 
-	err := db.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
-		// To enable key-only iteration, you need to set the IteratorOptions.PrefetchValues field to false
-		opts.PrefetchValues = false
-		it := txn.NewIterator(opts)
-		defer it.Close()
-
-		for it.Seek(utxoPrefix); it.ValidForPrefix(utxoPrefix); it.Next() {
-			item := it.Item()
-			k := item.KeyCopy(nil)
-
-			v, err := item.ValueCopy(nil)
-			Handle(err)
-			outs := DeSerializeOutputs(v)
-
-			k = bytes.TrimPrefix(k, utxoPrefix)
+	err = db.View(func(txn StoreTxn) error {
+		return forEachUTXO(txn, func(k []byte, outs TxOutputs) error {
 			txID := hex.EncodeToString(k)
+			if !outs.IsMature(height) {
+				return nil
+			}
 
 			for outIdx, out := range outs.Outputs {
+				if u.Unconfirmed != nil && u.Unconfirmed.IsSpent(k, outIdx) {
+					continue
+				}
 				if out.IsLockWithKey(pubKeyHash) && accumulated < amount {
 					accumulated += out.Value
 					unspentOuts[txID] = append(unspentOuts[txID], outIdx)
@@ -52,185 +99,195 @@ func (u *UXTOSet) FindSpendableOutputs(pubKeyHash []byte, amount float64) (float
 					}
 				}
 			}
+			return nil
+		})
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+	if u.Unconfirmed == nil {
+		return accumulated, unspentOuts, nil
+	}
+
+	for _, tx := range u.Unconfirmed.Spendable() {
+		for outIdx, out := range tx.Outputs {
+			if accumulated >= amount {
+				return accumulated, unspentOuts, nil
+			}
+			if out.IsLockWithKey(pubKeyHash) && !u.Unconfirmed.IsSpent(tx.ID, outIdx) {
+				accumulated += out.Value
+				txID := hex.EncodeToString(tx.ID)
+				unspentOuts[txID] = append(unspentOuts[txID], outIdx)
+			}
 		}
+	}
+	return accumulated, unspentOuts, nil
+}
 
-		return nil
-	})
-	Handle(err)
-	return accumulated, unspentOuts
+// TransactionFee returns what tx leaves to the miner, tx may spend the
+// outputs of the unconfirmed transactions
+func (u *UXTOSet) TransactionFee(tx *Transaction) (Amount, error) {
+	if u.Unconfirmed == nil {
+		return u.Blockchain.TransactionFee(tx)
+	}
+	parents := make(map[string]Transaction)
+	for _, in := range tx.Inputs {
+		if parent, ok := u.Unconfirmed.Transaction(in.ID); ok {
+			parents[hex.EncodeToString(in.ID)] = parent
+		}
+	}
+	return u.Blockchain.CheckTransactionInputs(tx, parents)
+}
+
+// prevTransactions returns the transactions whose outputs the inputs of tx
+// spend, by hex encoded ID, from the unconfirmed ones or the chain
+func (u *UXTOSet) prevTransactions(tx *Transaction) (map[string]Transaction, error) {
+	prevTxs := make(map[string]Transaction)
+	for _, in := range tx.Inputs {
+		if u.Unconfirmed != nil {
+			if prevTx, ok := u.Unconfirmed.Transaction(in.ID); ok {
+				prevTxs[hex.EncodeToString(in.ID)] = prevTx
+				continue
+			}
+		}
+		prevTx, err := u.Blockchain.FindTransaction(in.ID)
+		if err != nil {
+			return nil, err
+		}
+		prevTxs[hex.EncodeToString(in.ID)] = prevTx
+	}
+	return prevTxs, nil
 }
 
 // This handles Address Balance by getting all unspent transaction outputs
 // for a particular publicKeyHash
-func (u UXTOSet) FindUnSpentTransactions(pubKeyHash []byte) []TxOutput {
+func (u UXTOSet) FindUnSpentTransactions(pubKeyHash []byte) ([]TxOutput, error) {
 	var UTXOs []TxOutput
 	db := u.Blockchain.Database
 
-	err := db.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
-		it := txn.NewIterator(opts)
-		defer it.Close()
-
-		for it.Seek(utxoPrefix); it.ValidForPrefix(utxoPrefix); it.Next() {
-			item := it.Item()
-			v, err := item.ValueCopy(nil)
-
-			Handle(err)
-			outs := DeSerializeOutputs(v)
-
+	err := db.View(func(txn StoreTxn) error {
+		return forEachUTXO(txn, func(_ []byte, outs TxOutputs) error {
 			for _, out := range outs.Outputs {
 				if out.IsLockWithKey(pubKeyHash) {
 					UTXOs = append(UTXOs, out)
 				}
 			}
-		}
-
-		return nil
+			return nil
+		})
 	})
-	Handle(err)
 
-	return UTXOs
+	return UTXOs, err
 }
 
-func (u *UXTOSet) CountTransactions() int {
-	db := u.Blockchain.Database
-	counter := 0
-	err := db.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
-		it := txn.NewIterator(opts)
-		defer it.Close()
-		for it.Seek(utxoPrefix); it.ValidForPrefix(utxoPrefix); it.Next() {
-			counter++
-		}
-		return nil
-	})
-	Handle(err)
-	return counter
-}
-func (u *UXTOSet) Update(block *Block) {
+// FindBalance adds up the unspent outputs locked to pubKeyHash, coinbase
+// outputs that can't be spent in the next block yet are counted as immature
+func (u UXTOSet) FindBalance(pubKeyHash []byte) (spendable, immature Amount, err error) {
 	db := u.Blockchain.Database
-	err := db.Update(func(txn *badger.Txn) error {
-		for _, tx := range block.Transactions {
-			if tx.IsMinerTx() == false {
-				for _, in := range tx.Inputs {
-					updatedOutputs := TxOutputs{}
-					inID := append(utxoPrefix, in.ID...)
-					item, err := txn.Get(inID)
-					Handle(err)
-					v, err := item.ValueCopy(nil)
-					Handle(err)
-
-					outs := DeSerializeOutputs(v)
-					for outIdx, out := range outs.Outputs {
-						if outIdx != in.Out {
-							updatedOutputs.Outputs = append(updatedOutputs.Outputs, out)
-						}
-					}
-					if len(updatedOutputs.Outputs) == 0 {
-						if err := txn.Delete(inID); err != nil {
-							log.Panic(err)
-						}
-					} else {
-						if err := txn.Set(inID, updatedOutputs.Serialize()); err != nil {
-							log.Panic(err)
-						}
-					}
-				}
-				newOutputs := TxOutputs{}
-				for _, out := range tx.Outputs {
-					newOutputs.Outputs = append(newOutputs.Outputs, out)
+	height, err := u.Blockchain.GetBestHeight()
+	if err != nil {
+		return 0, 0, err
+	}
+	height++
+
+	err = db.View(func(txn StoreTxn) error {
+		return forEachUTXO(txn, func(_ []byte, outs TxOutputs) error {
+			for _, out := range outs.Outputs {
+				if !out.IsLockWithKey(pubKeyHash) {
+					continue
 				}
-				txID := append(utxoPrefix, tx.ID...)
-				err := txn.Set(txID, newOutputs.Serialize())
-				Handle(err)
-			} else {
-
-				//Update UXTO for Miner(Miner Benefits) transactions
-				newOutputs := TxOutputs{}
-				for _, out := range tx.Outputs {
-					newOutputs.Outputs = append(newOutputs.Outputs, out)
+				if outs.IsMature(height) {
+					spendable += out.Value
+				} else {
+					immature += out.Value
 				}
-				txID := append(utxoPrefix, tx.ID...)
-				err := txn.Set(txID, newOutputs.Serialize())
-				Handle(err)
 			}
-		}
-		return nil
+			return nil
+		})
 	})
+	if err != nil {
+		return 0, 0, err
+	}
 
-	Handle(err)
+	return spendable, immature, nil
 }
 
-// Update UTXOSet
-func (u *UXTOSet) Compute() {
+func (u *UXTOSet) CountTransactions() (int, error) {
 	db := u.Blockchain.Database
+	counter := 0
+	err := db.View(func(txn StoreTxn) error {
+		return txn.Iterate(utxoPrefix, false, func(_, _ []byte) error {
+			counter++
+			return nil
+		})
+	})
+	return counter, err
+}
 
-	u.DeleteByPrefix(utxoPrefix)
+// Compute rebuilds the UTXO set from the main chain. Connecting and
+// disconnecting blocks keeps it up to date, this is only needed to repair it.
+func (u *UXTOSet) Compute() error {
+	db := u.Blockchain.Database
 
-	UTXO := u.Blockchain.FindUTXO()
+	if err := u.DeleteByPrefix(utxoPrefix); err != nil {
+		return err
+	}
+
+	UTXO, err := u.Blockchain.FindUTXO()
+	if err != nil {
+		return err
+	}
 
-	err := db.Update(func(txn *badger.Txn) error {
+	return db.Update(func(txn StoreTxn) error {
 		for txId, outs := range UTXO {
 			key, err := hex.DecodeString(txId)
-			Handle(err)
+			if err != nil {
+				return err
+			}
 
-			key = append(utxoPrefix, key...)
-			err = txn.Set(key, outs.Serialize())
-			Handle(err)
+			if err := putUTXOs(txn, key, outs); err != nil {
+				return err
+			}
 		}
 		return nil
 	})
-
-	Handle(err)
 }
 
-func (u *UXTOSet) DeleteByPrefix(prefix []byte) {
-	deleteKeys := func(keysForDelete [][]byte) error {
-		if err := u.Blockchain.Database.Update(func(txn *badger.Txn) error {
-			for _, key := range keysForDelete {
-				if err := txn.Delete(key); err != nil {
-					return err
-				}
-			}
-			return nil
-		}); err != nil {
-			return err
-		}
-		return nil
-	}
+func (u *UXTOSet) DeleteByPrefix(prefix []byte) error {
 	// https://github.com/dgraph-io/badger#prefix-scans
 	// This is the maximum number of items that badgerDB can delete at once, so we
 	// have to aggregate all keys with utxo prefix and delete it in batch
 	collectSize := 100000
-	u.Blockchain.Database.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
-		opts.PrefetchValues = false
-		it := txn.NewIterator(opts)
-		defer it.Close()
-
+	errBatchFull := errors.New("batch full")
+	for {
 		keysForDelete := make([][]byte, 0, collectSize)
-		keysCollected := 0
-		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
-			key := it.Item().KeyCopy(nil)
-			keysForDelete = append(keysForDelete, key)
-			keysCollected++
-			if keysCollected == collectSize {
-				if err := deleteKeys(keysForDelete); err != nil {
-					log.Panic(err)
+		err := u.Blockchain.Database.View(func(txn StoreTxn) error {
+			return txn.Iterate(prefix, false, func(key, _ []byte) error {
+				keysForDelete = append(keysForDelete, key)
+				if len(keysForDelete) == collectSize {
+					return errBatchFull
 				}
-				// Reset keys to delete collection size
-				keysForDelete = make([][]byte, 0, collectSize)
-				keysCollected = 0
-			}
+				return nil
+			})
+		})
+		if err != nil && err != errBatchFull {
+			return err
+		}
+		if len(keysForDelete) == 0 {
+			return nil
 		}
 
-		if keysCollected > 0 {
-			if err := deleteKeys(keysForDelete); err != nil {
-				log.Panic(err)
+		// Keys are deleted once the read is over, the store may not take
+		// writes while it is open
+		err = u.Blockchain.Database.Update(func(txn StoreTxn) error {
+			for _, key := range keysForDelete {
+				if err := txn.Delete(key); err != nil {
+					return err
+				}
 			}
+			return nil
+		})
+		if err != nil {
+			return err
 		}
-
-		return nil
-	})
-
+	}
 }
@@ -0,0 +1,543 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/workspace/the-crypto-project/params"
+	"github.com/workspace/the-crypto-project/wallet"
+)
+
+// How far ahead of our clock a block timestamp may be
+const MaxFutureBlockTime = 2 * time.Hour
+
+// Number of blocks ending with the parent whose median timestamp a block
+// must come after
+const MedianTimeBlocks = 11
+
+// RejectCode identifies the consensus rule a block broke
+type RejectCode int
+
+const (
+	RejectNoTransactions RejectCode = iota + 1
+	RejectBadTxCount
+	RejectBadHeader
+	RejectBadDifficulty
+	RejectBadTimestamp
+	RejectInvalidPoW
+	RejectBadMerkleRoot
+	RejectBadCoinbase
+	RejectBadCoinbaseValue
+	RejectBadTransaction
+	RejectDoubleSpend
+	RejectOrphan
+	RejectBadHeight
+	RejectMissingInputs
+	RejectBadInputs
+	RejectInvalidSignature
+	RejectInsufficientInputs
+	RejectBlockTooLarge
+	RejectImmatureSpend
+	RejectBadGenesis
+)
+
+var rejectCodeStrings = map[RejectCode]string{
+	RejectNoTransactions:     "RejectNoTransactions",
+	RejectBadTxCount:         "RejectBadTxCount",
+	RejectBadHeader:          "RejectBadHeader",
+	RejectBadDifficulty:      "RejectBadDifficulty",
+	RejectBadTimestamp:       "RejectBadTimestamp",
+	RejectInvalidPoW:         "RejectInvalidPoW",
+	RejectBadMerkleRoot:      "RejectBadMerkleRoot",
+	RejectBadCoinbase:        "RejectBadCoinbase",
+	RejectBadCoinbaseValue:   "RejectBadCoinbaseValue",
+	RejectBadTransaction:     "RejectBadTransaction",
+	RejectDoubleSpend:        "RejectDoubleSpend",
+	RejectOrphan:             "RejectOrphan",
+	RejectBadHeight:          "RejectBadHeight",
+	RejectMissingInputs:      "RejectMissingInputs",
+	RejectBadInputs:          "RejectBadInputs",
+	RejectInvalidSignature:   "RejectInvalidSignature",
+	RejectInsufficientInputs: "RejectInsufficientInputs",
+	RejectBlockTooLarge:      "RejectBlockTooLarge",
+	RejectImmatureSpend:      "RejectImmatureSpend",
+	RejectBadGenesis:         "RejectBadGenesis",
+}
+
+func (code RejectCode) String() string {
+	if s, ok := rejectCodeStrings[code]; ok {
+		return s
+	}
+	return fmt.Sprintf("Unknown RejectCode (%d)", int(code))
+}
+
+// RuleError is returned when a block violates one of the consensus rules,
+// Code tells the caller which rule and Reason carries the details
+type RuleError struct {
+	Code   RejectCode
+	Reason string
+}
+
+func (e RuleError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Reason)
+}
+
+// Is lets errors.Is match rule errors against the sentinel errors of the
+// package, a block with a bad signature is an ErrInvalidSignature
+func (e RuleError) Is(target error) bool {
+	switch target {
+	case ErrInvalidSignature:
+		return e.Code == RejectInvalidSignature
+	case ErrTxNotFound:
+		return e.Code == RejectMissingInputs
+	case ErrBlockNotFound:
+		return e.Code == RejectOrphan
+	}
+	return false
+}
+
+func ruleError(code RejectCode, format string, args ...interface{}) RuleError {
+	return RuleError{code, fmt.Sprintf(format, args...)}
+}
+
+// outpoint formats a reference to a transaction output as txid:index
+func outpoint(txID []byte, out int) string {
+	return fmt.Sprintf("%x:%d", txID, out)
+}
+
+// CheckGenesis checks a genesis block received from a peer, on networks
+// that pin their genesis it must be that block
+func (b *Block) CheckGenesis() error {
+	if err := b.CheckBlock(); err != nil {
+		return err
+	}
+	// The height isn't part of the hashed header
+	if b.Height != GenesisHeight {
+		return ruleError(RejectBadGenesis, "genesis block %x has height %d, expected %d", b.Hash, b.Height, GenesisHeight)
+	}
+	if want := params.Active.GenesisHash; len(want) > 0 && !bytes.Equal(b.Hash, want) {
+		return ruleError(RejectBadGenesis, "genesis block %x is not the %s genesis %x", b.Hash, params.Active.Name, want)
+	}
+	return nil
+}
+
+// ValidateGenesis checks a genesis block received from a peer against the
+// chain. On networks that don't pin their genesis any peer can mine one, the
+// chain only takes one while it is empty.
+func (chain *Blockchain) ValidateGenesis(block *Block) error {
+	if err := block.CheckGenesis(); err != nil {
+		return err
+	}
+	if len(params.Active.GenesisHash) > 0 || len(chain.LastHash) == 0 {
+		return nil
+	}
+	genesis, err := chain.GetBlockHashAtHeight(GenesisHeight)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(block.Hash, genesis) {
+		return ruleError(RejectBadGenesis, "genesis block %x is not the genesis %x of the chain", block.Hash, genesis)
+	}
+	return nil
+}
+
+// CheckBlock performs the checks that don't depend on the rest of the chain:
+// proof of work, merkle root, coinbase layout and in-block double spends
+func (b *Block) CheckBlock() error {
+	if len(b.Transactions) == 0 {
+		return ruleError(RejectNoTransactions, "block %x has no transactions", b.Hash)
+	}
+	if b.TxCount != len(b.Transactions) {
+		return ruleError(RejectBadTxCount, "block %x claims %d transactions but has %d",
+			b.Hash, b.TxCount, len(b.Transactions))
+	}
+	if size := len(b.Serialize()); size > MaxBlockSize {
+		return ruleError(RejectBlockTooLarge, "block %x is %d bytes, more than the maximum of %d",
+			b.Hash, size, MaxBlockSize)
+	}
+	if b.Version != BlockVersion {
+		return ruleError(RejectBadHeader, "block %x has unknown version %d", b.Hash, b.Version)
+	}
+	if len(b.PrevHash) != 0 && len(b.PrevHash) != HashSize {
+		return ruleError(RejectBadHeader, "block %x previous hash has %d bytes", b.Hash, len(b.PrevHash))
+	}
+	if len(b.MerkleRoot) != HashSize {
+		return ruleError(RejectBadHeader, "block %x merkle root has %d bytes", b.Hash, len(b.MerkleRoot))
+	}
+	if target := CompactToBig(b.Bits); target.Sign() <= 0 || target.Cmp(params.Active.PowLimit) > 0 {
+		return ruleError(RejectBadDifficulty, "block %x target bits %08x are out of range", b.Hash, b.Bits)
+	}
+	if b.Timestamp > time.Now().Add(MaxFutureBlockTime).Unix() {
+		return ruleError(RejectBadTimestamp, "block %x timestamp %d is too far in the future", b.Hash, b.Timestamp)
+	}
+	if !NewProof(b).Validate() {
+		return ruleError(RejectInvalidPoW, "block %x does not satisfy its proof of work", b.Hash)
+	}
+	if !bytes.Equal(b.MerkleRoot, b.HashTransactions()) {
+		return ruleError(RejectBadMerkleRoot, "block %x merkle root %x does not match its transactions",
+			b.Hash, b.MerkleRoot)
+	}
+
+	// The first transaction pays the miner, and only the first one may
+	if !b.Transactions[0].IsMinerTx() {
+		return ruleError(RejectBadCoinbase, "first transaction of block %x is not a coinbase", b.Hash)
+	}
+
+	spent := make(map[string]bool)
+	for i, tx := range b.Transactions {
+		if i > 0 && tx.IsMinerTx() {
+			return ruleError(RejectBadCoinbase, "block %x has more than one coinbase", b.Hash)
+		}
+		if err := checkTransactionSanity(tx); err != nil {
+			return err
+		}
+		if tx.IsMinerTx() {
+			continue
+		}
+		for _, in := range tx.Inputs {
+			op := outpoint(in.ID, in.Out)
+			if spent[op] {
+				return ruleError(RejectDoubleSpend, "output %s is spent twice in block %x", op, b.Hash)
+			}
+			spent[op] = true
+		}
+	}
+
+	return nil
+}
+
+// checkTransactionSanity rejects transactions that are malformed on their own
+func checkTransactionSanity(tx *Transaction) error {
+	if !bytes.Equal(tx.ID, tx.Hash()) {
+		return ruleError(RejectBadTransaction, "transaction %x does not match its hash", tx.ID)
+	}
+	if len(tx.Inputs) == 0 {
+		return ruleError(RejectBadTransaction, "transaction %x has no inputs", tx.ID)
+	}
+	if len(tx.Outputs) == 0 {
+		return ruleError(RejectBadTransaction, "transaction %x has no outputs", tx.ID)
+	}
+	var total Amount
+	for i, out := range tx.Outputs {
+		if out.Value < 0 {
+			return ruleError(RejectBadTransaction, "transaction %x output %d has a negative value", tx.ID, i)
+		}
+		if out.Value > MaxMoney {
+			return ruleError(RejectBadTransaction, "transaction %x output %d value %s exceeds the maximum of %s",
+				tx.ID, i, out.Value, MaxMoney)
+		}
+		total += out.Value
+		if total > MaxMoney {
+			return ruleError(RejectBadTransaction, "transaction %x outputs total more than the maximum of %s",
+				tx.ID, MaxMoney)
+		}
+	}
+	if tx.IsMinerTx() {
+		return nil
+	}
+	for _, in := range tx.Inputs {
+		if len(in.ID) == 0 || in.Out < 0 {
+			return ruleError(RejectBadTransaction, "transaction %x has a null input", tx.ID)
+		}
+	}
+	return nil
+}
+
+// ValidateBlock runs the full set of consensus rules against a block before
+// it is added to the chain. The block is checked against its own parent, so
+// it does not have to extend the current tip.
+func (chain *Blockchain) ValidateBlock(block *Block) error {
+	if err := block.CheckBlock(); err != nil {
+		return err
+	}
+
+	parent, err := chain.GetBlock(block.PrevHash)
+	if errors.Is(err, ErrBlockNotFound) {
+		return ruleError(RejectOrphan, "parent %x of block %x is unknown", block.PrevHash, block.Hash)
+	}
+	if err != nil {
+		return err
+	}
+	if parent.Height+1 != block.Height {
+		return ruleError(RejectBadHeight, "block %x has height %d, expected %d",
+			block.Hash, block.Height, parent.Height+1)
+	}
+	bits, err := chain.CalcNextBits(&parent)
+	if err != nil {
+		return err
+	}
+	if block.Bits != bits {
+		return ruleError(RejectBadDifficulty, "block %x has bits %08x, expected %08x for height %d",
+			block.Hash, block.Bits, bits, block.Height)
+	}
+
+	// Without a lower bound a miner could backdate the blocks of an interval
+	// to ease the next target as far as MaxRetargetFactor allows
+	medianTime, err := chain.CalcPastMedianTime(&parent)
+	if err != nil {
+		return err
+	}
+	if block.Timestamp <= medianTime {
+		return ruleError(RejectBadTimestamp, "block %x timestamp %d is not after the median time %d of the blocks before it",
+			block.Hash, block.Timestamp, medianTime)
+	}
+
+	// Transactions may spend outputs created earlier in the same block,
+	// the others must spend outputs unspent on the branch of parent
+	var fees Amount
+	err = chain.branchView(parent.Hash, func(txn StoreTxn) error {
+		inBlock := make(map[string]Transaction)
+		for _, tx := range block.Transactions {
+			if !tx.IsMinerTx() {
+				fee, err := validateTransaction(txn, tx, block.Height, inBlock)
+				if err != nil {
+					return err
+				}
+				if fees, err = fees.Add(fee); err != nil {
+					return ruleError(RejectBadTransaction, "fees of block %x overflow", block.Hash)
+				}
+			}
+			inBlock[hex.EncodeToString(tx.ID)] = *tx
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// The miner may claim the subsidy and the fees, output values were
+	// bounded by MaxMoney in CheckBlock so the sum can't overflow
+	var reward Amount
+	for _, out := range block.Transactions[0].Outputs {
+		reward += out.Value
+	}
+	maxReward, err := fees.Add(CalcBlockSubsidy(block.Height))
+	if err != nil {
+		return ruleError(RejectBadCoinbaseValue, "fees of block %x overflow", block.Hash)
+	}
+	if reward > maxReward {
+		return ruleError(RejectBadCoinbaseValue, "coinbase of block %x pays %s, at most %s is allowed",
+			block.Hash, reward, maxReward)
+	}
+
+	return nil
+}
+
+// validateTransaction checks that every input of tx spends an unspent output
+// of txn's UTXO set, or of a transaction before it in its block, that it is
+// allowed to unlock, that the signatures are valid and that the outputs don't
+// spend more than the inputs. The transaction goes in a block at height,
+// coinbase outputs it spends must be mature by then. It returns the fee, what
+// the inputs are worth beyond the outputs.
+func validateTransaction(txn StoreTxn, tx *Transaction, height int, inBlock map[string]Transaction) (Amount, error) {
+	prevTxs := make(map[string]Transaction)
+	var in, out Amount
+	var err error
+
+	for _, input := range tx.Inputs {
+		id := hex.EncodeToString(input.ID)
+		prevTx, ok := inBlock[id]
+		entry := NewTxOutputs(&prevTx, height)
+		if !ok {
+			if entry, err = getUTXOs(txn, input.ID); errors.Is(err, ErrKeyNotFound) {
+				return 0, ruleError(RejectMissingInputs, "transaction %x spends unknown or spent transaction %x",
+					tx.ID, input.ID)
+			}
+			if err != nil {
+				return 0, err
+			}
+			if input.Out >= 0 && input.Out < len(entry.Outputs) && entry.Outputs[input.Out].IsSpent() {
+				return 0, ruleError(RejectDoubleSpend, "transaction %x spends output %s, already spent",
+					tx.ID, outpoint(input.ID, input.Out))
+			}
+			prevTx = Transaction{ID: input.ID, Outputs: entry.Outputs}
+		}
+		// Rewards of blocks that may still be reorganized away can't move
+		if !entry.IsMature(height) {
+			return 0, ruleError(RejectImmatureSpend, "transaction %x spends coinbase %x at height %d before it matures",
+				tx.ID, input.ID, height)
+		}
+		if input.Out >= len(prevTx.Outputs) {
+			return 0, ruleError(RejectBadInputs, "transaction %x spends non-existent output %s",
+				tx.ID, outpoint(input.ID, input.Out))
+		}
+		prevOut := prevTx.Outputs[input.Out]
+		if !prevOut.IsLockWithKey(wallet.PublicKeyHash(input.PubKey)) {
+			return 0, ruleError(RejectBadInputs, "transaction %x cannot unlock output %s",
+				tx.ID, outpoint(input.ID, input.Out))
+		}
+		if in, err = in.Add(prevOut.Value); err != nil || !in.IsValid() {
+			return 0, ruleError(RejectBadInputs, "transaction %x inputs total more than the maximum of %s",
+				tx.ID, MaxMoney)
+		}
+		prevTxs[id] = prevTx
+	}
+
+	if err := tx.Verify(prevTxs); err != nil {
+		return 0, ruleError(RejectInvalidSignature, "transaction %x: %v", tx.ID, err)
+	}
+
+	for _, o := range tx.Outputs {
+		out += o.Value
+	}
+	if out > in {
+		return 0, ruleError(RejectInsufficientInputs, "transaction %x spends %s but only has %s",
+			tx.ID, out, in)
+	}
+
+	return in - out, nil
+}
+
+// errDiscardView rolls back the transaction a branch view was built in
+var errDiscardView = errors.New("discard branch view")
+
+// branchView runs fn with the UTXO set of the branch ending with the block
+// parent. That is the stored set when parent is the tip, otherwise the main
+// chain is reorganized to parent in a transaction thrown away once fn
+// returns.
+func (chain *Blockchain) branchView(parent []byte, fn func(txn StoreTxn) error) error {
+	errNotTip := errors.New("not the tip")
+	err := chain.Database.View(func(txn StoreTxn) error {
+		tip, err := getLastHash(txn)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(tip, parent) {
+			return errNotTip
+		}
+		return fn(txn)
+	})
+	if !errors.Is(err, errNotTip) {
+		return err
+	}
+
+	err = chain.Database.Update(func(txn StoreTxn) error {
+		if _, err := setMainChain(txn, parent); err != nil {
+			return fmt.Errorf("building the UTXO set of branch %x: %w", parent, err)
+		}
+		if err := fn(txn); err != nil {
+			return err
+		}
+		return errDiscardView
+	})
+	if errors.Is(err, errDiscardView) {
+		return nil
+	}
+	return err
+}
+
+// CheckTransactionInputs validates tx for the next block the way a memory
+// pool admits it. Every input must spend an unspent output of the UTXO set,
+// mature at the next height, or an output of one of the unconfirmed
+// transactions, by hex encoded ID. Outputs two unconfirmed transactions both
+// spend are left to the caller. It returns the fee.
+func (chain *Blockchain) CheckTransactionInputs(tx *Transaction, unconfirmed map[string]Transaction) (Amount, error) {
+	if tx.IsMinerTx() {
+		return 0, ruleError(RejectBadCoinbase, "coinbase %x outside of a block", tx.ID)
+	}
+	if err := checkTransactionSanity(tx); err != nil {
+		return 0, err
+	}
+	height, err := chain.GetBestHeight()
+	if err != nil {
+		return 0, err
+	}
+
+	prevTxs := make(map[string]Transaction)
+	spent := make(map[string]bool)
+	var in, out Amount
+	err = chain.Database.View(func(txn StoreTxn) error {
+		for _, input := range tx.Inputs {
+			if spent[outpoint(input.ID, input.Out)] {
+				return ruleError(RejectDoubleSpend, "transaction %x spends output %s twice",
+					tx.ID, outpoint(input.ID, input.Out))
+			}
+			spent[outpoint(input.ID, input.Out)] = true
+
+			id := hex.EncodeToString(input.ID)
+			prevTx, ok := unconfirmed[id]
+			if !ok {
+				entry, err := getUTXOs(txn, input.ID)
+				if errors.Is(err, ErrKeyNotFound) {
+					return ruleError(RejectMissingInputs, "transaction %x spends unknown or spent output %s",
+						tx.ID, outpoint(input.ID, input.Out))
+				}
+				if err != nil {
+					return err
+				}
+				if !entry.IsMature(height + 1) {
+					return ruleError(RejectImmatureSpend, "transaction %x spends coinbase %x before it matures",
+						tx.ID, input.ID)
+				}
+				prevTx = Transaction{ID: input.ID, Outputs: entry.Outputs}
+			}
+			if input.Out >= len(prevTx.Outputs) || prevTx.Outputs[input.Out].IsSpent() {
+				return ruleError(RejectMissingInputs, "transaction %x spends unknown or spent output %s",
+					tx.ID, outpoint(input.ID, input.Out))
+			}
+			prevOut := prevTx.Outputs[input.Out]
+			if !prevOut.IsLockWithKey(wallet.PublicKeyHash(input.PubKey)) {
+				return ruleError(RejectBadInputs, "transaction %x cannot unlock output %s",
+					tx.ID, outpoint(input.ID, input.Out))
+			}
+			var err error
+			if in, err = in.Add(prevOut.Value); err != nil || !in.IsValid() {
+				return ruleError(RejectBadInputs, "transaction %x inputs total more than the maximum of %s",
+					tx.ID, MaxMoney)
+			}
+			prevTxs[id] = prevTx
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if err := tx.Verify(prevTxs); err != nil {
+		return 0, ruleError(RejectInvalidSignature, "transaction %x: %v", tx.ID, err)
+	}
+
+	for _, o := range tx.Outputs {
+		out += o.Value
+	}
+	if out > in {
+		return 0, ruleError(RejectInsufficientInputs, "transaction %x spends %s but only has %s",
+			tx.ID, out, in)
+	}
+	return in - out, nil
+}
+
+// CalcPastMedianTime returns the median timestamp of parent and the blocks
+// before it, MedianTimeBlocks of them at most. The block following parent
+// must be stamped later.
+func (chain *Blockchain) CalcPastMedianTime(parent *Block) (int64, error) {
+	timestamps := []int64{parent.Timestamp}
+	block := parent
+	for len(timestamps) < MedianTimeBlocks && !block.IsGenesis() {
+		prev, err := chain.GetBlock(block.PrevHash)
+		if err != nil {
+			return 0, err
+		}
+		block = &prev
+		timestamps = append(timestamps, block.Timestamp)
+	}
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+	return timestamps[len(timestamps)/2], nil
+}
+
+// NextTimestamp returns the timestamp of a block mined now on top of
+// parent, the current time unless the blocks before it are stamped later
+func (chain *Blockchain) NextTimestamp(parent *Block) (int64, error) {
+	medianTime, err := chain.CalcPastMedianTime(parent)
+	if err != nil {
+		return 0, err
+	}
+	if now := time.Now().Unix(); now > medianTime {
+		return now, nil
+	}
+	return medianTime + 1, nil
+}
@@ -0,0 +1,178 @@
+package blockchain
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/workspace/the-crypto-project/params"
+)
+
+func TestValidateBlockDoubleSpendAcrossBlocks(t *testing.T) {
+	a, b := newTestWallet(t), newTestWallet(t)
+	chain := newTestChain(t, a)
+	coinbase := genesisCoinbase(t, chain)
+	value := coinbase.Outputs[0].Value
+
+	pay := spendTx(t, a, coinbase, 0, []string{b.address, a.address}, []Amount{value / 2, value/2 - 1000})
+	addTestBlock(t, chain, chain.LastHash, a, pay)
+
+	// An output spent by an earlier block
+	again := spendTx(t, b, pay, 0, []string{a.address}, []Amount{value/2 - 1000})
+	respend := spendTx(t, b, pay, 0, []string{b.address}, []Amount{value/2 - 2000})
+	tip := addTestBlock(t, chain, chain.LastHash, a, again)
+	wantRule(t, chain.ValidateBlock(testBlock(t, chain, tip.Hash, a, respend)), RejectDoubleSpend)
+
+	// Every output of the coinbase is spent, its entry is gone
+	steal := spendTx(t, a, coinbase, 0, []string{a.address}, []Amount{value - 1000})
+	wantRule(t, chain.ValidateBlock(testBlock(t, chain, tip.Hash, a, steal)), RejectMissingInputs)
+}
+
+func TestValidateBlockSideChainSpends(t *testing.T) {
+	a, b := newTestWallet(t), newTestWallet(t)
+	chain := newTestChain(t, a)
+	fork := chain.LastHash
+	coinbase := genesisCoinbase(t, chain)
+	value := coinbase.Outputs[0].Value
+
+	pay := spendTx(t, a, coinbase, 0, []string{b.address, a.address}, []Amount{value / 2, value/2 - 1000})
+	main := addTestBlock(t, chain, fork, a, pay)
+	addTestBlock(t, chain, main.Hash, a)
+
+	// A side chain spending the same coinbase is checked against its own
+	// branch, where the coinbase is unspent
+	other := spendTx(t, a, coinbase, 0, []string{a.address, a.address}, []Amount{value / 2, value/2 - 1000})
+	side := addTestBlock(t, chain, fork, b, other)
+	if err := chain.ValidateBlock(testBlock(t, chain, fork, b, pay)); err != nil {
+		t.Fatalf("spending the coinbase on another branch: %v", err)
+	}
+
+	// Outputs of the main chain are unknown on the side chain, and outputs
+	// the side chain spent can't be spent again on it
+	spendPay := spendTx(t, b, pay, 0, []string{b.address}, []Amount{value/2 - 1000})
+	wantRule(t, chain.ValidateBlock(testBlock(t, chain, side.Hash, b, spendPay)), RejectMissingInputs)
+	again := spendTx(t, a, other, 0, []string{b.address}, []Amount{value/2 - 1000})
+	next := addTestBlock(t, chain, side.Hash, b, again)
+	respend := spendTx(t, a, other, 0, []string{a.address}, []Amount{value/2 - 2000})
+	wantRule(t, chain.ValidateBlock(testBlock(t, chain, next.Hash, b, respend)), RejectDoubleSpend)
+
+	// Validating side chains leaves the main chain alone
+	if tip, _ := chain.GetBestHeight(); tip != main.Height+1 {
+		t.Fatalf("tip at height %d, want %d", tip, main.Height+1)
+	}
+	if _, err := chain.TransactionFee(spendPay); err != nil {
+		t.Fatalf("output of the main chain after validating a side chain: %v", err)
+	}
+}
+
+func TestNetworkGenesis(t *testing.T) {
+	defer func() { params.Active = &params.RegTest }()
+	for _, p := range []*params.ChainParams{&params.MainNet, &params.TestNet} {
+		params.Active = p
+		genesis := NetworkGenesis()
+		if err := genesis.CheckGenesis(); err != nil {
+			t.Fatalf("%s genesis: %v", p.Name, err)
+		}
+		decoded, err := DeSerialize(genesis.Serialize())
+		if err != nil || !bytes.Equal(decoded.Hash, p.GenesisHash) {
+			t.Fatalf("%s genesis decoded as %x: %v", p.Name, decoded.Hash, err)
+		}
+
+		// A chain of the network starts from it whatever address it is
+		// initialized with
+		chain, err := NewMemoryBlockchain("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(chain.LastHash, p.GenesisHash) {
+			t.Fatalf("%s chain starts from %x, want %x", p.Name, chain.LastHash, p.GenesisHash)
+		}
+		chain.Database.Close()
+	}
+
+	// Any other genesis is rejected, even a valid one
+	params.Active = &params.MainNet
+	w := newTestWallet(t)
+	coinbase, err := MinerTx(w.address, params.MainNet.GenesisData, GenesisHeight, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := Genesis(coinbase)
+	if err := other.CheckBlock(); err != nil {
+		t.Fatal(err)
+	}
+	wantRule(t, other.CheckGenesis(), RejectBadGenesis)
+}
+
+func TestValidateGenesis(t *testing.T) {
+	a, b := newTestWallet(t), newTestWallet(t)
+	chain := newTestChain(t, a)
+	genesis, err := chain.GetBlockByHeight(GenesisHeight)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := chain.ValidateGenesis(&genesis); err != nil {
+		t.Fatal(err)
+	}
+
+	// Regtest pins no genesis, another one is only taken by an empty chain
+	coinbase, err := MinerTx(b.address, params.Active.GenesisData, GenesisHeight, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := Genesis(coinbase)
+	wantRule(t, chain.ValidateGenesis(other), RejectBadGenesis)
+	empty := &Blockchain{Database: NewMemoryStore()}
+	defer empty.Database.Close()
+	if err := empty.ValidateGenesis(other); err != nil {
+		t.Fatal(err)
+	}
+
+	// The height isn't covered by the hash of the block
+	misplaced := *other
+	misplaced.Height = GenesisHeight + 5
+	wantRule(t, empty.ValidateGenesis(&misplaced), RejectBadGenesis)
+
+	defer func() { params.Active = &params.RegTest }()
+	params.Active = &params.MainNet
+	pinned := NetworkGenesis()
+	if err := empty.ValidateGenesis(pinned); err != nil {
+		t.Fatal(err)
+	}
+	pinned.Height = GenesisHeight + 5
+	wantRule(t, empty.ValidateGenesis(pinned), RejectBadGenesis)
+}
+
+func TestValidateBlockPastMedianTime(t *testing.T) {
+	a := newTestWallet(t)
+	chain := newTestChain(t, a)
+	for i := 0; i < MedianTimeBlocks; i++ {
+		addTestBlock(t, chain, chain.LastHash, a)
+	}
+	tip, err := chain.GetBlock(chain.LastHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	medianTime, err := chain.CalcPastMedianTime(&tip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bits, err := chain.CalcNextBits(&tip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blockAt := func(timestamp int64) *Block {
+		coinbase, err := MinerTx(a.address, "", tip.Height+1, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return CreateBlockAt([]*Transaction{coinbase}, tip.Hash, tip.Height+1, bits, timestamp)
+	}
+
+	// Backdated blocks are refused, even at the median itself
+	for _, timestamp := range []int64{params.Active.GenesisTime, medianTime - 1, medianTime} {
+		wantRule(t, chain.ValidateBlock(blockAt(timestamp)), RejectBadTimestamp)
+	}
+	if err := chain.ValidateBlock(blockAt(medianTime + 1)); err != nil {
+		t.Fatalf("block stamped after the median time: %v", err)
+	}
+}
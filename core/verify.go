@@ -0,0 +1,626 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/workspace/the-crypto-project/wallet"
+)
+
+// Levels of VerifyChain, each one runs the checks of the levels below it
+const (
+	// Blocks decode, sit at their height and link to their parent and the
+	// tip to the last one
+	VerifyLinkage = iota
+	// Proof of work, difficulty, merkle root and the rules CheckBlock applies
+	VerifyBlocks
+	// Transactions are replayed against a UTXO set rebuilt in memory: inputs
+	// exist and are mature, signatures are valid and nothing is created
+	VerifyTransactions
+	// The stored UTXO set and undo records match the replay
+	VerifyUTXOSet
+)
+
+// repairKey is set while RepairChain runs. A repair rebuilds the UTXO set
+// and the indexes over many transactions, one that was interrupted leaves
+// them partial and VerifyChain reports it until a repair completes.
+var repairKey = []byte("meta/repair")
+
+// ChainFault is the first inconsistency VerifyChain found
+type ChainFault struct {
+	Height int
+	// Hash of the block at fault, nil when the fault isn't in a block
+	Hash []byte
+	// Set when the blocks are fine and the UTXO set or an undo record is
+	// wrong, they are rebuilt without rolling back
+	InState bool
+	Err     error
+}
+
+func (f *ChainFault) Error() string {
+	if f.Hash == nil {
+		return fmt.Sprintf("height %d: %v", f.Height, f.Err)
+	}
+	return fmt.Sprintf("block %x at height %d: %v", f.Hash, f.Height, f.Err)
+}
+
+func (f *ChainFault) Unwrap() error {
+	return f.Err
+}
+
+// VerifyReport tells what VerifyChain checked and what it found
+type VerifyReport struct {
+	Level     int
+	TipHeight int
+	// Lowest height checked at Level, the blocks below it are only replayed
+	// at level VerifyTransactions and above
+	From    int
+	Checked int
+	// Nil when the chain is consistent
+	Fault *ChainFault
+	// Height of the last block that passed
+	LastGood int
+}
+
+// VerifyChain walks the main chain and checks the last depth blocks, all of
+// them when depth is 0, at level. From VerifyTransactions on the whole chain
+// is replayed to rebuild the UTXO set, but only the signatures of the last
+// depth blocks are checked. It stops at the first inconsistency and reports
+// it, the error is only set when the chain can't be read at all.
+func (chain *Blockchain) VerifyChain(depth, level int) (*VerifyReport, error) {
+	if level < VerifyLinkage || level > VerifyUTXOSet {
+		return nil, fmt.Errorf("verification level %d, it must be between %d and %d", level, VerifyLinkage, VerifyUTXOSet)
+	}
+	if depth < 0 {
+		return nil, fmt.Errorf("negative verification depth %d", depth)
+	}
+
+	// The walk follows the height index, the stored tip must be its last
+	// block. The tip block itself may be what is damaged.
+	var tip []byte
+	tipHeight := 0
+	repairing := false
+	err := chain.Database.View(func(txn StoreTxn) error {
+		var err error
+		tip, err = getLastHash(txn)
+		if errors.Is(err, ErrKeyNotFound) {
+			return ErrNoBlockchain
+		}
+		if err != nil {
+			return err
+		}
+		if repairing, err = repairInterrupted(txn); err != nil {
+			return err
+		}
+		err = txn.Iterate(heightPrefix, true, func(key, _ []byte) error {
+			tipHeight = int(binary.BigEndian.Uint32(key[len(heightPrefix):]))
+			return errStopIteration
+		})
+		if err == errStopIteration {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	report := &VerifyReport{Level: level, TipHeight: tipHeight, From: GenesisHeight}
+	if tipHeight < GenesisHeight {
+		report.Fault = &ChainFault{Height: GenesisHeight, Err: errors.New("the height index is empty")}
+		return report, nil
+	}
+	if depth > 0 && tipHeight-depth+1 > GenesisHeight {
+		report.From = tipHeight - depth + 1
+	}
+	start := report.From
+	if level >= VerifyTransactions {
+		start = GenesisHeight
+	}
+
+	verifier := &chainVerifier{
+		chain: chain,
+		level: level,
+		utxos: make(map[string]TxOutputs),
+	}
+	if start > GenesisHeight {
+		// Linkage of the first block checked is against the block before
+		if verifier.prev, err = chain.blockAtHeight(start - 1); err != nil {
+			report.Fault = &ChainFault{Height: start - 1, Err: err}
+			report.LastGood = start - 2
+			return report, nil
+		}
+	}
+
+	for height := start; height <= tipHeight; height++ {
+		block, err := chain.blockAtHeight(height)
+		if err == nil {
+			err = verifier.verifyBlock(block, height, height >= report.From)
+		}
+		if err != nil {
+			report.Fault = &ChainFault{Height: height, Err: err}
+			if block != nil {
+				report.Fault.Hash = block.Hash
+			}
+			var stateErr stateError
+			if errors.As(err, &stateErr) {
+				report.Fault.InState, report.Fault.Err = true, stateErr.err
+			}
+			report.LastGood = height - 1
+			return report, nil
+		}
+		if height >= report.From {
+			report.Checked++
+		}
+		if height%1000 == 0 {
+			log.Infof("Verified blocks up to height %d", height)
+		}
+	}
+	report.LastGood = tipHeight
+
+	if !bytes.Equal(verifier.prev.Hash, tip) {
+		report.Fault = &ChainFault{Height: tipHeight, Hash: verifier.prev.Hash,
+			Err: fmt.Errorf("the tip is %x, not the last block of the height index", tip)}
+		report.LastGood = tipHeight - 1
+		return report, nil
+	}
+	// The blocks are fine, the state a repair was rebuilding may not be
+	if repairing {
+		report.Fault = &ChainFault{Height: tipHeight, InState: true, Err: ErrRepairInterrupted}
+		return report, nil
+	}
+	if level >= VerifyUTXOSet {
+		if err := verifier.compareUTXOSet(); err != nil {
+			report.Fault = &ChainFault{Height: tipHeight, InState: true, Err: err}
+		}
+	}
+	return report, nil
+}
+
+// stateError marks the faults of the UTXO set and the undo records
+type stateError struct {
+	err error
+}
+
+func (e stateError) Error() string {
+	return e.err.Error()
+}
+
+// blockAtHeight reads the main chain block at height
+func (chain *Blockchain) blockAtHeight(height int) (*Block, error) {
+	var block *Block
+	err := chain.Database.View(func(txn StoreTxn) error {
+		hash, err := getHashAtHeight(txn, height)
+		if errors.Is(err, ErrKeyNotFound) {
+			return fmt.Errorf("%w: no block at height %d in the height index", ErrBlockNotFound, height)
+		}
+		if err != nil {
+			return err
+		}
+		if block, err = getBlockTxn(txn, hash); err != nil {
+			return err
+		}
+		// The hash of a decoded block is the hash of its header
+		if !bytes.Equal(block.Hash, hash) {
+			return fmt.Errorf("%w: block stored under %x hashes to %x", ErrMalformedData, hash, block.Hash)
+		}
+		return nil
+	})
+	return block, err
+}
+
+// chainVerifier replays the main chain block by block
+type chainVerifier struct {
+	chain *Blockchain
+	level int
+	// The UTXO set after prev, rebuilt from the genesis block
+	utxos map[string]TxOutputs
+	prev  *Block
+}
+
+// verifyBlock checks block, found at height in the height index, and makes it
+// the last block replayed. Signatures are only checked when full is set.
+func (v *chainVerifier) verifyBlock(block *Block, height int, full bool) error {
+	if block.Height != height {
+		return ruleError(RejectBadHeight, "block %x has height %d, expected %d", block.Hash, block.Height, height)
+	}
+	if height == GenesisHeight {
+		if !block.IsGenesis() {
+			return ruleError(RejectOrphan, "block %x at the genesis height has a parent %x", block.Hash, block.PrevHash)
+		}
+	} else if !bytes.Equal(block.PrevHash, v.prev.Hash) {
+		return ruleError(RejectOrphan, "block %x has parent %x, the block below it is %x", block.Hash, block.PrevHash, v.prev.Hash)
+	}
+
+	if full && v.level >= VerifyBlocks {
+		if err := block.CheckBlock(); err != nil {
+			return err
+		}
+		if !block.IsGenesis() {
+			bits, err := v.chain.CalcNextBits(v.prev)
+			if err != nil {
+				return err
+			}
+			if block.Bits != bits {
+				return ruleError(RejectBadDifficulty, "block %x has bits %08x, expected %08x", block.Hash, block.Bits, bits)
+			}
+		}
+	}
+
+	if v.level >= VerifyTransactions {
+		spent, err := replayBlock(block, v.utxos, full)
+		if err != nil {
+			return err
+		}
+		if full && v.level >= VerifyUTXOSet {
+			if err := v.compareUndo(block, spent); err != nil {
+				return stateError{err}
+			}
+		}
+	}
+
+	v.prev = block
+	return nil
+}
+
+// replayBlock checks the transactions of block against utxos, the UTXO set
+// of its parent, then applies them to it. It returns the outputs spent in the
+// order connectUTXOs records them in the undo record.
+func replayBlock(block *Block, utxos map[string]TxOutputs, checkSignatures bool) ([]SpentOutput, error) {
+	var spent []SpentOutput
+	var fees Amount
+	for _, tx := range block.Transactions {
+		if !tx.IsMinerTx() {
+			prevTxs := make(map[string]Transaction)
+			var in, out Amount
+			var err error
+			for _, input := range tx.Inputs {
+				id := hex.EncodeToString(input.ID)
+				outs, ok := utxos[id]
+				if !ok || input.Out < 0 || input.Out >= len(outs.Outputs) || outs.Outputs[input.Out].IsSpent() {
+					return nil, ruleError(RejectMissingInputs, "transaction %x spends %s, which is not in the UTXO set",
+						tx.ID, outpoint(input.ID, input.Out))
+				}
+				if !outs.IsMature(block.Height) {
+					return nil, ruleError(RejectImmatureSpend, "transaction %x spends coinbase %x before it matures",
+						tx.ID, input.ID)
+				}
+				prevOut := outs.Outputs[input.Out]
+				if !prevOut.IsLockWithKey(wallet.PublicKeyHash(input.PubKey)) {
+					return nil, ruleError(RejectBadInputs, "transaction %x cannot unlock output %s",
+						tx.ID, outpoint(input.ID, input.Out))
+				}
+				if in, err = in.Add(prevOut.Value); err != nil || !in.IsValid() {
+					return nil, ruleError(RejectBadInputs, "transaction %x inputs total more than the maximum of %s",
+						tx.ID, MaxMoney)
+				}
+				// Signatures only commit to the output they spend
+				prevTxs[id] = Transaction{ID: input.ID, Outputs: outs.Outputs}
+
+				spent = append(spent, SpentOutput{
+					TxID:     input.ID,
+					Out:      input.Out,
+					Output:   prevOut,
+					Height:   outs.Height,
+					Coinbase: outs.Coinbase,
+				})
+				outs.Outputs = append([]TxOutput{}, outs.Outputs...)
+				outs.Spend(input.Out)
+				if outs.IsEmpty() {
+					delete(utxos, id)
+				} else {
+					utxos[id] = outs
+				}
+			}
+
+			if checkSignatures {
+				if err := tx.Verify(prevTxs); err != nil {
+					return nil, ruleError(RejectInvalidSignature, "transaction %x: %v", tx.ID, err)
+				}
+			}
+			for _, o := range tx.Outputs {
+				out += o.Value
+			}
+			if out > in {
+				return nil, ruleError(RejectInsufficientInputs, "transaction %x spends %s but only has %s", tx.ID, out, in)
+			}
+			if fees, err = fees.Add(in - out); err != nil {
+				return nil, ruleError(RejectBadTransaction, "fees of block %x overflow", block.Hash)
+			}
+		}
+		utxos[hex.EncodeToString(tx.ID)] = NewTxOutputs(tx, block.Height)
+	}
+
+	var reward Amount
+	for _, out := range block.Transactions[0].Outputs {
+		reward += out.Value
+	}
+	maxReward, err := fees.Add(CalcBlockSubsidy(block.Height))
+	if err != nil || reward > maxReward {
+		return nil, ruleError(RejectBadCoinbaseValue, "coinbase of block %x pays %s, at most %s is allowed",
+			block.Hash, reward, maxReward)
+	}
+	return spent, nil
+}
+
+// compareUndo checks the stored undo record of block against the outputs the
+// replay spent. A block without one is fine, it is rebuilt when needed.
+func (v *chainVerifier) compareUndo(block *Block, spent []SpentOutput) error {
+	return v.chain.Database.View(func(txn StoreTxn) error {
+		data, err := txn.Get(undoKey(block.Hash))
+		if errors.Is(err, ErrKeyNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		stored, err := decodeUndo(data)
+		if err != nil {
+			return fmt.Errorf("%w: undo record: %v", ErrMalformedData, err)
+		}
+		if len(stored) != len(spent) {
+			return fmt.Errorf("undo record lists %d spent outputs, the block spends %d", len(stored), len(spent))
+		}
+		for i := range spent {
+			s, r := stored[i], spent[i]
+			if !bytes.Equal(s.TxID, r.TxID) || s.Out != r.Out || !sameOutput(s.Output, r.Output) ||
+				s.Height != r.Height || s.Coinbase != r.Coinbase {
+				return fmt.Errorf("undo record entry %d for %s does not match the output the block spends",
+					i, outpoint(r.TxID, r.Out))
+			}
+		}
+		return nil
+	})
+}
+
+// compareUTXOSet checks the stored UTXO set against the replayed one
+func (v *chainVerifier) compareUTXOSet() error {
+	seen := make(map[string]bool)
+	err := v.chain.Database.View(func(txn StoreTxn) error {
+		return forEachUTXO(txn, func(txID []byte, outs TxOutputs) error {
+			id := hex.EncodeToString(txID)
+			seen[id] = true
+			replayed, ok := v.utxos[id]
+			if !ok {
+				return fmt.Errorf("the UTXO set has outputs of %x, all of them are spent or it doesn't exist", txID)
+			}
+			if !sameUTXOs(outs, replayed) {
+				return fmt.Errorf("the UTXO set entry of %x does not match the chain", txID)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	var missing []string
+	for id := range v.utxos {
+		if !seen[id] {
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("the UTXO set is missing the unspent outputs of %s and %d other transactions",
+			missing[0], len(missing)-1)
+	}
+	return nil
+}
+
+func sameOutput(a, b TxOutput) bool {
+	return a.Value == b.Value && bytes.Equal(a.PubKeyHash, b.PubKeyHash)
+}
+
+// sameUTXOs compares two UTXO set entries, trailing spent outputs don't count
+func sameUTXOs(a, b TxOutputs) bool {
+	if a.Height != b.Height || a.Coinbase != b.Coinbase {
+		return false
+	}
+	for i := 0; i < len(a.Outputs) || i < len(b.Outputs); i++ {
+		var x, y TxOutput
+		if i < len(a.Outputs) {
+			x = a.Outputs[i]
+		}
+		if i < len(b.Outputs) {
+			y = b.Outputs[i]
+		}
+		if !sameOutput(x, y) {
+			return false
+		}
+	}
+	return true
+}
+
+// RepairChain fixes the fault of report: the main chain is rolled back to
+// the last good block, dropping the blocks above it, then the UTXO set, the
+// undo records and the indexes are rebuilt from the blocks left. Peers send
+// the dropped blocks again, if they are valid, once the node is started.
+// Until it returns the chain is marked as being repaired, a repair that is
+// interrupted must be run again.
+func (chain *Blockchain) RepairChain(report *VerifyReport) error {
+	if report.Fault == nil {
+		return nil
+	}
+	if report.LastGood < GenesisHeight {
+		return fmt.Errorf("the genesis block is at fault, there is nothing to roll back to: %w", report.Fault)
+	}
+	if err := chain.setRepairing(true); err != nil {
+		return err
+	}
+
+	if !report.Fault.InState {
+		if err := chain.rollback(report.LastGood); err != nil {
+			return fmt.Errorf("rolling back to height %d: %w", report.LastGood, err)
+		}
+	}
+	if err := chain.rebuildChainState(); err != nil {
+		return err
+	}
+
+	var indexes chainIndexes
+	err := chain.Database.View(func(txn StoreTxn) error {
+		var err error
+		indexes, err = loadChainIndexes(txn)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if indexes.tx || indexes.addr {
+		if _, err := chain.Reindex(indexes.tx, indexes.addr); err != nil {
+			return err
+		}
+	}
+	return chain.setRepairing(false)
+}
+
+// repairInterrupted reports whether the last repair of the chain didn't
+// complete
+func repairInterrupted(txn StoreTxn) (bool, error) {
+	_, err := txn.Get(repairKey)
+	if errors.Is(err, ErrKeyNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// setRepairing marks the chain as being repaired, or clears the mark once
+// the repair is done
+func (chain *Blockchain) setRepairing(repairing bool) error {
+	return chain.Database.Update(func(txn StoreTxn) error {
+		if repairing {
+			return txn.Set(repairKey, []byte{1})
+		}
+		return txn.Delete(repairKey)
+	})
+}
+
+// rollback makes the main chain block at height the tip and deletes the main
+// chain blocks above it. The UTXO set is left behind, rebuildChainState
+// catches it up.
+func (chain *Blockchain) rollback(height int) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	goodTip, err := chain.GetBlockHashAtHeight(height)
+	if err != nil {
+		return err
+	}
+
+	// The blocks above height, from the height index and from the tip down
+	// in case the index is what broke
+	drop := make(map[string][]byte)
+	var heightKeys [][]byte
+	err = chain.Database.View(func(txn StoreTxn) error {
+		err := txn.Iterate(heightPrefix, false, func(key, hash []byte) error {
+			if int(binary.BigEndian.Uint32(key[len(heightPrefix):])) > height {
+				heightKeys = append(heightKeys, key)
+				drop[string(hash)] = hash
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		hash, err := getLastHash(txn)
+		if err != nil {
+			return err
+		}
+		for {
+			// A block that can't be read ends the walk, its key is
+			// deleted all the same
+			block, err := getBlockTxn(txn, hash)
+			if err == nil && block.Height <= height {
+				return nil
+			}
+			drop[string(hash)] = hash
+			if err != nil {
+				return nil
+			}
+			hash = block.PrevHash
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	err = chain.Database.Update(func(txn StoreTxn) error {
+		for _, key := range heightKeys {
+			if err := txn.Delete(key); err != nil {
+				return err
+			}
+		}
+		return setLastHash(txn, goodTip)
+	})
+	if err != nil {
+		return err
+	}
+	chain.LastHash = goodTip
+
+	var batch [][]byte
+	deleteBatch := func() error {
+		return chain.Database.Update(func(txn StoreTxn) error {
+			for _, hash := range batch {
+				for _, key := range [][]byte{blockKey(hash), workKey(hash), undoKey(hash)} {
+					if err := txn.Delete(key); err != nil {
+						return err
+					}
+				}
+			}
+			batch = batch[:0]
+			return nil
+		})
+	}
+	for _, hash := range drop {
+		if batch = append(batch, hash); len(batch) == migrationBatchSize/3 {
+			if err := deleteBatch(); err != nil {
+				return err
+			}
+		}
+	}
+	log.Infof("Rolled back to height %d, %d blocks dropped", height, len(drop))
+	return deleteBatch()
+}
+
+// rebuildChainState drops the UTXO set and the undo records and connects
+// the main chain again from the genesis block, a block per transaction. The
+// chain is marked as being repaired meanwhile.
+func (chain *Blockchain) rebuildChainState() error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	tipHeight, err := chain.GetBestHeight()
+	if err != nil {
+		return err
+	}
+	if err := chain.Database.DropPrefix(utxoPrefix, undoPrefix); err != nil {
+		return err
+	}
+	for height := GenesisHeight; height <= tipHeight; height++ {
+		block, err := chain.blockAtHeight(height)
+		if err != nil {
+			return err
+		}
+		err = chain.Database.Update(func(txn StoreTxn) error {
+			spent, err := connectUTXOs(txn, block)
+			if err != nil {
+				return err
+			}
+			return txn.Set(undoKey(block.Hash), encodeUndo(spent))
+		})
+		if err != nil {
+			return fmt.Errorf("rebuilding the UTXO set at height %d: %w", height, err)
+		}
+		if height%1000 == 0 {
+			log.Infof("Rebuilt the UTXO set up to height %d", height)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// stateContent returns the UTXO set and the undo records of store
+func stateContent(t *testing.T, store ChainStore) map[string]string {
+	t.Helper()
+	state := make(map[string]string)
+	for key, value := range storeContent(t, store) {
+		if strings.HasPrefix(key, string(utxoPrefix)) || strings.HasPrefix(key, string(undoPrefix)) {
+			state[key] = value
+		}
+	}
+	return state
+}
+
+// wantSameState fails unless got holds the keys and values of want
+func wantSameState(t *testing.T, got, want map[string]string) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("%d UTXO entries and undo records, want %d", len(got), len(want))
+	}
+	for key, value := range want {
+		if got[key] != value {
+			t.Fatalf("key %q differs from the state before", key)
+		}
+	}
+}
+
+func TestRepairTamperedUTXOSet(t *testing.T) {
+	a, b := newTestWallet(t), newTestWallet(t)
+	chain := newTestChain(t, a)
+	coinbase := genesisCoinbase(t, chain)
+	value := coinbase.Outputs[0].Value
+	pay := spendTx(t, a, coinbase, 0, []string{b.address, a.address}, []Amount{value / 2, value/2 - 1000})
+	addTestBlock(t, chain, chain.LastHash, a, pay)
+	tip := chain.LastHash
+
+	report, err := chain.VerifyChain(0, VerifyUTXOSet)
+	if err != nil || report.Fault != nil {
+		t.Fatalf("fault %v in the untouched chain: %v", report.Fault, err)
+	}
+	want := stateContent(t, chain.Database)
+
+	// The payee's output is worth more than the block created
+	err = chain.Database.Update(func(txn StoreTxn) error {
+		outs, err := getUTXOs(txn, pay.ID)
+		if err != nil {
+			return err
+		}
+		outs.Outputs[0].Value += 1000
+		return putUTXOs(txn, pay.ID, outs)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err = chain.VerifyChain(0, VerifyUTXOSet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Fault == nil || !report.Fault.InState {
+		t.Fatalf("fault %v, want one in the UTXO set", report.Fault)
+	}
+
+	if err := chain.RepairChain(report); err != nil {
+		t.Fatal(err)
+	}
+	if report, err := chain.VerifyChain(0, VerifyUTXOSet); err != nil || report.Fault != nil {
+		t.Fatalf("fault %v after the repair: %v", report.Fault, err)
+	}
+	if !bytes.Equal(chain.LastHash, tip) {
+		t.Fatal("repairing the UTXO set rolled the chain back")
+	}
+	wantSameState(t, stateContent(t, chain.Database), want)
+}
+
+// A repair that stops partway leaves a UTXO set that may look consistent up
+// to the level checked, the chain stays at fault until a repair completes
+func TestInterruptedRepair(t *testing.T) {
+	a := newTestWallet(t)
+	chain := newTestChain(t, a)
+	want := stateContent(t, chain.Database)
+
+	// A crash right after the UTXO set was dropped
+	if err := chain.setRepairing(true); err != nil {
+		t.Fatal(err)
+	}
+	if err := chain.Database.DropPrefix(utxoPrefix, undoPrefix); err != nil {
+		t.Fatal(err)
+	}
+
+	for level := VerifyLinkage; level <= VerifyUTXOSet; level++ {
+		report, err := chain.VerifyChain(0, level)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.Fault == nil || !report.Fault.InState {
+			t.Fatalf("level %d: fault %v, want one in the UTXO set", level, report.Fault)
+		}
+		if level < VerifyUTXOSet && !errors.Is(report.Fault, ErrRepairInterrupted) {
+			t.Fatalf("level %d: fault %v, want ErrRepairInterrupted", level, report.Fault)
+		}
+	}
+
+	report, err := chain.VerifyChain(0, VerifyLinkage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := chain.RepairChain(report); err != nil {
+		t.Fatal(err)
+	}
+	if report, err := chain.VerifyChain(0, VerifyUTXOSet); err != nil || report.Fault != nil {
+		t.Fatalf("fault %v after the repair: %v", report.Fault, err)
+	}
+	wantSameState(t, stateContent(t, chain.Database), want)
+}
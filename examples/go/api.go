@@ -13,9 +13,9 @@ import (
 )
 
 type SendBody struct {
-	SendTo   string  `json:"sendto"`
-	SendFrom string  `json:"sendfrom"`
-	Amount   float64 `json:"amount"`
+	SendTo   string      `json:"sendto"`
+	SendFrom string      `json:"sendfrom"`
+	Amount   json.Number `json:"amount"`
 }
 
 const (
@@ -95,7 +95,7 @@ func send(w http.ResponseWriter, r *http.Request) {
 	}
 
 	fmt.Println(respBody)
-	byt := fmt.Sprintf(`{"id": 1 , "method": "API.Send", "params": [{"sendFrom":"%s","sendTo": "%s", "amount": %f}]}`, respBody.SendFrom, respBody.SendTo, respBody.Amount)
+	byt := fmt.Sprintf(`{"id": 1 , "method": "API.Send", "params": [{"sendFrom":"%s","sendTo": "%s", "amount": %s}]}`, respBody.SendFrom, respBody.SendTo, respBody.Amount)
 	var jsonStr = []byte(byt)
 	req, err := http.NewRequest("POST", URL, bytes.NewBuffer(jsonStr))
 	req.Header.Set("Content-Type", "application/json")
@@ -0,0 +1,83 @@
+// Build, serialize, hash and sign transactions the same way the node does.
+// The byte layout is documented in core/encoding.go, all integers are big
+// endian and byte strings are prefixed with their uint32 length.
+const crypto = require("crypto");
+
+const TX_VERSION = 1;
+// Output values are integers counted in base units, one token is 10^8 units
+const BASE_UNITS_PER_COIN = 100000000n;
+
+function uint32(n) {
+  const buf = Buffer.alloc(4);
+  buf.writeUInt32BE(n >>> 0);
+  return buf;
+}
+
+function varBytes(data) {
+  return Buffer.concat([uint32(data.length), data]);
+}
+
+function serializeInput(input) {
+  const out = Buffer.alloc(4);
+  out.writeInt32BE(input.out);
+  return Buffer.concat([
+    varBytes(input.txid),
+    out,
+    varBytes(input.signature || Buffer.alloc(0)),
+    varBytes(input.pubkey || Buffer.alloc(0)),
+  ]);
+}
+
+function serializeOutput(output) {
+  const value = Buffer.alloc(8);
+  value.writeBigInt64BE(BigInt(output.value));
+  return Buffer.concat([value, varBytes(output.pubkeyHash)]);
+}
+
+function serialize(tx) {
+  return Buffer.concat([
+    uint32(TX_VERSION),
+    uint32(tx.inputs.length),
+    ...tx.inputs.map(serializeInput),
+    uint32(tx.outputs.length),
+    ...tx.outputs.map(serializeOutput),
+  ]);
+}
+
+function txid(tx) {
+  return crypto.createHash("sha256").update(serialize(tx)).digest();
+}
+
+// The message signed for input `index`: every input loses its signature and
+// public key, the signed one carries the public key hash of the output it
+// spends instead.
+function signingData(tx, index, prevPubkeyHash) {
+  const inputs = tx.inputs.map((input) => ({ txid: input.txid, out: input.out }));
+  inputs[index].pubkey = prevPubkeyHash;
+  return serialize({ inputs, outputs: tx.outputs });
+}
+
+// Sign every input with a P-256 private key, prevPubkeyHashes[i] is the
+// public key hash of the output spent by input i. The public key is the
+// 64 byte X || Y of the key.
+function sign(tx, privateKey, publicKey, prevPubkeyHashes) {
+  tx.inputs.forEach((input, i) => {
+    input.signature = crypto.sign("sha256", signingData(tx, i, prevPubkeyHashes[i]), {
+      key: privateKey,
+      dsaEncoding: "ieee-p1363",
+    });
+    input.pubkey = publicKey;
+  });
+  return txid(tx);
+}
+
+module.exports = { serialize, txid, signingData, sign };
+
+if (require.main === module) {
+  const coinbase = {
+    inputs: [{ txid: Buffer.alloc(0), out: -1, pubkey: Buffer.from("abc") }],
+    outputs: [{ value: 20n * BASE_UNITS_PER_COIN, pubkeyHash: Buffer.from("bdde8b26b7a209e75bdb744f5dfd2d5b0f9dad03", "hex") }],
+  };
+  console.log(serialize(coinbase).toString("hex"));
+  console.log(txid(coinbase).toString("hex"));
+}
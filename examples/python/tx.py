@@ -0,0 +1,72 @@
+"""Build, serialize and hash transactions the same way the node does.
+
+The byte layout is documented in core/encoding.go, all integers are big
+endian and byte strings are prefixed with their uint32 length.
+"""
+import hashlib
+import struct
+
+TX_VERSION = 1
+# Output values are integers counted in base units, one token is 10^8 units
+BASE_UNITS_PER_COIN = 100_000_000
+
+
+def var_bytes(data):
+    return struct.pack(">I", len(data)) + data
+
+
+class TxInput:
+    def __init__(self, txid, out, signature=b"", pubkey=b""):
+        self.txid = txid
+        self.out = out
+        self.signature = signature
+        self.pubkey = pubkey
+
+    def serialize(self):
+        return (var_bytes(self.txid) + struct.pack(">i", self.out)
+                + var_bytes(self.signature) + var_bytes(self.pubkey))
+
+
+class TxOutput:
+    def __init__(self, value, pubkey_hash):
+        self.value = value
+        self.pubkey_hash = pubkey_hash
+
+    def serialize(self):
+        return struct.pack(">q", self.value) + var_bytes(self.pubkey_hash)
+
+
+class Transaction:
+    def __init__(self, inputs, outputs):
+        self.inputs = inputs
+        self.outputs = outputs
+
+    def serialize(self):
+        data = struct.pack(">II", TX_VERSION, len(self.inputs))
+        data += b"".join(i.serialize() for i in self.inputs)
+        data += struct.pack(">I", len(self.outputs))
+        data += b"".join(o.serialize() for o in self.outputs)
+        return data
+
+    def txid(self):
+        return hashlib.sha256(self.serialize()).digest()
+
+    def signing_data(self, index, prev_pubkey_hash):
+        """The message signed for input `index`.
+
+        Every input loses its signature and public key, the signed input
+        carries the public key hash of the output it spends instead. Sign it
+        with ECDSA P-256 over SHA-256 and store r and s as 32 bytes each.
+        """
+        inputs = [TxInput(i.txid, i.out) for i in self.inputs]
+        inputs[index].pubkey = prev_pubkey_hash
+        return Transaction(inputs, self.outputs).serialize()
+
+
+if __name__ == "__main__":
+    coinbase = Transaction(
+        [TxInput(b"", -1, pubkey=b"abc")],
+        [TxOutput(20 * BASE_UNITS_PER_COIN, bytes.fromhex("bdde8b26b7a209e75bdb744f5dfd2d5b0f9dad03"))],
+    )
+    print(coinbase.serialize().hex())
+    print(coinbase.txid().hex())
@@ -1,3 +1,5 @@
+mod tx;
+
 use warp::Filter;
 
 #[tokio::main]
@@ -0,0 +1,82 @@
+//! Build, serialize and hash transactions the same way the node does.
+//! The byte layout is documented in core/encoding.go, all integers are big
+//! endian and byte strings are prefixed with their u32 length.
+use sha2::{Digest, Sha256};
+
+pub const TX_VERSION: u32 = 1;
+/// Output values are integers counted in base units, one token is 10^8 units
+pub const BASE_UNITS_PER_COIN: i64 = 100_000_000;
+
+pub struct TxInput {
+    pub txid: Vec<u8>,
+    pub out: i32,
+    pub signature: Vec<u8>,
+    pub pubkey: Vec<u8>,
+}
+
+pub struct TxOutput {
+    pub value: i64,
+    pub pubkey_hash: Vec<u8>,
+}
+
+pub struct Transaction {
+    pub inputs: Vec<TxInput>,
+    pub outputs: Vec<TxOutput>,
+}
+
+fn var_bytes(buf: &mut Vec<u8>, data: &[u8]) {
+    buf.extend_from_slice(&(data.len() as u32).to_be_bytes());
+    buf.extend_from_slice(data);
+}
+
+impl Transaction {
+    pub fn serialize(&self) -> Vec<u8> {
+        let mut buf = Vec::new();
+        buf.extend_from_slice(&TX_VERSION.to_be_bytes());
+        buf.extend_from_slice(&(self.inputs.len() as u32).to_be_bytes());
+        for input in &self.inputs {
+            var_bytes(&mut buf, &input.txid);
+            buf.extend_from_slice(&input.out.to_be_bytes());
+            var_bytes(&mut buf, &input.signature);
+            var_bytes(&mut buf, &input.pubkey);
+        }
+        buf.extend_from_slice(&(self.outputs.len() as u32).to_be_bytes());
+        for output in &self.outputs {
+            buf.extend_from_slice(&output.value.to_be_bytes());
+            var_bytes(&mut buf, &output.pubkey_hash);
+        }
+        buf
+    }
+
+    pub fn txid(&self) -> Vec<u8> {
+        Sha256::digest(&self.serialize()).to_vec()
+    }
+
+    /// The message signed for input `index`: every input loses its signature
+    /// and public key, the signed one carries the public key hash of the
+    /// output it spends instead. Sign it with ECDSA P-256 over SHA-256 and
+    /// store r and s as 32 bytes each.
+    pub fn signing_data(&self, index: usize, prev_pubkey_hash: &[u8]) -> Vec<u8> {
+        let inputs = self
+            .inputs
+            .iter()
+            .enumerate()
+            .map(|(i, input)| TxInput {
+                txid: input.txid.clone(),
+                out: input.out,
+                signature: Vec::new(),
+                pubkey: if i == index { prev_pubkey_hash.to_vec() } else { Vec::new() },
+            })
+            .collect();
+        let outputs = self
+            .outputs
+            .iter()
+            .map(|output| TxOutput {
+                value: output.value,
+                pubkey_hash: output.pubkey_hash.clone(),
+            })
+            .collect();
+
+        Transaction { inputs, outputs }.serialize()
+    }
+}
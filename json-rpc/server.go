@@ -40,7 +40,11 @@ func (conn *HttpConn) Close() error {
 }
 
 func (api *API) CreateWallet(args Args, address *string) error {
-	*address = api.cmd.CreateWallet()
+	created, err := api.cmd.CreateWallet()
+	if err != nil {
+		return err
+	}
+	*address = created
 	return nil
 }
 
@@ -50,17 +54,83 @@ func (api *API) GetBalance(args Args, balance *utils.BalanceResponse) error {
 }
 
 func (api *API) GetBlockchain(args Args, data *Blocks) error {
-	*data = api.cmd.GetBlockchain()
+	blocks, err := api.cmd.GetBlockchain()
+	if err != nil {
+		return err
+	}
+	*data = blocks
 	return nil
 }
 
 func (api *API) GetBlockByHeight(args BlockArgs, data *blockchain.Block) error {
-	*data = api.cmd.GetBlockByHeight(args.Height)
+	block, err := api.cmd.GetBlockByHeight(args.Height)
+	if err != nil {
+		return err
+	}
+	*data = block
+	return nil
+}
+
+func (api *API) GetBlockRange(args BlockRangeArgs, data *Blocks) error {
+	blocks, err := api.cmd.GetBlockRange(args.From, args.To)
+	if err != nil {
+		return err
+	}
+	*data = blocks
+	return nil
+}
+
+func (api *API) GetSupplyInfo(args Args, data *blockchain.SupplyInfo) error {
+	info, err := api.cmd.GetSupplyInfo()
+	if err != nil {
+		return err
+	}
+	*data = info
+	return nil
+}
+
+func (api *API) GetTransaction(args TxArgs, data *utils.TransactionResponse) error {
+	tx, err := api.cmd.GetTransaction(args.TxID)
+	if err != nil {
+		return err
+	}
+	*data = tx
+	return nil
+}
+
+func (api *API) GetAddressHistory(args AddressArgs, data *utils.AddressHistoryResponse) error {
+	history, err := api.cmd.GetAddressHistory(args.Address, args.Skip, args.Limit)
+	if err != nil {
+		return err
+	}
+	*data = history
+	return nil
+}
+
+func (api *API) GetAddressUTXOs(args AddressArgs, data *utils.AddressUTXOsResponse) error {
+	utxos, err := api.cmd.GetAddressUTXOs(args.Address, args.Skip, args.Limit)
+	if err != nil {
+		return err
+	}
+	*data = utxos
 	return nil
 }
 
 func (api *API) Send(args SendArgs, data *utils.SendResponse) error {
-	*data = api.cmd.Send(args.SendFrom, args.SendTo, args.Amount, args.Mine)
+	feeRate := blockchain.Amount(args.FeeRate)
+	if feeRate == 0 {
+		feeRate = blockchain.DefaultFeeRate
+	}
+	*data = api.cmd.Send(args.SendFrom, args.SendTo, args.Amount, feeRate, args.Mine)
+	return nil
+}
+
+func (api *API) SaveMempool(args Args, data *utils.SaveMempoolResponse) error {
+	saved, err := api.cmd.SaveMempool()
+	if err != nil {
+		return err
+	}
+	*data = saved
 	return nil
 }
 
@@ -13,8 +13,10 @@ type Args struct {
 type SendArgs struct {
 	SendFrom string
 	SendTo   string
-	Amount   float64
-	Mine     bool
+	Amount   blockchain.Amount
+	// Fee rate in base units per byte, DefaultFeeRate when zero
+	FeeRate int64
+	Mine    bool
 }
 
 type BlockArgs struct {
@@ -22,6 +24,25 @@ type BlockArgs struct {
 	Height  int
 }
 
+// Heights of the first and last block, both included
+type BlockRangeArgs struct {
+	From int
+	To   int
+}
+
+type TxArgs struct {
+	// Hex encoded transaction id
+	TxID string
+}
+
+// Address and page of its transactions or outputs, a Limit of 0 returns
+// up to 100 entries
+type AddressArgs struct {
+	Address string
+	Skip    int
+	Limit   int
+}
+
 type Blocks []*blockchain.Block
 
 func (bs *Blocks) MarshalJSON() ([]byte, error) {
@@ -2,70 +2,467 @@ package memopool
 
 import (
 	"encoding/hex"
+	"fmt"
 	"sync"
+	"time"
 
 	blockchain "github.com/workspace/the-crypto-project/core"
 )
 
-// Memory pool Data-structure
-
+// Memory pool Data-structure. Pending transactions wait for a miner to ask
+// for them, queued ones have been handed to a miner. The methods are safe
+// for concurrent use.
 type MemoPool struct {
-	Pending map[string]blockchain.Transaction
-	Queued  map[string]blockchain.Transaction
-	Wg      sync.WaitGroup
+	chain  *blockchain.Blockchain
+	policy Policy
+
+	mu      sync.RWMutex
+	pending map[string]*TxDesc
+	queued  map[string]*TxDesc
+	// Transaction of the pool spending an output, by outpointKey
+	spends map[string]*TxDesc
+	// Bytes of the transactions held
+	size int
+	// Minimum fee rate set by the last eviction and when it was set, see
+	// minFeeRate
+	rollingFeeRate blockchain.Amount
+	rollingFeeTime time.Time
+}
+
+// TxDesc is a transaction of the pool and what admitting it found out
+type TxDesc struct {
+	Tx    blockchain.Transaction
+	Fee   blockchain.Amount
+	Size  int
+	Added time.Time
+}
+
+// New returns an empty pool admitting the transactions that can go in the
+// next block of chain
+func New(chain *blockchain.Blockchain, policy Policy) *MemoPool {
+	return &MemoPool{
+		chain:   chain,
+		policy:  policy,
+		pending: map[string]*TxDesc{},
+		queued:  map[string]*TxDesc{},
+		spends:  map[string]*TxDesc{},
+	}
+}
+
+// outpointKey formats a reference to a transaction output as txid:index
+func outpointKey(txID []byte, out int) string {
+	return fmt.Sprintf("%x:%d", txID, out)
+}
+
+func (memo *MemoPool) Move(txID string, to string) {
+	memo.mu.Lock()
+	defer memo.mu.Unlock()
+
+	if desc, ok := memo.pending[txID]; ok && to == "queued" {
+		delete(memo.pending, txID)
+		memo.queued[txID] = desc
+	}
+	if desc, ok := memo.queued[txID]; ok && to == "pending" {
+		delete(memo.queued, txID)
+		memo.pending[txID] = desc
+	}
+}
+
+// Add new transaction. It must spend unspent outputs of the chain or outputs
+// of transactions of the pool, that no other transaction of the pool spends,
+// and stay within the limits of the policy, which bound the chains of
+// unconfirmed transactions as well. With ReplaceByFee, a transaction
+// paying more than the ones it conflicts with replaces them instead, see
+// checkReplacement. A full pool evicts its lowest fee rates to make room,
+// when that evicts tnx itself the pool is left as it was. The RejectError returned tells why a transaction was refused.
+func (memo *MemoPool) Add(tnx blockchain.Transaction) error {
+	memo.mu.Lock()
+	defer memo.mu.Unlock()
+	return memo.add(tnx, time.Now())
+}
+
+// add admits tnx as if it had entered the pool at added, expiry counts from
+// it
+func (memo *MemoPool) add(tnx blockchain.Transaction, added time.Time) error {
+	now := time.Now()
+
+	txID := hex.EncodeToString(tnx.ID)
+	if memo.get(txID) != nil {
+		return reject(RejectDuplicate, "transaction %x is already in the pool", tnx.ID)
+	}
+	size := tnx.Size()
+	if size > memo.policy.MaxTxSize {
+		return reject(RejectTooLarge, "transaction %x has %d bytes, at most %d are accepted",
+			tnx.ID, size, memo.policy.MaxTxSize)
+	}
+
+	// Outputs of the pool are spendable as well
+	parents := make(map[string]blockchain.Transaction)
+	for _, in := range tnx.Inputs {
+		if parent := memo.get(hex.EncodeToString(in.ID)); parent != nil {
+			parents[hex.EncodeToString(in.ID)] = parent.Tx
+		}
+	}
+	fee, err := memo.chain.CheckTransactionInputs(&tnx, parents)
+	if err != nil {
+		return rejectRuleError(err)
+	}
+	var conflicts []*TxDesc
+	for _, in := range tnx.Inputs {
+		spender := memo.spenderOf(in)
+		if spender == nil {
+			continue
+		}
+		if !memo.policy.ReplaceByFee {
+			return reject(RejectConflict, "transaction %x spends output %s, already spent by %x",
+				tnx.ID, outpointKey(in.ID, in.Out), spender.Tx.ID)
+		}
+		conflicts = append(conflicts, spender)
+	}
+
+	minFee, err := blockchain.FeeForSize(memo.minFeeRate(now), size)
+	if err != nil {
+		return err
+	}
+	if fee < minFee {
+		return reject(RejectLowFee, "transaction %x pays %s, the minimum relay fee for %d bytes is %s",
+			tnx.ID, fee, size, minFee)
+	}
+
+	// Block assembly and eviction walk the unconfirmed chains, bound them
+	ancestors := memo.ancestorsOf(&tnx)
+	if len(ancestors)+1 > memo.policy.MaxAncestors {
+		return reject(RejectTooLongChain, "transaction %x has %d unconfirmed ancestors, at most %d are allowed",
+			tnx.ID, len(ancestors), memo.policy.MaxAncestors-1)
+	}
+	for _, ancestor := range ancestors {
+		if n := len(memo.descendants(ancestor)); n+1 > memo.policy.MaxDescendants {
+			return reject(RejectTooLongChain, "transaction %x would be descendant %d of %x, at most %d are allowed",
+				tnx.ID, n, ancestor.Tx.ID, memo.policy.MaxDescendants-1)
+		}
+	}
+
+	desc := &TxDesc{Tx: tnx, Fee: fee, Size: size, Added: added}
+	// Making room may evict transactions before this one, and replacing
+	// removes the ones it conflicts with. If it turns out the full pool
+	// evicts it anyway they all come back.
+	var saved *snapshot
+	if memo.size+size > memo.policy.MaxPoolSize {
+		saved = memo.snapshot()
+	}
+	if len(conflicts) > 0 {
+		replaced, err := memo.checkReplacement(desc, conflicts)
+		if err != nil {
+			return err
+		}
+		for _, old := range replaced {
+			memo.remove(hex.EncodeToString(old.Tx.ID))
+		}
+	}
+
+	memo.pending[txID] = desc
+	memo.size += size
+	for _, in := range tnx.Inputs {
+		memo.spends[outpointKey(in.ID, in.Out)] = desc
+	}
+	memo.trim(now)
+	if memo.get(txID) == nil {
+		if saved != nil {
+			memo.restore(saved)
+		}
+		return reject(RejectPoolFull, "transaction %x pays the lowest fee rate of the full pool", tnx.ID)
+	}
+	return nil
+}
+
+// snapshot is the content of the pool at some point
+type snapshot struct {
+	pending, queued, spends map[string]*TxDesc
+	size                    int
+}
+
+func copyDescs(descs map[string]*TxDesc) map[string]*TxDesc {
+	copied := make(map[string]*TxDesc, len(descs))
+	for key, desc := range descs {
+		copied[key] = desc
+	}
+	return copied
+}
+
+// snapshot saves the transactions of the pool, the fee rate the pool asks
+// for isn't part of it
+func (memo *MemoPool) snapshot() *snapshot {
+	return &snapshot{copyDescs(memo.pending), copyDescs(memo.queued), copyDescs(memo.spends), memo.size}
+}
+
+// restore puts back the transactions of a snapshot
+func (memo *MemoPool) restore(saved *snapshot) {
+	memo.pending, memo.queued, memo.spends, memo.size = saved.pending, saved.queued, saved.spends, saved.size
+}
+
+func (memo *MemoPool) get(txID string) *TxDesc {
+	if desc, ok := memo.pending[txID]; ok {
+		return desc
+	}
+	return memo.queued[txID]
+}
+
+// spenderOf returns the transaction of the pool spending the output in
+// spends, nil if there is none
+func (memo *MemoPool) spenderOf(in blockchain.TxInput) *TxDesc {
+	return memo.spends[outpointKey(in.ID, in.Out)]
+}
+
+// Has reports whether the transaction is pending or queued
+func (memo *MemoPool) Has(txID string) bool {
+	memo.mu.RLock()
+	defer memo.mu.RUnlock()
+	return memo.get(txID) != nil
 }
 
-func (memo *MemoPool) Move(tnx blockchain.Transaction, to string) {
-	if to == "pending" {
-		memo.Remove(hex.EncodeToString(tnx.ID), "queued")
-		memo.Pending[hex.EncodeToString(tnx.ID)] = tnx
+// Get returns a pending or queued transaction
+func (memo *MemoPool) Get(txID string) (blockchain.Transaction, bool) {
+	memo.mu.RLock()
+	defer memo.mu.RUnlock()
+	if desc := memo.get(txID); desc != nil {
+		return desc.Tx, true
 	}
+	return blockchain.Transaction{}, false
+}
 
-	if to == "queued" {
-		memo.Remove(hex.EncodeToString(tnx.ID), "pending")
-		memo.Queued[hex.EncodeToString(tnx.ID)] = tnx
+// remove drops a pending or queued transaction
+func (memo *MemoPool) remove(txID string) {
+	desc := memo.get(txID)
+	if desc == nil {
+		return
+	}
+	memo.size -= desc.Size
+	delete(memo.queued, txID)
+	delete(memo.pending, txID)
+	for _, in := range desc.Tx.Inputs {
+		if memo.spends[outpointKey(in.ID, in.Out)] == desc {
+			delete(memo.spends, outpointKey(in.ID, in.Out))
+		}
 	}
 }
 
-// Add new transaction
-func (memo *MemoPool) Add(tnx blockchain.Transaction) {
-	memo.Pending[hex.EncodeToString(tnx.ID)] = tnx
+// ancestorsOf returns the transactions of the pool tx spends, directly or
+// not, parents before their children
+func (memo *MemoPool) ancestorsOf(tx *blockchain.Transaction) []*TxDesc {
+	var ancestors []*TxDesc
+	seen := make(map[*TxDesc]bool)
+	var visit func(tx *blockchain.Transaction)
+	visit = func(tx *blockchain.Transaction) {
+		for _, in := range tx.Inputs {
+			parent := memo.get(hex.EncodeToString(in.ID))
+			if parent == nil || seen[parent] {
+				continue
+			}
+			seen[parent] = true
+			visit(&parent.Tx)
+			ancestors = append(ancestors, parent)
+		}
+	}
+	visit(tx)
+	return ancestors
+}
+
+// Ancestors returns the transactions of the pool a pooled transaction
+// spends, directly or not, parents before their children. They must be
+// mined before it, or with it.
+func (memo *MemoPool) Ancestors(txID string) []blockchain.Transaction {
+	memo.mu.RLock()
+	defer memo.mu.RUnlock()
+
+	desc := memo.get(txID)
+	if desc == nil {
+		return nil
+	}
+	var txs []blockchain.Transaction
+	for _, ancestor := range memo.ancestorsOf(&desc.Tx) {
+		txs = append(txs, ancestor.Tx)
+	}
+	return txs
+}
+
+// Descendants returns the transactions of the pool spending the outputs of
+// a pooled transaction, directly or not, parents before their children
+func (memo *MemoPool) Descendants(txID string) []blockchain.Transaction {
+	memo.mu.RLock()
+	defer memo.mu.RUnlock()
+
+	desc := memo.get(txID)
+	if desc == nil {
+		return nil
+	}
+	var txs []blockchain.Transaction
+	for _, descendant := range memo.descendants(desc)[1:] {
+		txs = append(txs, descendant.Tx)
+	}
+	return txs
+}
+
+// descendants returns desc and the transactions of the pool spending its
+// outputs, directly or not, parents before their children
+func (memo *MemoPool) descendants(desc *TxDesc) []*TxDesc {
+	found := []*TxDesc{desc}
+	seen := map[*TxDesc]bool{desc: true}
+	for i := 0; i < len(found); i++ {
+		for out := range found[i].Tx.Outputs {
+			spender := memo.spends[outpointKey(found[i].Tx.ID, out)]
+			if spender != nil && !seen[spender] {
+				seen[spender] = true
+				found = append(found, spender)
+			}
+		}
+	}
+	return found
+}
+
+// removeWithDescendants drops desc and its descendants. It returns how many
+// were dropped.
+func (memo *MemoPool) removeWithDescendants(desc *TxDesc) int {
+	if memo.get(hex.EncodeToString(desc.Tx.ID)) != desc {
+		return 0
+	}
+	removed := memo.descendants(desc)
+	for _, d := range removed {
+		memo.remove(hex.EncodeToString(d.Tx.ID))
+	}
+	return len(removed)
 }
 
-//Remove transaction
+// Count returns the number of pending transactions
+func (memo *MemoPool) Count() int {
+	memo.mu.RLock()
+	defer memo.mu.RUnlock()
+	return len(memo.pending)
+}
+
+// Remove transaction
 func (memo *MemoPool) Remove(txID string, from string) {
-	if from == "queued" {
-		delete(memo.Queued, txID)
+	memo.mu.Lock()
+	defer memo.mu.Unlock()
+
+	if _, ok := memo.queued[txID]; ok && from == "queued" {
+		memo.remove(txID)
 		return
 	}
 
-	if from == "pending" {
-		delete(memo.Pending, txID)
+	if _, ok := memo.pending[txID]; ok && from == "pending" {
+		memo.remove(txID)
 		return
 	}
 }
 
-//Get transactions
+// GetTransactions returns the IDs of up to count pending transactions,
+// highest fee rate first
 func (memo *MemoPool) GetTransactions(count int) (txs [][]byte) {
-	i := 0
-	for _, tx := range memo.Pending {
-		txs = append(txs, tx.ID)
-		if i == count {
+	memo.mu.RLock()
+	defer memo.mu.RUnlock()
+
+	for _, desc := range byFeeRate(memo.pending) {
+		if len(txs) == count {
 			break
 		}
-		i++
+		txs = append(txs, desc.Tx.ID)
+	}
+	return txs
+}
+
+// QueuedTransactions returns the transactions handed to a miner, by hex
+// encoded ID
+func (memo *MemoPool) QueuedTransactions() map[string]blockchain.Transaction {
+	memo.mu.RLock()
+	defer memo.mu.RUnlock()
+
+	txs := make(map[string]blockchain.Transaction, len(memo.queued))
+	for txID, desc := range memo.queued {
+		txs[txID] = desc.Tx
 	}
 	return txs
 }
 
-//remove transactions from pending and queued
+// remove transactions from pending and queued
 func (memo *MemoPool) RemoveFromAll(txID string) {
-	delete(memo.Queued, txID)
-	delete(memo.Pending, txID)
+	memo.mu.Lock()
+	defer memo.mu.Unlock()
+
+	memo.remove(txID)
+}
+
+// RemoveBlock drops the transactions a block of the main chain confirmed,
+// and the ones spending the same outputs along with their descendants, they
+// can't be mined anymore
+func (memo *MemoPool) RemoveBlock(block *blockchain.Block) {
+	memo.mu.Lock()
+	defer memo.mu.Unlock()
+
+	for _, tx := range block.Transactions {
+		memo.remove(hex.EncodeToString(tx.ID))
+		if tx.IsMinerTx() {
+			continue
+		}
+		for _, in := range tx.Inputs {
+			if spender := memo.spenderOf(in); spender != nil {
+				memo.removeWithDescendants(spender)
+			}
+		}
+	}
+}
+
+// Revalidate checks every transaction of the pool again against the chain,
+// after a reorganization changed the outputs they spend. The ones that
+// became invalid on the new branch are dropped along with the transactions
+// spending them. It returns how many were dropped.
+func (memo *MemoPool) Revalidate() int {
+	memo.mu.Lock()
+	defer memo.mu.Unlock()
+
+	descs := memo.ordered()
+	queued := memo.queued
+	memo.pending = map[string]*TxDesc{}
+	memo.queued = map[string]*TxDesc{}
+	memo.spends = map[string]*TxDesc{}
+	memo.size = 0
+
+	for _, desc := range descs {
+		// The refused ones are counted below
+		memo.add(desc.Tx, desc.Added)
+	}
+	// Miners still have the queued ones
+	for txID := range queued {
+		if desc, ok := memo.pending[txID]; ok {
+			delete(memo.pending, txID)
+			memo.queued[txID] = desc
+		}
+	}
+	return len(descs) - len(memo.pending) - len(memo.queued)
+}
+
+// ordered returns the transactions of the pool parents before their
+// children, the ones handed to a miner first then by fee rate
+func (memo *MemoPool) ordered() []*TxDesc {
+	var descs []*TxDesc
+	seen := make(map[*TxDesc]bool)
+	for _, desc := range append(byFeeRate(memo.queued), byFeeRate(memo.pending)...) {
+		for _, d := range append(memo.ancestorsOf(&desc.Tx), desc) {
+			if !seen[d] {
+				seen[d] = true
+				descs = append(descs, d)
+			}
+		}
+	}
+	return descs
 }
 
 // Clear transactions.
 func (memo *MemoPool) ClearAll() {
-	memo.Pending = map[string]blockchain.Transaction{}
-	memo.Queued = map[string]blockchain.Transaction{}
+	memo.mu.Lock()
+	defer memo.mu.Unlock()
+
+	memo.pending = map[string]*TxDesc{}
+	memo.queued = map[string]*TxDesc{}
+	memo.spends = map[string]*TxDesc{}
+	memo.size = 0
 }
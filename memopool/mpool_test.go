@@ -0,0 +1,362 @@
+package memopool
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	blockchain "github.com/workspace/the-crypto-project/core"
+	"github.com/workspace/the-crypto-project/params"
+	"github.com/workspace/the-crypto-project/wallet"
+)
+
+func TestMain(m *testing.M) {
+	if err := params.Select(params.RegTest.Name); err != nil {
+		panic(err)
+	}
+	log.SetOutput(ioutil.Discard)
+	os.Exit(m.Run())
+}
+
+var testPolicy = Policy{
+	MaxTxSize:       100000,
+	MinRelayFeeRate: 1,
+	MaxPoolSize:     1 << 20,
+	Expiry:          time.Hour,
+	MaxAncestors:    25,
+	MaxDescendants:  25,
+}
+
+type testWallet struct {
+	*wallet.Wallet
+	address string
+}
+
+func newTestWallet(t *testing.T) testWallet {
+	t.Helper()
+	w, err := wallet.MakeWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testWallet{w, string(w.Address())}
+}
+
+// newTestChain returns an in-memory chain of blocks paying w, the coinbases
+// returned are mature
+func newTestChain(t *testing.T, w testWallet, blocks int) (*blockchain.Blockchain, []*blockchain.Transaction) {
+	t.Helper()
+	chain, err := blockchain.NewMemoryBlockchain(w.address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { chain.Database.Close() })
+	var coinbases []*blockchain.Transaction
+	for i := 0; i < blocks+params.Active.CoinbaseMaturity; i++ {
+		block := addTestBlock(t, chain, chain.LastHash, w)
+		coinbases = append(coinbases, block.Transactions[0])
+	}
+	return chain, coinbases[:blocks]
+}
+
+// addTestBlock mines a block of txs on top of parent and adds it
+func addTestBlock(t *testing.T, chain *blockchain.Blockchain, parent []byte, miner testWallet, txs ...*blockchain.Transaction) *blockchain.Block {
+	t.Helper()
+	prev, err := chain.GetBlock(parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bits, err := chain.CalcNextBits(&prev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	coinbase, err := blockchain.MinerTx(miner.address, "", prev.Height+1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	timestamp, err := chain.NextTimestamp(&prev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := blockchain.CreateBlockAt(append([]*blockchain.Transaction{coinbase}, txs...), parent, prev.Height+1, bits, timestamp)
+	if err := chain.ValidateBlock(block); err != nil {
+		t.Fatal(err)
+	}
+	if err := chain.AddBlock(block); err != nil {
+		t.Fatal(err)
+	}
+	return block
+}
+
+// spendTx signs a transaction from w paying output out of prev, less fee,
+// to address
+func spendTx(t *testing.T, w testWallet, prev *blockchain.Transaction, out int, to string, fee blockchain.Amount) *blockchain.Transaction {
+	t.Helper()
+	o, err := blockchain.NewTXOutput(prev.Outputs[out].Value-fee, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx := &blockchain.Transaction{
+		Inputs:  []blockchain.TxInput{{ID: prev.ID, Out: out, PubKey: w.PublicKey}},
+		Outputs: []blockchain.TxOutput{*o},
+	}
+	prevTxs := map[string]blockchain.Transaction{hex.EncodeToString(prev.ID): *prev}
+	if err := tx.Sign(w.PrivateKey, prevTxs); err != nil {
+		t.Fatal(err)
+	}
+	tx.ID = tx.Hash()
+	return tx
+}
+
+func has(memo *MemoPool, tx *blockchain.Transaction) bool {
+	return memo.Has(hex.EncodeToString(tx.ID))
+}
+
+func TestRevalidateAfterReorg(t *testing.T) {
+	a := newTestWallet(t)
+	chain, coinbases := newTestChain(t, a, 2)
+	fork := chain.LastHash
+
+	// parent is confirmed on the branch that gets reorganized away, child
+	// waits in the pool
+	parent := spendTx(t, a, coinbases[0], 0, a.address, 1000)
+	addTestBlock(t, chain, fork, a, parent)
+	memo := New(chain, testPolicy)
+	child := spendTx(t, a, parent, 0, a.address, 1000)
+	other := spendTx(t, a, coinbases[1], 0, a.address, 1000)
+	for _, tx := range []*blockchain.Transaction{child, other} {
+		if err := memo.Add(*tx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	memo.Move(hex.EncodeToString(other.ID), "queued")
+
+	side := addTestBlock(t, chain, fork, a)
+	addTestBlock(t, chain, side.Hash, a)
+	if dropped := memo.Revalidate(); dropped != 1 {
+		t.Fatalf("dropped %d transactions, want 1", dropped)
+	}
+	if has(memo, child) {
+		t.Fatal("kept a transaction spending an output of the old branch")
+	}
+	if _, ok := memo.QueuedTransactions()[hex.EncodeToString(other.ID)]; !ok {
+		t.Fatal("a queued transaction valid on the new branch left the queue")
+	}
+}
+
+func TestReplacementEvictedByFullPool(t *testing.T) {
+	a := newTestWallet(t)
+	chain, coinbases := newTestChain(t, a, 2)
+
+	original := spendTx(t, a, coinbases[0], 0, a.address, 1000)
+	rich := spendTx(t, a, coinbases[1], 0, a.address, 100000)
+	policy := testPolicy
+	policy.ReplaceByFee = true
+	policy.MaxPoolSize = original.Size() + rich.Size()
+	memo := New(chain, policy)
+	for _, tx := range []*blockchain.Transaction{original, rich} {
+		if err := memo.Add(*tx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The replacement pays more than the original but is larger, the full
+	// pool evicts it as the lowest fee rate
+	replacement := &blockchain.Transaction{Inputs: []blockchain.TxInput{{ID: coinbases[0].ID, Out: 0, PubKey: a.PublicKey}}}
+	value := coinbases[0].Outputs[0].Value - 3000
+	for i := 0; i < 4; i++ {
+		out, err := blockchain.NewTXOutput(value/4, a.address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		replacement.Outputs = append(replacement.Outputs, *out)
+	}
+	prevTxs := map[string]blockchain.Transaction{hex.EncodeToString(coinbases[0].ID): *coinbases[0]}
+	if err := replacement.Sign(a.PrivateKey, prevTxs); err != nil {
+		t.Fatal(err)
+	}
+	replacement.ID = replacement.Hash()
+
+	err := memo.Add(*replacement)
+	if rejectErr, ok := err.(RejectError); !ok || rejectErr.Reason != RejectPoolFull {
+		t.Fatalf("got %v, want the pool to be full", err)
+	}
+	if !has(memo, original) || !has(memo, rich) || has(memo, replacement) {
+		t.Fatal("the pool changed after rejecting the replacement")
+	}
+	// The original still owns its input
+	again := spendTx(t, a, coinbases[0], 0, a.address, 1500)
+	if err := memo.Add(*again); err == nil {
+		t.Fatal("admitted a second spend of the output of the original")
+	}
+}
+
+// wantReject fails unless err is a RejectError for reason
+func wantReject(t *testing.T, err error, reason RejectReason) {
+	t.Helper()
+	rejectErr, ok := err.(RejectError)
+	if !ok || rejectErr.Reason != reason {
+		t.Fatalf("got %v, want %s", err, reason)
+	}
+}
+
+func TestAddRejections(t *testing.T) {
+	a, b := newTestWallet(t), newTestWallet(t)
+	chain, coinbases := newTestChain(t, a, 2)
+	memo := New(chain, testPolicy)
+	pooled := spendTx(t, a, coinbases[0], 0, b.address, 1000)
+	if err := memo.Add(*pooled); err != nil {
+		t.Fatal(err)
+	}
+
+	forged := spendTx(t, a, coinbases[1], 0, b.address, 1000)
+	forged.Inputs[0].Signature[len(forged.Inputs[0].Signature)-1] ^= 0xff
+	forged.ID = forged.Hash()
+	stolen := spendTx(t, b, coinbases[1], 0, b.address, 1000)
+	unknown := spendTx(t, b, spendTx(t, b, coinbases[1], 0, b.address, 1000), 0, a.address, 1000)
+	tooLarge := testPolicy
+	tooLarge.MaxTxSize = pooled.Size() - 1
+
+	for _, test := range []struct {
+		name   string
+		policy Policy
+		tx     *blockchain.Transaction
+		reason RejectReason
+	}{
+		{"duplicate", testPolicy, pooled, RejectDuplicate},
+		{"conflict", testPolicy, spendTx(t, a, coinbases[0], 0, a.address, 2000), RejectConflict},
+		{"missing inputs", testPolicy, unknown, RejectMissingInputs},
+		{"forged signature", testPolicy, forged, RejectInvalidSignature},
+		{"output of another key", testPolicy, stolen, RejectInvalid},
+		{"below the minimum relay fee", testPolicy, spendTx(t, a, coinbases[1], 0, b.address, 0), RejectLowFee},
+		{"too large", tooLarge, spendTx(t, a, coinbases[1], 0, b.address, 1000), RejectTooLarge},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			memo.policy = test.policy
+			wantReject(t, memo.Add(*test.tx), test.reason)
+			if has(memo, test.tx) != (test.tx == pooled) || memo.Count() != 1 {
+				t.Fatal("the pool changed after rejecting the transaction")
+			}
+		})
+	}
+}
+
+// Transactions are added, read and removed from several goroutines, run
+// with -race
+func TestConcurrentAdd(t *testing.T) {
+	a := newTestWallet(t)
+	chain, coinbases := newTestChain(t, a, 8)
+	memo := New(chain, testPolicy)
+
+	errs := make(chan error, len(coinbases))
+	for _, coinbase := range coinbases {
+		tx := spendTx(t, a, coinbase, 0, a.address, 1000)
+		go func() {
+			err := memo.Add(*tx)
+			memo.GetTransactions(len(coinbases))
+			memo.Move(hex.EncodeToString(tx.ID), "queued")
+			memo.Expire()
+			errs <- err
+		}()
+	}
+	for range coinbases {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(memo.QueuedTransactions()); n != len(coinbases) {
+		t.Fatalf("%d transactions queued, want %d", n, len(coinbases))
+	}
+}
+
+func TestEvictLowestFeeRate(t *testing.T) {
+	a, b := newTestWallet(t), newTestWallet(t)
+	chain, coinbases := newTestChain(t, a, 4)
+	low := spendTx(t, a, coinbases[0], 0, a.address, 1000)
+	mid := spendTx(t, a, coinbases[1], 0, a.address, 5000)
+	high := spendTx(t, a, coinbases[2], 0, a.address, 10000)
+	// The child of low pays for it, the pair outranks mid
+	boosted := spendTx(t, a, coinbases[3], 0, a.address, 1000)
+	child := spendTx(t, a, boosted, 0, b.address, 20000)
+
+	policy := testPolicy
+	policy.MaxPoolSize = low.Size() + mid.Size() + high.Size() - 1
+	memo := New(chain, policy)
+	for _, tx := range []*blockchain.Transaction{low, mid, high} {
+		if err := memo.Add(*tx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if has(memo, low) || !has(memo, mid) || !has(memo, high) {
+		t.Fatal("the full pool didn't evict the lowest fee rate")
+	}
+
+	// Evicting low raised the fee rate the pool asks for above it
+	rate := memo.minFeeRate(time.Now())
+	if rate <= policy.MinRelayFeeRate || blockchain.Amount(low.Size())*rate <= 1000 {
+		t.Fatalf("minimum fee rate %d after evicting a fee of 1000 for %d bytes", rate, low.Size())
+	}
+	again := spendTx(t, a, coinbases[0], 0, b.address, 1000)
+	wantReject(t, memo.Add(*again), RejectLowFee)
+
+	// The raise halves every MinFeeHalfLife back to the policy minimum
+	halved := memo.minFeeRate(memo.rollingFeeTime.Add(MinFeeHalfLife))
+	if halved != (rate+1)/2 && halved != policy.MinRelayFeeRate {
+		t.Fatalf("minimum fee rate %d after a half life, it was %d", halved, rate)
+	}
+	if got := memo.minFeeRate(memo.rollingFeeTime.Add(20 * MinFeeHalfLife)); got != policy.MinRelayFeeRate {
+		t.Fatalf("minimum fee rate %d long after the eviction, want %d", got, policy.MinRelayFeeRate)
+	}
+
+	// A package evicts what pays less than it does as a whole
+	memo.rollingFeeRate = 0
+	memo.policy.MaxPoolSize = mid.Size() + high.Size() + boosted.Size() + child.Size() - 1
+	for _, tx := range []*blockchain.Transaction{boosted, child} {
+		if err := memo.Add(*tx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !has(memo, boosted) || !has(memo, child) || !has(memo, high) {
+		t.Fatal("evicted the parent of a child paying for it")
+	}
+	if has(memo, mid) {
+		t.Fatal("kept the lowest fee rate over the package")
+	}
+}
+
+func TestExpire(t *testing.T) {
+	a := newTestWallet(t)
+	chain, coinbases := newTestChain(t, a, 2)
+	memo := New(chain, testPolicy)
+
+	// A transaction added now spending a stale one goes with it
+	stale := spendTx(t, a, coinbases[0], 0, a.address, 1000)
+	child := spendTx(t, a, stale, 0, a.address, 1000)
+	fresh := spendTx(t, a, coinbases[1], 0, a.address, 1000)
+	if err := memo.add(*stale, time.Now().Add(-testPolicy.Expiry-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := memo.add(*fresh, time.Now().Add(-testPolicy.Expiry+time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := memo.Add(*child); err != nil {
+		t.Fatal(err)
+	}
+	memo.Move(hex.EncodeToString(stale.ID), "queued")
+
+	if expired := memo.Expire(); expired != 2 {
+		t.Fatalf("expired %d transactions, want 2", expired)
+	}
+	if has(memo, stale) || has(memo, child) || !has(memo, fresh) {
+		t.Fatal("expired the wrong transactions")
+	}
+	if memo.size != fresh.Size() {
+		t.Fatalf("the pool counts %d bytes, it holds %d", memo.size, fresh.Size())
+	}
+	// The spent output is free again
+	if err := memo.Add(*spendTx(t, a, coinbases[0], 0, a.address, 2000)); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,122 @@
+package memopool
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	blockchain "github.com/workspace/the-crypto-project/core"
+)
+
+// Version of the layout Save writes, Load refuses the other ones. A dump
+// is the version as a big-endian uint32 followed by the gob encoded
+// dumpedTx of the pool, parents before their children.
+const DumpVersion = 1
+
+type dumpedTx struct {
+	// The serialized transaction
+	Tx []byte
+	// When it entered the pool, in Unix nanoseconds
+	Added int64
+}
+
+// Save writes the transactions of the pool to path, replacing the file
+// only once the new one is complete. It returns how many were written.
+func (memo *MemoPool) Save(path string) (int, error) {
+	memo.mu.RLock()
+	var txs []dumpedTx
+	for _, desc := range memo.ordered() {
+		txs = append(txs, dumpedTx{desc.Tx.Serializer(), desc.Added.UnixNano()})
+	}
+	memo.mu.RUnlock()
+
+	var content bytes.Buffer
+	if err := binary.Write(&content, binary.BigEndian, uint32(DumpVersion)); err != nil {
+		return 0, err
+	}
+	if err := gob.NewEncoder(&content).Encode(txs); err != nil {
+		return 0, fmt.Errorf("encoding memory pool: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return 0, err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content.Bytes()); err != nil {
+		tmp.Close()
+		return 0, err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return 0, err
+	}
+	return len(txs), nil
+}
+
+// Load admits the transactions saved to path again, checked against the
+// chain as it is now. The ones that were mined, expired or became invalid
+// meanwhile are dropped. It returns how many were loaded and dropped, a
+// missing file loads nothing.
+func (memo *MemoPool) Load(path string) (loaded, dropped int, err error) {
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	reader := bytes.NewReader(content)
+	var version uint32
+	if err := binary.Read(reader, binary.BigEndian, &version); err != nil {
+		return 0, 0, fmt.Errorf("memory pool dump %s: %w", path, err)
+	}
+	if version != DumpVersion {
+		return 0, 0, fmt.Errorf("memory pool dump %s has version %d, only %d is supported", path, version, DumpVersion)
+	}
+	var txs []dumpedTx
+	if err := gob.NewDecoder(reader).Decode(&txs); err != nil {
+		return 0, 0, fmt.Errorf("memory pool dump %s: %w", path, err)
+	}
+
+	memo.mu.Lock()
+	defer memo.mu.Unlock()
+	cutoff := time.Now().Add(-memo.policy.Expiry)
+	var added []string
+	for _, dumped := range txs {
+		tx, err := blockchain.DeserializeTransaction(dumped.Tx)
+		if err != nil || time.Unix(0, dumped.Added).Before(cutoff) {
+			continue
+		}
+		if err := memo.add(tx, time.Unix(0, dumped.Added)); err != nil {
+			if !IsRejected(err) {
+				return 0, 0, err
+			}
+			continue
+		}
+		added = append(added, hex.EncodeToString(tx.ID))
+	}
+	// A full pool may have evicted some of them again
+	for _, txID := range added {
+		if memo.get(txID) != nil {
+			loaded++
+		}
+	}
+	return loaded, len(txs) - loaded, nil
+}
@@ -0,0 +1,113 @@
+package memopool
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	blockchain "github.com/workspace/the-crypto-project/core"
+)
+
+func TestSaveLoad(t *testing.T) {
+	a, b := newTestWallet(t), newTestWallet(t)
+	chain, coinbases := newTestChain(t, a, 3)
+	memo := New(chain, testPolicy)
+
+	parent := spendTx(t, a, coinbases[0], 0, b.address, 1000)
+	child := spendTx(t, b, parent, 0, a.address, 5000)
+	other := spendTx(t, a, coinbases[1], 0, b.address, 2000)
+	mined := spendTx(t, a, coinbases[2], 0, b.address, 1000)
+	added := time.Now().Add(-time.Minute).Round(0)
+	for _, tx := range []*blockchain.Transaction{parent, child, other, mined} {
+		if err := memo.add(*tx, added); err != nil {
+			t.Fatal(err)
+		}
+	}
+	memo.Move(hex.EncodeToString(other.ID), "queued")
+
+	path := filepath.Join(t.TempDir(), "mempool.dat")
+	if saved, err := memo.Save(path); err != nil || saved != 4 {
+		t.Fatalf("saved %d transactions: %v", saved, err)
+	}
+
+	// A transaction mined while the node was down isn't loaded back
+	addTestBlock(t, chain, chain.LastHash, a, mined)
+	restored := New(chain, testPolicy)
+	loaded, dropped, err := restored.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded != 3 || dropped != 1 {
+		t.Fatalf("loaded %d and dropped %d transactions, want 3 and 1", loaded, dropped)
+	}
+	for _, tx := range []*blockchain.Transaction{parent, child, other} {
+		desc := restored.get(hex.EncodeToString(tx.ID))
+		if desc == nil {
+			t.Fatalf("transaction %x wasn't loaded", tx.ID)
+		}
+		if !desc.Added.Equal(added) {
+			t.Fatalf("transaction %x entered the pool at %v, it was saved at %v", tx.ID, desc.Added, added)
+		}
+	}
+	if has(restored, mined) {
+		t.Fatal("loaded a mined transaction")
+	}
+	// Miners ask for the queued ones again
+	if restored.Count() != 3 {
+		t.Fatalf("%d transactions pending, want 3", restored.Count())
+	}
+}
+
+func TestLoadRefusesBadDumps(t *testing.T) {
+	a, b := newTestWallet(t), newTestWallet(t)
+	chain, coinbases := newTestChain(t, a, 2)
+	memo := New(chain, testPolicy)
+	saved := spendTx(t, a, coinbases[0], 0, b.address, 1000)
+	if err := memo.Add(*saved); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "mempool.dat")
+	if _, err := memo.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newer := append([]byte{}, content...)
+	binary.BigEndian.PutUint32(newer, DumpVersion+1)
+	for _, test := range []struct {
+		name    string
+		content []byte
+	}{
+		{"unknown version", newer},
+		{"truncated", content[:len(content)-10]},
+		{"truncated version", content[:2]},
+		{"empty", nil},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			// The pool already holds a transaction of its own
+			pool := New(chain, testPolicy)
+			pooled := spendTx(t, a, coinbases[1], 0, b.address, 1000)
+			if err := pool.Add(*pooled); err != nil {
+				t.Fatal(err)
+			}
+
+			bad := filepath.Join(dir, test.name+".dat")
+			if err := ioutil.WriteFile(bad, test.content, 0600); err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err := pool.Load(bad); err == nil {
+				t.Fatal("the dump was loaded")
+			}
+			if pool.Count() != 1 || !has(pool, pooled) || has(pool, saved) {
+				t.Fatal("refusing the dump changed the pool")
+			}
+		})
+	}
+}
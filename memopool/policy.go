@@ -0,0 +1,144 @@
+package memopool
+
+import (
+	"encoding/hex"
+	"math"
+	"sort"
+	"time"
+
+	blockchain "github.com/workspace/the-crypto-project/core"
+)
+
+// Evictions raise the minimum fee rate of the pool, the raise halves every
+// MinFeeHalfLife until it is back to the policy minimum
+const MinFeeHalfLife = 12 * time.Hour
+
+// Policy holds the limits of the transactions the pool accepts, on top of
+// the consensus rules
+type Policy struct {
+	// Largest transaction, in bytes
+	MaxTxSize int
+	// Lowest fee, in base units per byte
+	MinRelayFeeRate blockchain.Amount
+	// Bytes of transactions the pool holds before evicting the lowest fee
+	// rates
+	MaxPoolSize int
+	// How long a transaction may wait in the pool
+	Expiry time.Duration
+	// Let a transaction paying more replace the ones it conflicts with,
+	// instead of refusing it
+	ReplaceByFee bool
+	// Most unconfirmed ancestors of a transaction, and descendants of a
+	// transaction, both counting the transaction itself
+	MaxAncestors   int
+	MaxDescendants int
+}
+
+// minFeeRate returns the fee rate a transaction must pay to enter the pool
+// at now, the policy minimum or the rate raised by the last evictions
+func (memo *MemoPool) minFeeRate(now time.Time) blockchain.Amount {
+	if memo.rollingFeeRate == 0 {
+		return memo.policy.MinRelayFeeRate
+	}
+	halvings := float64(now.Sub(memo.rollingFeeTime)) / float64(MinFeeHalfLife)
+	rate := blockchain.Amount(math.Ceil(float64(memo.rollingFeeRate) * math.Pow(0.5, halvings)))
+	if rate <= memo.policy.MinRelayFeeRate {
+		memo.rollingFeeRate = 0
+		return memo.policy.MinRelayFeeRate
+	}
+	return rate
+}
+
+// raiseMinFeeRate makes the transactions entering the pool pay more than
+// the evicted fee for size did, so a full pool doesn't churn between equal
+// fees
+func (memo *MemoPool) raiseMinFeeRate(fee blockchain.Amount, size int, now time.Time) {
+	// Rounded up, the evicted rate itself must not be enough
+	rate := (fee+blockchain.Amount(size)-1)/blockchain.Amount(size) + memo.policy.MinRelayFeeRate
+	if rate > memo.minFeeRate(now) {
+		memo.rollingFeeRate = rate
+		memo.rollingFeeTime = now
+	}
+}
+
+// trim evicts the transactions of lowest fee rate, and the ones spending
+// them, until the pool fits in MaxPoolSize. A transaction is rated with its
+// descendants when they pay a higher rate, a child keeps its parent in the
+// pool the way it gets it mined.
+func (memo *MemoPool) trim(now time.Time) {
+	for memo.size > memo.policy.MaxPoolSize {
+		var lowest *TxDesc
+		var lowestFee blockchain.Amount
+		var lowestSize int
+		for _, txs := range []map[string]*TxDesc{memo.pending, memo.queued} {
+			for _, desc := range txs {
+				fee, size := memo.evictionRate(desc)
+				if lowest == nil || blockchain.HigherFeeRate(lowestFee, lowestSize, fee, size) {
+					lowest, lowestFee, lowestSize = desc, fee, size
+				}
+			}
+		}
+		memo.removeWithDescendants(lowest)
+		memo.raiseMinFeeRate(lowestFee, lowestSize, now)
+	}
+}
+
+// evictionRate returns the fee and size desc is rated by for eviction, its
+// own or those of its package of descendants, whichever rate is higher
+func (memo *MemoPool) evictionRate(desc *TxDesc) (blockchain.Amount, int) {
+	var fee blockchain.Amount
+	size := 0
+	for _, d := range memo.descendants(desc) {
+		fee += d.Fee
+		size += d.Size
+	}
+	if blockchain.HigherFeeRate(fee, size, desc.Fee, desc.Size) {
+		return fee, size
+	}
+	return desc.Fee, desc.Size
+}
+
+// Expire drops the transactions that waited longer than the policy allows,
+// and the ones spending them. It returns how many were dropped.
+func (memo *MemoPool) Expire() int {
+	memo.mu.Lock()
+	defer memo.mu.Unlock()
+
+	cutoff := time.Now().Add(-memo.policy.Expiry)
+	var expired []*TxDesc
+	for _, txs := range []map[string]*TxDesc{memo.pending, memo.queued} {
+		for _, desc := range txs {
+			if desc.Added.Before(cutoff) {
+				expired = append(expired, desc)
+			}
+		}
+	}
+	removed := 0
+	for _, desc := range expired {
+		removed += memo.removeWithDescendants(desc)
+	}
+	return removed
+}
+
+// byFeeRate returns the transactions of txs, highest fee rate first and the
+// oldest first among equal rates
+func byFeeRate(txs map[string]*TxDesc) []*TxDesc {
+	descs := make([]*TxDesc, 0, len(txs))
+	for _, desc := range txs {
+		descs = append(descs, desc)
+	}
+	sort.Slice(descs, func(i, j int) bool {
+		a, b := descs[i], descs[j]
+		if blockchain.HigherFeeRate(a.Fee, a.Size, b.Fee, b.Size) {
+			return true
+		}
+		if blockchain.HigherFeeRate(b.Fee, b.Size, a.Fee, a.Size) {
+			return false
+		}
+		if !a.Added.Equal(b.Added) {
+			return a.Added.Before(b.Added)
+		}
+		return hex.EncodeToString(a.Tx.ID) < hex.EncodeToString(b.Tx.ID)
+	})
+	return descs
+}
@@ -0,0 +1,95 @@
+package memopool
+
+import (
+	"errors"
+	"fmt"
+
+	blockchain "github.com/workspace/the-crypto-project/core"
+)
+
+// RejectReason tells why the pool refused a transaction
+type RejectReason int
+
+const (
+	// The transaction is already in the pool
+	RejectDuplicate RejectReason = iota + 1
+	// Malformed, or breaks a consensus rule
+	RejectInvalid
+	// Spends an output that is neither unspent nor created by the pool
+	RejectMissingInputs
+	RejectInvalidSignature
+	// Spends an output another transaction of the pool spends
+	RejectConflict
+	RejectTooLarge
+	// Pays less than the minimum relay fee
+	RejectLowFee
+	// The pool is full of transactions paying a higher fee rate
+	RejectPoolFull
+	// Conflicts with transactions it doesn't pay enough to replace
+	RejectReplacement
+	// Has too many unconfirmed ancestors, or one of them too many
+	// descendants
+	RejectTooLongChain
+)
+
+var rejectReasonStrings = map[RejectReason]string{
+	RejectDuplicate:        "RejectDuplicate",
+	RejectInvalid:          "RejectInvalid",
+	RejectMissingInputs:    "RejectMissingInputs",
+	RejectInvalidSignature: "RejectInvalidSignature",
+	RejectConflict:         "RejectConflict",
+	RejectTooLarge:         "RejectTooLarge",
+	RejectLowFee:           "RejectLowFee",
+	RejectPoolFull:         "RejectPoolFull",
+	RejectReplacement:      "RejectReplacement",
+	RejectTooLongChain:     "RejectTooLongChain",
+}
+
+func (reason RejectReason) String() string {
+	if s, ok := rejectReasonStrings[reason]; ok {
+		return s
+	}
+	return fmt.Sprintf("Unknown RejectReason (%d)", int(reason))
+}
+
+// RejectError is returned when the pool refuses a transaction, Err carries
+// the details and is a blockchain.RuleError when a consensus rule is broken
+type RejectError struct {
+	Reason RejectReason
+	Err    error
+}
+
+func (e RejectError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Reason, e.Err)
+}
+
+func (e RejectError) Unwrap() error {
+	return e.Err
+}
+
+func reject(reason RejectReason, format string, args ...interface{}) RejectError {
+	return RejectError{reason, fmt.Errorf(format, args...)}
+}
+
+// rejectRuleError turns the rule errors of the chain into rejections, other
+// errors are failures of the node and are returned as they are
+func rejectRuleError(err error) error {
+	var ruleErr blockchain.RuleError
+	if !errors.As(err, &ruleErr) {
+		return err
+	}
+	switch ruleErr.Code {
+	case blockchain.RejectMissingInputs:
+		return RejectError{RejectMissingInputs, err}
+	case blockchain.RejectInvalidSignature:
+		return RejectError{RejectInvalidSignature, err}
+	}
+	return RejectError{RejectInvalid, err}
+}
+
+// IsRejected reports whether err is the pool refusing a transaction rather
+// than failing
+func IsRejected(err error) bool {
+	var rejectErr RejectError
+	return errors.As(err, &rejectErr)
+}
@@ -0,0 +1,64 @@
+package memopool
+
+import (
+	"encoding/hex"
+
+	blockchain "github.com/workspace/the-crypto-project/core"
+)
+
+// Most transactions a replacement may evict, conflicts and their
+// descendants together
+const MaxReplacements = 100
+
+// checkReplacement returns the transactions desc replaces, the ones it
+// conflicts with and their descendants. The replacement must pay a higher
+// fee rate than each transaction it conflicts with, and more fees than all
+// the evicted transactions together plus the minimum relay fee of its own
+// size, so replacing can't be used to relay for free. It can't spend the
+// outputs of a transaction it evicts.
+func (memo *MemoPool) checkReplacement(desc *TxDesc, conflicts []*TxDesc) ([]*TxDesc, error) {
+	tx := desc.Tx
+	var replaced []*TxDesc
+	evicted := make(map[string]bool)
+	var evictedFees blockchain.Amount
+	for _, conflict := range conflicts {
+		if !blockchain.HigherFeeRate(desc.Fee, desc.Size, conflict.Fee, conflict.Size) {
+			return nil, reject(RejectReplacement, "transaction %x pays %s for %d bytes, not a higher fee rate than %s for %d bytes of %x",
+				tx.ID, desc.Fee, desc.Size, conflict.Fee, conflict.Size, conflict.Tx.ID)
+		}
+		for _, d := range memo.descendants(conflict) {
+			txID := hex.EncodeToString(d.Tx.ID)
+			if evicted[txID] {
+				continue
+			}
+			evicted[txID] = true
+			replaced = append(replaced, d)
+			evictedFees += d.Fee
+		}
+	}
+	if len(replaced) > MaxReplacements {
+		return nil, reject(RejectReplacement, "transaction %x would evict %d transactions, at most %d are allowed",
+			tx.ID, len(replaced), MaxReplacements)
+	}
+
+	for _, in := range tx.Inputs {
+		if evicted[hex.EncodeToString(in.ID)] {
+			return nil, reject(RejectReplacement, "transaction %x spends output %s of a transaction it replaces",
+				tx.ID, outpointKey(in.ID, in.Out))
+		}
+	}
+
+	relayFee, err := blockchain.FeeForSize(memo.policy.MinRelayFeeRate, desc.Size)
+	if err != nil {
+		return nil, err
+	}
+	minFee, err := evictedFees.Add(relayFee)
+	if err != nil {
+		return nil, err
+	}
+	if desc.Fee < minFee {
+		return nil, reject(RejectReplacement, "transaction %x pays %s, replacing %d transactions takes at least %s",
+			tx.ID, desc.Fee, len(replaced), minFee)
+	}
+	return replaced, nil
+}
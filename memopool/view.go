@@ -0,0 +1,63 @@
+package memopool
+
+import (
+	"encoding/hex"
+
+	blockchain "github.com/workspace/the-crypto-project/core"
+)
+
+// poolView is a snapshot of the pool for a wallet, it doesn't change with
+// the pool
+type poolView struct {
+	spent     map[string]bool
+	txs       map[string]blockchain.Transaction
+	spendable []blockchain.Transaction
+}
+
+// View returns what a wallet sees of the pool to build a new transaction.
+// The outputs of a pooled transaction are spendable while the new one has
+// at most maxDepth unconfirmed ancestors and stays within the ancestor limit
+// of the pool, a maxDepth of 0 only spends confirmed outputs.
+func (memo *MemoPool) View(maxDepth int) blockchain.UnconfirmedView {
+	memo.mu.RLock()
+	defer memo.mu.RUnlock()
+
+	if limit := memo.policy.MaxAncestors - 1; maxDepth > limit {
+		maxDepth = limit
+	}
+	view := &poolView{
+		spent: make(map[string]bool, len(memo.spends)),
+		txs:   make(map[string]blockchain.Transaction),
+	}
+	for outpoint := range memo.spends {
+		view.spent[outpoint] = true
+	}
+	for _, txs := range []map[string]*TxDesc{memo.pending, memo.queued} {
+		for txID, desc := range txs {
+			view.txs[txID] = desc.Tx
+		}
+	}
+	// The likeliest to be mined soon first, the ones handed to a miner then
+	// the highest fee rates
+	descs := byFeeRate(memo.queued)
+	descs = append(descs, byFeeRate(memo.pending)...)
+	for _, desc := range descs {
+		if len(memo.ancestorsOf(&desc.Tx))+1 <= maxDepth {
+			view.spendable = append(view.spendable, desc.Tx)
+		}
+	}
+	return view
+}
+
+func (view *poolView) IsSpent(txID []byte, out int) bool {
+	return view.spent[outpointKey(txID, out)]
+}
+
+func (view *poolView) Spendable() []blockchain.Transaction {
+	return view.spendable
+}
+
+func (view *poolView) Transaction(txID []byte) (blockchain.Transaction, bool) {
+	tx, ok := view.txs[hex.EncodeToString(txID)]
+	return tx, ok
+}
@@ -1,12 +1,14 @@
 package p2p
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 
 	"github.com/libp2p/go-libp2p-core/peer"
 
 	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/workspace/the-crypto-project/params"
 )
 
 const ChannelBufSize = 128
@@ -78,7 +80,9 @@ func (channel *Channel) Publish(message string, payload []byte, SendTo string) e
 	if err != nil {
 		return err
 	}
-	return channel.topic.Publish(channel.ctx, msgBytes)
+	// Prefix the message with the magic bytes of our network
+	magic := params.Active.Magic
+	return channel.topic.Publish(channel.ctx, append(magic[:], msgBytes...))
 }
 
 func (channel *Channel) readLoop() {
@@ -96,8 +100,14 @@ func (channel *Channel) readLoop() {
 			continue
 		}
 
+		// drop messages of other networks
+		magic := params.Active.Magic
+		if !bytes.HasPrefix(content.Data, magic[:]) {
+			continue
+		}
+
 		NewContent := new(ChannelContent)
-		err = json.Unmarshal(content.Data, NewContent)
+		err = json.Unmarshal(content.Data[len(magic):], NewContent)
 		if err != nil {
 			continue
 		}
@@ -111,6 +121,7 @@ func (channel *Channel) readLoop() {
 	}
 }
 
+// Every network has its own topics
 func topicName(channelName string) string {
-	return "channel:" + channelName
+	return params.Active.Name + ":channel:" + channelName
 }
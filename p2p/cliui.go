@@ -7,9 +7,6 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
-	"path"
-	"path/filepath"
-	"runtime"
 	"strings"
 	"time"
 
@@ -19,6 +16,7 @@ import (
 
 	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/rivo/tview"
+	"github.com/workspace/the-crypto-project/util/datadir"
 )
 
 // CLIUI is a Text User Interface (TUI) for Peers
@@ -40,13 +38,6 @@ type Log struct {
 	Time  string `json:"time"`
 }
 
-var (
-	_, b, _, _ = runtime.Caller(0)
-
-	// Root folder of this project
-	Root = filepath.Join(filepath.Dir(b), "../")
-)
-
 func NewCLIUI(generalChannel *Channel, miningChannel *Channel, fullNodesChannel *Channel) *CLIUI {
 	app := tview.NewApplication()
 
@@ -171,7 +162,7 @@ func (ui *CLIUI) displayContent(content *ChannelContent) {
 
 func (ui *CLIUI) HandleStream(net *Network, content *ChannelContent) {
 	// ui.displayContent(content)
-	if content.Payload != nil {
+	if len(content.Payload) >= commandLength {
 		command := BytesToCmd(content.Payload[:commandLength])
 		log.Infof("Received  %s command \n", command)
 
@@ -197,12 +188,7 @@ func (ui *CLIUI) HandleStream(net *Network, content *ChannelContent) {
 }
 
 func (ui *CLIUI) readFromLogs(instanceId string) {
-	filename := "/logs/console.log"
-	if instanceId != "" {
-		filename = fmt.Sprintf("/logs/console_%s.log", instanceId)
-	}
-
-	logFile := path.Join(Root, filename)
+	logFile := datadir.LogFile(instanceId)
 	e := ioutil.WriteFile(logFile, []byte(""), 0644)
 	if e != nil {
 		panic(e)
@@ -0,0 +1,44 @@
+package p2p
+
+import (
+	log "github.com/sirupsen/logrus"
+	"github.com/workspace/the-crypto-project/config"
+	"github.com/workspace/the-crypto-project/util/datadir"
+)
+
+// persistMempool reports whether the pool outlives the node, a chain kept
+// in memory doesn't so its pool isn't either
+func persistMempool() bool {
+	return config.Active.Mempool.Persist && !config.Active.Storage.InMemory
+}
+
+// loadMempool admits the transactions the instance saved when it last ran
+func loadMempool(instanceId string) {
+	path := datadir.MempoolFile(instanceId)
+	loaded, dropped, err := memoryPool.Load(path)
+	if err != nil {
+		log.Errorf("Loading the memory pool from %s: %v", path, err)
+		return
+	}
+	if loaded+dropped > 0 {
+		log.Infof("Loaded %d transactions into the memory pool from %s, dropped %d no longer valid", loaded, path, dropped)
+	}
+}
+
+// SaveMempool writes the pool of the node to the data directory, it is
+// loaded back on the next start. It returns the file and how many
+// transactions were written.
+func (net *Network) SaveMempool() (string, int, error) {
+	path := datadir.MempoolFile(net.Blockchain.InstanceId)
+	saved, err := net.Mempool.Save(path)
+	return path, saved, err
+}
+
+func saveMempool(net *Network) {
+	path, saved, err := net.SaveMempool()
+	if err != nil {
+		log.Errorf("Saving the memory pool to %s: %v", path, err)
+		return
+	}
+	log.Debugf("Saved %d transactions of the memory pool to %s", saved, path)
+}
@@ -3,17 +3,14 @@ package p2p
 import (
 	"bytes"
 	"context"
-	"crypto/rand"
 	"encoding/gob"
 	"encoding/hex"
+	"errors"
 	"fmt"
-	"io"
-	"strconv"
 	"sync"
 	"time"
 
 	"github.com/libp2p/go-libp2p"
-	"github.com/libp2p/go-libp2p-core/crypto"
 	"github.com/libp2p/go-libp2p-core/peer"
 	discovery "github.com/libp2p/go-libp2p-discovery"
 	dht "github.com/libp2p/go-libp2p-kad-dht"
@@ -25,8 +22,10 @@ import (
 
 	"github.com/libp2p/go-libp2p-core/host"
 	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/workspace/the-crypto-project/config"
 	blockchain "github.com/workspace/the-crypto-project/core"
 	"github.com/workspace/the-crypto-project/memopool"
+	"github.com/workspace/the-crypto-project/params"
 	appUtils "github.com/workspace/the-crypto-project/util/utils"
 )
 
@@ -41,11 +40,8 @@ var (
 	FullNodesChannel = "fullnodes-channel"
 	MinerAddress     = ""
 	blocksInTransit  = [][]byte{}
-	memoryPool       = memopool.MemoPool{
-		map[string]blockchain.Transaction{},
-		map[string]blockchain.Transaction{},
-		sync.WaitGroup{},
-	}
+	// Set up by StartNode once the chain is open
+	memoryPool *memopool.MemoPool
 )
 
 func (net *Network) SendBlock(peerId string, b *blockchain.Block) {
@@ -68,43 +64,44 @@ func (net *Network) HandleBlocks(content *ChannelContent) {
 	err := dec.Decode(&payload)
 
 	if err != nil {
-		log.Panic(err)
+		log.Errorf("Dropped malformed %s message: %s", BytesToCmd(content.Payload[:commandLength]), err)
+		return
 	}
 
 	blockData := payload.Block
-	block := blockchain.DeSerialize(blockData)
+	block, err := blockchain.DeSerialize(blockData)
+	if err != nil {
+		log.Warnf("Rejected block from %s: %s", payload.SendFrom, err)
+		return
+	}
 
-	// fmt.Printf("Valid: %s\n", strconv.FormatBool(validate))
 	// Verify block before adding it to the blockchain
-
 	if block.IsGenesis() {
-		net.Blockchain.AddBlock(block)
+		err = net.Blockchain.ValidateGenesis(block)
 	} else {
-		lastBlock, err := net.Blockchain.GetBlock(net.Blockchain.LastHash)
-		if err != nil {
-			log.Info(err)
-		}
-		log.Info(block.Height)
-		valid := block.IsBlockValid(lastBlock)
-		log.Info("Block validity:", strconv.FormatBool(valid))
-		if valid {
-			net.Blockchain.AddBlock(block)
-
-			//Remove transactions from the memory Pool...
-			for _, tx := range block.Transactions {
-				txID := hex.EncodeToString(tx.ID)
-				memoryPool.RemoveFromAll(txID)
-			}
-		} else {
-			appUtils.CloseDB(net.Blockchain)
-			log.Fatalf("We discovered an invalid block of height: %d", block.Height)
+		err = net.Blockchain.ValidateBlock(block)
+	}
+	if err != nil {
+		log.Warnf("Rejected block %x of height %d from %s: %s", block.Hash, block.Height, payload.SendFrom, err)
+		// Whatever else this peer queued up builds on the rejected block
+		blocksInTransit = [][]byte{}
+
+		// We are missing part of the peer's branch, ask for all of it,
+		// the blocks we already have are skipped when the inventory comes in
+		if ruleErr, ok := err.(blockchain.RuleError); ok && ruleErr.Code == blockchain.RejectOrphan {
+			net.SendGetBlocks(payload.SendFrom, 0)
 		}
+		return
+	}
+	if err := net.Blockchain.AddBlock(block); err != nil {
+		log.Errorf("Failed to add block %x: %s", block.Hash, err)
+		return
 	}
 
-	if len(block.Transactions) > 0 {
-		for _, tx := range block.Transactions {
-			memoryPool.RemoveFromAll(hex.EncodeToString(tx.ID))
-		}
+	// Transactions of a side chain block are still pending on the main chain,
+	// reorganizations update the memory pool through HandleReorg
+	if bytes.Equal(net.Blockchain.LastHash, block.Hash) {
+		memoryPool.RemoveBlock(block)
 	}
 
 	log.Infof("Added block %x \n", block.Hash)
@@ -115,11 +112,37 @@ func (net *Network) HandleBlocks(content *ChannelContent) {
 
 		net.SendGetData(payload.SendFrom, "block", blockHash)
 		blocksInTransit = blocksInTransit[1:]
-	} else {
-		UTXO := blockchain.UXTOSet{net.Blockchain}
-		UTXO.Compute()
 	}
 }
+
+// HandleReorg drops the transactions the new branch confirmed or conflicts
+// with from the memory pool, and puts back the ones of the blocks that left
+// the main chain and are still valid on it. The rest of the pool is checked
+// against the new tip, transactions spending outputs only the old branch
+// created are gone with it.
+func (net *Network) HandleReorg(event *blockchain.ReorgEvent) {
+	log.Warnf("Switched tip from %x to %x", event.OldTip, event.NewTip)
+
+	for _, block := range event.Connected {
+		memoryPool.RemoveBlock(block)
+	}
+	// Oldest block first, so parents go in before the transactions
+	// spending them
+	for i := len(event.Disconnected) - 1; i >= 0; i-- {
+		for _, tx := range event.Disconnected[i].Transactions {
+			if tx.IsMinerTx() {
+				continue
+			}
+			if err := memoryPool.Add(*tx); err != nil {
+				log.Debugf("Dropped transaction %x of a disconnected block: %s", tx.ID, err)
+			}
+		}
+	}
+	if dropped := memoryPool.Revalidate(); dropped > 0 {
+		log.Infof("Dropped %d transactions of the memory pool invalid on the new branch", dropped)
+	}
+}
+
 func (net *Network) SendGetData(peerId string, _type string, id []byte) {
 	payload := GobEncode(GetData{net.Host.ID().Pretty(), _type, id})
 	request := append(CmdToBytes("getdata"), payload...)
@@ -135,7 +158,8 @@ func (net *Network) HandleGetData(content *ChannelContent) {
 	err := dec.Decode(&payload)
 
 	if err != nil {
-		log.Panic(err)
+		log.Errorf("Dropped malformed %s message: %s", BytesToCmd(content.Payload[:commandLength]), err)
+		return
 	}
 
 	if payload.Type == "block" {
@@ -149,9 +173,12 @@ func (net *Network) HandleGetData(content *ChannelContent) {
 
 	if payload.Type == "tx" {
 		txID := hex.EncodeToString(payload.ID)
-		tx := memoryPool.Pending[txID]
+		tx, ok := memoryPool.Get(txID)
+		if !ok {
+			return
+		}
 		if net.BelongsToMiningGroup(payload.SendFrom) {
-			memoryPool.Move(tx, "queued")
+			memoryPool.Move(txID, "queued")
 			net.SendTxFromPool(payload.SendFrom, &tx)
 		} else {
 			net.SendTx(payload.SendFrom, &tx)
@@ -176,11 +203,20 @@ func (net *Network) HandleInv(content *ChannelContent) {
 	err := dec.Decode(&payload)
 
 	if err != nil {
-		log.Panic(err)
+		log.Errorf("Dropped malformed %s message: %s", BytesToCmd(content.Payload[:commandLength]), err)
+		return
 	}
 	log.Infof("Recieved inventory with %d %s \n", len(payload.Items), payload.Type)
 
 	if payload.Type == "block" {
+		var missing [][]byte
+		for _, blockHash := range payload.Items {
+			if _, err := net.Blockchain.GetBlock(blockHash); err != nil {
+				missing = append(missing, blockHash)
+			}
+		}
+		payload.Items = missing
+
 		if len(payload.Items) >= 1 {
 			blocksInTransit = payload.Items
 
@@ -200,11 +236,8 @@ func (net *Network) HandleInv(content *ChannelContent) {
 	}
 
 	if payload.Type == "tx" {
-		if len(payload.Items) == 0 {
-			memoryPool.Wg.Done()
-		}
 		for _, txID := range payload.Items {
-			if memoryPool.Pending[hex.EncodeToString(txID)].ID == nil {
+			if !memoryPool.Has(hex.EncodeToString(txID)) {
 				net.SendGetData(payload.SendFrom, "tx", txID)
 			}
 		}
@@ -226,17 +259,25 @@ func (net *Network) HandleGetBlocks(content *ChannelContent) {
 	err := dec.Decode(&payload)
 
 	if err != nil {
-		log.Panic(err)
+		log.Errorf("Dropped malformed %s message: %s", BytesToCmd(content.Payload[:commandLength]), err)
+		return
 	}
 
-	chain := net.Blockchain.ContinueBlockchain()
-	blockHashes := chain.GetBlockHashes(payload.Height)
+	blockHashes, err := net.Blockchain.GetBlockHashes(payload.Height)
+	if err != nil {
+		log.Errorf("Failed to list blocks above height %d: %s", payload.Height, err)
+		return
+	}
 	log.Info("LENGTH:", len(blockHashes))
 	net.SendInv(payload.SendFrom, "block", blockHashes)
 }
 
 func (net *Network) SendVersion(peer string) {
-	bestHeight := net.Blockchain.GetBestHeight()
+	bestHeight, err := net.Blockchain.GetBestHeight()
+	if err != nil {
+		log.Errorf("Failed to read the best height: %s", err)
+		return
+	}
 	payload := GobEncode(Version{
 		version,
 		bestHeight,
@@ -255,10 +296,15 @@ func (net *Network) HandleVersion(content *ChannelContent) {
 	err := dec.Decode(&payload)
 
 	if err != nil {
-		log.Panic(err)
+		log.Errorf("Dropped malformed %s message: %s", BytesToCmd(content.Payload[:commandLength]), err)
+		return
 	}
 
-	bestHeight := net.Blockchain.GetBestHeight()
+	bestHeight, err := net.Blockchain.GetBestHeight()
+	if err != nil {
+		log.Errorf("Failed to read the best height: %s", err)
+		return
+	}
 	otherHeight := payload.BestHeight
 	log.Info("BEST HEIGHT: ", bestHeight, " OTHER HEIGHT:", otherHeight)
 	if bestHeight < otherHeight {
@@ -269,8 +315,6 @@ func (net *Network) HandleVersion(content *ChannelContent) {
 }
 
 func (net *Network) SendTx(peerId string, transaction *blockchain.Transaction) {
-	memoryPool.Add(*transaction)
-
 	tnx := Tx{net.Host.ID().Pretty(), transaction.Serializer()}
 	payload := GobEncode(tnx)
 	request := append(CmdToBytes("tx"), payload...)
@@ -303,10 +347,11 @@ func (net *Network) HandleGetTxFromPool(content *ChannelContent) {
 	err := dec.Decode(&payload)
 
 	if err != nil {
-		log.Panic(err)
+		log.Errorf("Dropped malformed %s message: %s", BytesToCmd(content.Payload[:commandLength]), err)
+		return
 	}
 
-	if len(memoryPool.Pending) >= payload.Count {
+	if memoryPool.Count() >= payload.Count {
 		txs := memoryPool.GetTransactions(payload.Count)
 		net.SendTxPoolInv(payload.SendFrom, "tx", txs)
 	} else {
@@ -322,56 +367,85 @@ func (net *Network) HandleTx(content *ChannelContent) {
 	err := dec.Decode(&payload)
 
 	if err != nil {
-		log.Panic(err)
+		log.Errorf("Dropped malformed %s message: %s", BytesToCmd(content.Payload[:commandLength]), err)
+		return
 	}
 
 	txData := payload.Transaction
-	tx := blockchain.DeserializeTransaction(txData)
-
-	log.Infof("%s, %d", payload.SendFrom, len(memoryPool.Pending))
-	chain := net.Blockchain.ContinueBlockchain()
-
-	if chain.VerifyTransaction(&tx) {
-		memoryPool.Add(tx)
-		if net.Miner {
-			//Move transaction to queued
-			memoryPool.Move(tx, "queued")
-			log.Info("MINING")
-			//Mine transaction instantly
-			net.MineTx(memoryPool.Queued)
-		}
+	tx, err := blockchain.DeserializeTransaction(txData)
+	if err != nil {
+		log.Warnf("Rejected transaction from %s: %s", payload.SendFrom, err)
+		return
+	}
+
+	log.Infof("%s, %d", payload.SendFrom, memoryPool.Count())
+
+	if err := memoryPool.Add(tx); err != nil {
+		logRejection(tx.ID, payload.SendFrom, err)
+		return
+	}
+	if net.Miner {
+		//Move transaction to queued
+		memoryPool.Move(hex.EncodeToString(tx.ID), "queued")
+		log.Info("MINING")
+		//Mine transaction instantly
+		net.MineTx(memoryPool.QueuedTransactions())
+	}
+}
+
+// logRejection logs why the memory pool refused a transaction, peers
+// announcing one we already have is routine
+func logRejection(txID []byte, from string, err error) {
+	var rejectErr memopool.RejectError
+	switch {
+	case errors.As(err, &rejectErr) && rejectErr.Reason == memopool.RejectDuplicate:
+		log.Debugf("Ignored transaction %x from %s: %s", txID, from, err)
+	case errors.As(err, &rejectErr):
+		log.Warnf("Rejected transaction %x from %s: %s", txID, from, err)
+	default:
+		log.Errorf("Failed to add transaction %x from %s to the memory pool: %s", txID, from, err)
 	}
 }
 func (net *Network) MineTx(memopoolTxs map[string]blockchain.Transaction) {
-	var txs []*blockchain.Transaction
+	var candidates []*blockchain.Transaction
 	log.Infof("MINE: %d", len(memopoolTxs))
-	chain := net.Blockchain.ContinueBlockchain()
+	chain := net.Blockchain
 
 	for id := range memopoolTxs {
 		log.Infof("tx: %s \n", memopoolTxs[id].ID)
-		tx := memopoolTxs[id]
-
-		log.Info("tx vailidity: ", chain.VerifyTransaction(&tx))
-		if chain.VerifyTransaction(&tx) {
-			txs = append(txs, &tx)
+		// Unconfirmed parents are mined along
+		for _, ancestor := range memoryPool.Ancestors(id) {
+			if _, ok := memopoolTxs[hex.EncodeToString(ancestor.ID)]; !ok {
+				ancestor := ancestor
+				candidates = append(candidates, &ancestor)
+			}
 		}
+		tx := memopoolTxs[id]
+		candidates = append(candidates, &tx)
 	}
 
-	if len(txs) == 0 {
+	// Highest package fee rate first, invalid transactions are left out
+	txs, err := chain.AssembleBlock(MinerAddress, candidates)
+	if err != nil {
+		log.Errorf("Failed to assemble a block: %s", err)
+		return
+	}
+	if len(txs) == 1 {
 		log.Info("No valid Transaction")
 	}
 
-	cbTx := blockchain.MinerTx(MinerAddress, "")
-	txs = append(txs, cbTx)
-	newBlock := chain.MineBlock(txs)
-	UTXOs := blockchain.UXTOSet{chain}
-	UTXOs.Compute()
-
+	newBlock, err := chain.MineBlock(txs)
+	if err != nil {
+		log.Errorf("Failed to mine a block: %s", err)
+		return
+	}
 	log.Info("New Block Mined")
 
 	net.SendInv("", "block", [][]byte{newBlock.Hash})
-	memoryPool.ClearAll()
-	memoryPool.Wg.Done()
+	// A block of a peer may have taken the tip meanwhile
+	if bytes.Equal(chain.LastHash, newBlock.Hash) {
+		memoryPool.RemoveBlock(newBlock)
+	}
 }
 
 func (net *Network) BelongsToMiningGroup(PeerId string) bool {
@@ -397,13 +471,10 @@ func (net *Network) MinersEventLoop() {
 			payload := GobEncode(tnx)
 			request := append(CmdToBytes("gettxfrompool"), payload...)
 			net.FullNodesChannel.Publish("Request transaction from pool", request, "")
-			memoryPool.Wg.Add(1)
 		}
 	}
 }
 func StartNode(chain *blockchain.Blockchain, listenPort, minerAddress string, miner, fullNode bool, callback func(*Network)) {
-	var r io.Reader
-	r = rand.Reader
 	MinerAddress = minerAddress
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -411,8 +482,20 @@ func StartNode(chain *blockchain.Blockchain, listenPort, minerAddress string, mi
 	defer chain.Database.Close()
 	go appUtils.CloseDB(chain)
 
-	// Creates a new RSA key pair for this host.
-	prvKey, _, err := crypto.GenerateKeyPairWithReader(crypto.RSA, 2048, r)
+	memoryPool = memopool.New(chain, memopool.Policy{
+		MaxTxSize:       config.Active.Mempool.MaxTxSize,
+		MinRelayFeeRate: blockchain.Amount(config.Active.Mempool.MinRelayFeeRate),
+		MaxPoolSize:     config.Active.Mempool.MaxSizeMB << 20,
+		Expiry:          time.Duration(config.Active.Mempool.ExpiryHours) * time.Hour,
+		ReplaceByFee:    config.Active.Mempool.ReplaceByFee,
+		MaxAncestors:    config.Active.Mempool.MaxAncestors,
+		MaxDescendants:  config.Active.Mempool.MaxDescendants,
+	})
+	if persistMempool() {
+		loadMempool(chain.InstanceId)
+	}
+
+	prvKey, err := loadNodeKey(chain.InstanceId)
 	if err != nil {
 		panic(err)
 	}
@@ -486,8 +569,15 @@ func StartNode(chain *blockchain.Blockchain, listenPort, minerAddress string, mi
 		Blockchain:       chain,
 		Blocks:           make(chan *blockchain.Block, 200),
 		Transactions:     make(chan *blockchain.Transaction, 200),
+		Mempool:          memoryPool,
 		Miner:            miner,
 	}
+	if persistMempool() {
+		// Before the deferred close of the database, and on interrupts
+		defer saveMempool(network)
+		appUtils.OnShutdown(func() { saveMempool(network) })
+	}
+	chain.OnReorg(network.HandleReorg)
 	callback(network)
 	err = RequestBlocks(network)
 
@@ -502,17 +592,36 @@ func StartNode(chain *blockchain.Blockchain, listenPort, minerAddress string, mi
 		panic(err)
 	}
 	if err = ui.Run(network); err != nil {
-		log.Error("error running text UI: %s", err)
+		log.Errorf("error running text UI: %s", err)
 	}
 }
 
 func HandleEvents(net *Network) {
+	expiryTicker := time.NewTicker(time.Minute)
+	defer expiryTicker.Stop()
+	var saveTick <-chan time.Time
+	if persistMempool() {
+		saveTicker := time.NewTicker(time.Duration(config.Active.Mempool.SaveIntervalMinutes) * time.Minute)
+		defer saveTicker.Stop()
+		saveTick = saveTicker.C
+	}
+
 	for {
 		select {
+		case <-saveTick:
+			saveMempool(net)
+		case <-expiryTicker.C:
+			if expired := memoryPool.Expire(); expired > 0 {
+				log.Infof("Expired %d transactions from the memory pool", expired)
+			}
 		case block := <-net.Blocks:
 			net.SendBlock("", block)
 		case tnx := <-net.Transactions:
-			// mine := false
+			// Only relay what our own pool accepts
+			if err := memoryPool.Add(*tnx); err != nil {
+				logRejection(tnx.ID, net.Host.ID().Pretty(), err)
+				continue
+			}
 			net.SendTx("", tnx)
 		}
 	}
@@ -525,6 +634,12 @@ func RequestBlocks(net *Network) error {
 	}
 	return nil
 }
+
+// Nodes of a network only meet nodes of the same network
+func rendezvous() string {
+	return "rendezvous:" + params.Active.Name
+}
+
 func SetupDiscovery(ctx context.Context, host host.Host) error {
 
 	// Start a DHT, for use in peer discovery. We can't just make a new DHT
@@ -565,13 +680,13 @@ func SetupDiscovery(ctx context.Context, host host.Host) error {
 	// This is like telling your friends to meet you at the Eiffel Tower.
 	log.Info("Announcing ourselves...")
 	routingDiscovery := discovery.NewRoutingDiscovery(kademliaDHT)
-	discovery.Advertise(ctx, routingDiscovery, "rendezvous")
+	discovery.Advertise(ctx, routingDiscovery, rendezvous())
 	log.Info("Successfully announced!")
 
 	// Now, look for others who have announced
 	// This is like your friend telling you the location to meet you.
 	log.Info("Searching for other peers...")
-	peerChan, err := routingDiscovery.FindPeers(ctx, "rendezvous")
+	peerChan, err := routingDiscovery.FindPeers(ctx, rendezvous())
 	if err != nil {
 		panic(err)
 	}
@@ -0,0 +1,49 @@
+package p2p
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	log "github.com/sirupsen/logrus"
+	"github.com/workspace/the-crypto-project/util/datadir"
+)
+
+// loadNodeKey returns the identity key of the instance from the data
+// directory, a new key is made and saved on the first start so the peer ID
+// stays the same across restarts
+func loadNodeKey(instanceId string) (crypto.PrivKey, error) {
+	keyFile := datadir.NodeKey(instanceId)
+	data, err := ioutil.ReadFile(keyFile)
+	if err == nil {
+		key, err := crypto.UnmarshalPrivateKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("node key %s: %w", keyFile, err)
+		}
+		return key, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	// Creates a new RSA key pair for this host.
+	key, _, err := crypto.GenerateKeyPairWithReader(crypto.RSA, 2048, rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	data, err = crypto.MarshalPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(keyFile), 0700); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(keyFile, data, 0600); err != nil {
+		return nil, err
+	}
+	log.Infof("Created node key %s", keyFile)
+	return key, nil
+}
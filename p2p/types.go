@@ -3,6 +3,7 @@ package p2p
 import (
 	"github.com/libp2p/go-libp2p-core/host"
 	blockchain "github.com/workspace/the-crypto-project/core"
+	"github.com/workspace/the-crypto-project/memopool"
 )
 
 type Network struct {
@@ -13,6 +14,7 @@ type Network struct {
 	Blockchain       *blockchain.Blockchain
 	Blocks           chan *blockchain.Block
 	Transactions     chan *blockchain.Transaction
+	Mempool          *memopool.MemoPool
 	Miner            bool
 }
 
@@ -0,0 +1,159 @@
+package params
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// ChainParams holds everything that tells one network apart from another.
+// Nodes only accept blocks, addresses and peer messages of the network they
+// were started on.
+type ChainParams struct {
+	// Name of the network, selected with the --network flag
+	Name string
+	// Prepended to every P2P message, messages of other networks are dropped
+	Magic [4]byte
+	// First byte of the wallet addresses of the network
+	AddressVersion byte
+	// Directory in the data directory holding the files of the network,
+	// empty for the main network
+	DataDir string
+	// Coinbase data of the genesis block
+	GenesisData string
+	// Timestamp, nonce and payee of the genesis block, with GenesisData
+	// they make up the whole block. Nobody holds the key of the payee, the
+	// genesis reward can't be spent.
+	GenesisTime       int64
+	GenesisNonce      uint64
+	GenesisPubKeyHash []byte
+	// Hash of the genesis block, peers sending any other genesis are
+	// rejected. Empty on networks where every chain mines its own genesis
+	// paying the address it is initialized with.
+	GenesisHash []byte
+
+	// Easiest target a block may have
+	PowLimit *big.Int
+	// Number of blocks between two difficulty adjustments, 0 never adjusts
+	RetargetInterval int
+	// Time in seconds we want between two blocks
+	TargetBlockTime int64
+	// Largest factor the target may move by in a single adjustment
+	MaxRetargetFactor int64
+
+	// Subsidy, in base units, paid to the miner of the first blocks
+	InitialSubsidy int64
+	// Number of blocks between two halvings of the subsidy
+	SubsidyHalvingInterval int
+	// Number of blocks a coinbase must be buried under before its outputs
+	// can be spent
+	CoinbaseMaturity int
+}
+
+const baseUnitsPerCoin = 100000000
+
+// mustHex decodes a hash written in the source
+func mustHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// powLimit returns 2^bits - 1
+func powLimit(bits uint) *big.Int {
+	return new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), bits), big.NewInt(1))
+}
+
+var (
+	// The network real value is exchanged on
+	MainNet = ChainParams{
+		Name:           "main",
+		Magic:          [4]byte{0xd3, 0x4e, 0x07, 0x01},
+		AddressVersion: 0x00,
+		DataDir:        "",
+		GenesisData:    "genesis",
+
+		GenesisTime:       1600000000,
+		GenesisNonce:      25,
+		GenesisPubKeyHash: make([]byte, 20),
+		GenesisHash:       mustHex("0755d7e8b595813ce75667a7f153bf6dcfb55c01e1b76916547228810710a315"),
+
+		// 5 leading zero bits
+		PowLimit:          powLimit(251),
+		RetargetInterval:  10,
+		TargetBlockTime:   30,
+		MaxRetargetFactor: 4,
+
+		InitialSubsidy:         20 * baseUnitsPerCoin,
+		SubsidyHalvingInterval: 525000,
+		CoinbaseMaturity:       10,
+	}
+
+	// A public network for testing with coins of no value
+	TestNet = ChainParams{
+		Name:           "test",
+		Magic:          [4]byte{0xd3, 0x4e, 0x07, 0x02},
+		AddressVersion: 0x6f,
+		DataDir:        "testnet",
+		GenesisData:    "testnet genesis",
+
+		GenesisTime:       1600000000,
+		GenesisNonce:      50,
+		GenesisPubKeyHash: make([]byte, 20),
+		GenesisHash:       mustHex("0365a44f5e77b464b6eb2e9fe5f1f102951c184a3cb9e40caf6cb83aab4a34ae"),
+
+		PowLimit:          powLimit(251),
+		RetargetInterval:  10,
+		TargetBlockTime:   30,
+		MaxRetargetFactor: 4,
+
+		InitialSubsidy:         20 * baseUnitsPerCoin,
+		SubsidyHalvingInterval: 525000,
+		CoinbaseMaturity:       10,
+	}
+
+	// A local network for development and CI, blocks are mined instantly,
+	// the difficulty never changes and rewards mature fast
+	RegTest = ChainParams{
+		Name:           "regtest",
+		Magic:          [4]byte{0xd3, 0x4e, 0x07, 0x03},
+		AddressVersion: 0x3c,
+		DataDir:        "regtest",
+		// No pinned genesis, each chain mines its own paying the address it
+		// is initialized with and the other nodes sync it
+		GenesisData: "regtest genesis",
+
+		// 1 leading zero bit
+		PowLimit:          powLimit(255),
+		RetargetInterval:  0,
+		TargetBlockTime:   30,
+		MaxRetargetFactor: 4,
+
+		InitialSubsidy:         20 * baseUnitsPerCoin,
+		SubsidyHalvingInterval: 150,
+		CoinbaseMaturity:       2,
+	}
+
+	// Networks by name
+	Networks = map[string]*ChainParams{
+		MainNet.Name: &MainNet,
+		TestNet.Name: &TestNet,
+		RegTest.Name: &RegTest,
+	}
+
+	// Parameters of the network the node runs on
+	Active = &MainNet
+)
+
+// Select makes the network with the given name the active one
+func Select(name string) error {
+	p, ok := Networks[strings.ToLower(name)]
+	if !ok {
+		return fmt.Errorf("unknown network %q, expected one of main, test or regtest", name)
+	}
+	Active = p
+	return nil
+}
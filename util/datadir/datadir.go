@@ -0,0 +1,139 @@
+// Package datadir locates the files of a node. Everything a node writes
+// lives under one data directory, chosen with --datadir or the DEMON_DATADIR
+// environment variable and defaulting to a per-user directory:
+//
+//	<datadir>/
+//	    config.yaml                 node configuration
+//	    blocks/                     chain database of the default instance
+//	    blocks_<INSTANCE_ID>/       chain database of an instance
+//	    wallets.dat                 wallets
+//	    nodekey[_<INSTANCE_ID>]     P2P identity key
+//	    mempool[_<INSTANCE_ID>].dat memory pool saved across restarts
+//	    logs/console[_<INSTANCE_ID>].log
+//	    testnet/                    same layout, without config.yaml, for
+//	    regtest/                    the other networks
+//
+// The main network uses the data directory itself, the other networks the
+// directory named by params.ChainParams.DataDir inside it.
+package datadir
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/workspace/the-crypto-project/params"
+)
+
+// EnvVar names the environment variable overriding the default directory
+const EnvVar = "DEMON_DATADIR"
+
+// Directory set with Set, empty until then
+var dir string
+
+// Default returns the data directory used when none is given:
+// %APPDATA%\Demon on Windows, ~/Library/Application Support/Demon on macOS
+// and ~/.demon elsewhere
+func Default() string {
+	if runtime.GOOS == "windows" {
+		if appData := os.Getenv("APPDATA"); appData != "" {
+			return filepath.Join(appData, "Demon")
+		}
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		// No home directory, e.g. a service account, use the working one
+		return ".demon"
+	}
+	if runtime.GOOS == "darwin" {
+		return filepath.Join(home, "Library", "Application Support", "Demon")
+	}
+	return filepath.Join(home, ".demon")
+}
+
+// Set selects the data directory, an empty path falls back to EnvVar then
+// to Default. The directory is created by Create if it doesn't exist.
+func Set(path string) error {
+	if path == "" {
+		path = os.Getenv(EnvVar)
+	}
+	if path == "" {
+		path = Default()
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return fmt.Errorf("data directory %s: %w", path, err)
+	}
+	if info, err := os.Stat(abs); err == nil && !info.IsDir() {
+		return fmt.Errorf("data directory %s is not a directory", abs)
+	} else if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("data directory %s: %w", abs, err)
+	}
+	dir = abs
+	return nil
+}
+
+// Dir returns the data directory
+func Dir() string {
+	if dir == "" {
+		// Nothing called Set, honour the environment all the same
+		if err := Set(""); err != nil {
+			return Default()
+		}
+	}
+	return dir
+}
+
+// Network returns the directory of the active network
+func Network() string {
+	return filepath.Join(Dir(), params.Active.DataDir)
+}
+
+// Create makes the directories of the active network, nodes call it on
+// start so the first run sets the layout up. The data directory holds
+// private keys and is only readable by its owner.
+func Create() error {
+	if err := os.MkdirAll(Dir(), 0700); err != nil {
+		return err
+	}
+	return os.MkdirAll(filepath.Join(Network(), "logs"), 0700)
+}
+
+func instanceName(name, instanceId string) string {
+	if instanceId == "" {
+		return name
+	}
+	return fmt.Sprintf("%s_%s", name, instanceId)
+}
+
+// ChainDB returns the directory of the chain database of an instance
+func ChainDB(instanceId string) string {
+	return filepath.Join(Network(), instanceName("blocks", instanceId))
+}
+
+// WalletsFile returns the file holding the wallets of the network, shared
+// by every instance
+func WalletsFile() string {
+	return filepath.Join(Network(), "wallets.dat")
+}
+
+// NodeKey returns the file holding the P2P identity of an instance
+func NodeKey(instanceId string) string {
+	return filepath.Join(Network(), instanceName("nodekey", instanceId))
+}
+
+// MempoolFile returns the file the memory pool of an instance is saved to
+func MempoolFile(instanceId string) string {
+	return filepath.Join(Network(), instanceName("mempool", instanceId)+".dat")
+}
+
+// LogFile returns the log file of an instance
+func LogFile(instanceId string) string {
+	return filepath.Join(Network(), "logs", instanceName("console", instanceId)+".log")
+}
+
+// ConfigFile returns the configuration file, shared by every network
+func ConfigFile() string {
+	return filepath.Join(Dir(), "config.yaml")
+}
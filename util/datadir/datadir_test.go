@@ -0,0 +1,61 @@
+package datadir
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSet(t *testing.T) {
+	root := t.TempDir()
+	file := filepath.Join(root, "file")
+	if err := ioutil.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	old, ok := os.LookupEnv(EnvVar)
+	defer func() {
+		if ok {
+			os.Setenv(EnvVar, old)
+		} else {
+			os.Unsetenv(EnvVar)
+		}
+		dir = ""
+	}()
+
+	for _, test := range []struct {
+		name, path, env string
+		want            string
+		fails           bool
+	}{
+		{name: "flag", path: root, env: filepath.Join(root, "env"), want: root},
+		{name: "environment", env: filepath.Join(root, "env"), want: filepath.Join(root, "env")},
+		{name: "default", want: Default()},
+		{name: "missing directory", path: filepath.Join(root, "new", "dir"), want: filepath.Join(root, "new", "dir")},
+		{name: "file", path: file, fails: true},
+		{name: "file from the environment", env: file, fails: true},
+		{name: "below a file", path: filepath.Join(file, "dir"), fails: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if test.env == "" {
+				os.Unsetenv(EnvVar)
+			} else {
+				os.Setenv(EnvVar, test.env)
+			}
+			dir = ""
+			err := Set(test.path)
+			if test.fails {
+				if err == nil {
+					t.Fatalf("%s was accepted", Dir())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want, _ := filepath.Abs(test.want); Dir() != want {
+				t.Fatalf("data directory %s, want %s", Dir(), want)
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package datadir
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/workspace/the-crypto-project/params"
+)
+
+// Earlier versions kept the chain and the wallets of a network in the tmp/
+// directory of the checkout they ran from, the wallet binary kept its
+// wallets in the working directory. `demon import` copies them into the
+// data directory, the originals are left alone.
+
+// DefaultLegacyDir is where `demon import` looks when no directory is
+// given, relative to the working directory
+const DefaultLegacyDir = "tmp"
+
+// LegacyChainDB returns the chain database of an instance under dir, a
+// directory earlier versions wrote to
+func LegacyChainDB(dir, instanceId string) string {
+	return filepath.Join(dir, params.Active.DataDir, instanceName("blocks", instanceId))
+}
+
+// LegacyWalletsFile returns the wallets file under dir, a directory earlier
+// versions wrote to
+func LegacyWalletsFile(dir string) string {
+	return filepath.Join(dir, params.Active.DataDir, ".data")
+}
+
+// Copy copies the file or directory from to the path to, which must not
+// exist yet. A copy that fails partway is removed.
+func Copy(from, to string) error {
+	if _, err := os.Lstat(to); !os.IsNotExist(err) {
+		return fmt.Errorf("%s already exists", to)
+	}
+	if err := os.MkdirAll(filepath.Dir(to), 0700); err != nil {
+		return err
+	}
+	err := filepath.Walk(from, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(from, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(to, rel)
+		if info.IsDir() {
+			return os.MkdirAll(target, 0700)
+		}
+		if !info.Mode().IsRegular() {
+			return fmt.Errorf("%s is not a regular file", path)
+		}
+		return copyFile(path, target)
+	})
+	if err != nil {
+		os.RemoveAll(to)
+	}
+	return err
+}
+
+func copyFile(from, to string) error {
+	in, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	// The copy must be on disk before the caller relies on it
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,45 @@
+package datadir
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCopy(t *testing.T) {
+	root := t.TempDir()
+	from := filepath.Join(root, "tmp", "blocks_1")
+	if err := os.MkdirAll(filepath.Join(from, "sub"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{"MANIFEST": "manifest", filepath.Join("sub", "000001.vlog"): "values"}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(from, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	to := filepath.Join(root, "datadir", "blocks_1")
+	if err := Copy(from, to); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		for _, dir := range []string{from, to} {
+			if data, err := ioutil.ReadFile(filepath.Join(dir, name)); err != nil || string(data) != content {
+				t.Fatalf("%s holds %q: %v", filepath.Join(dir, name), data, err)
+			}
+		}
+	}
+
+	// What is there already is never replaced
+	if err := ioutil.WriteFile(filepath.Join(from, "MANIFEST"), []byte("older"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := Copy(from, to); err == nil {
+		t.Fatal("copied over an existing database")
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(to, "MANIFEST")); string(data) != "manifest" {
+		t.Fatalf("the existing database holds %q", data)
+	}
+}
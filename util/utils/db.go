@@ -3,17 +3,46 @@ package utils
 import (
 	"os"
 	"runtime"
+	"sync"
 	"syscall"
 
 	blockchain "github.com/workspace/the-crypto-project/core"
 	"gopkg.in/vrecan/death.v3"
 )
 
+var (
+	shutdownMu    sync.Mutex
+	shutdownHooks []func()
+	shutdownOnce  sync.Once
+)
+
+// OnShutdown registers fn to run when the process is interrupted, before
+// the chain database closes
+func OnShutdown(fn func()) {
+	shutdownMu.Lock()
+	defer shutdownMu.Unlock()
+	shutdownHooks = append(shutdownHooks, fn)
+}
+
+// runShutdownHooks runs the registered hooks once, however many handlers
+// caught the signal. The others wait for them to finish.
+func runShutdownHooks() {
+	shutdownOnce.Do(func() {
+		shutdownMu.Lock()
+		hooks := shutdownHooks
+		shutdownMu.Unlock()
+		for _, fn := range hooks {
+			fn()
+		}
+	})
+}
+
 func CloseDB(chain *blockchain.Blockchain) {
 	d := death.NewDeath(syscall.SIGINT, syscall.SIGTERM, os.Interrupt)
 	d.WaitForDeathWithFunc(func() {
 		defer os.Exit(1)
 		defer runtime.Goexit()
+		runShutdownHooks()
 		chain.Database.Close()
 	})
 }
@@ -1,25 +1,29 @@
 package utils
 
 import (
-	"fmt"
 	"time"
 
 	"github.com/mattn/go-colorable"
 	log "github.com/sirupsen/logrus"
 	"github.com/snowzach/rotatefilehook"
+	"github.com/workspace/the-crypto-project/config"
+	"github.com/workspace/the-crypto-project/util/datadir"
 )
 
+// SetLog logs to the console and to the log file of the instance in the
+// data directory, as the log section of the configuration tells
 func SetLog(instanceId string) {
-	var logLevel = log.InfoLevel
-	filename := "../../logs/console.log"
-	if instanceId != "" {
-		filename = fmt.Sprintf("../../logs/console_%s.log", instanceId)
+	conf := config.Active.Log
+	logLevel, err := log.ParseLevel(conf.Level)
+	if err != nil {
+		log.Fatalf("Invalid log level: %v", err)
 	}
+	filename := datadir.LogFile(instanceId)
 	rotateFileHook, err := rotatefilehook.NewRotateFileHook(rotatefilehook.RotateFileConfig{
 		Filename:   filename,
-		MaxSize:    50, // megabytes
-		MaxBackups: 3,
-		MaxAge:     28, //days
+		MaxSize:    conf.MaxSizeMB,
+		MaxBackups: conf.MaxBackups,
+		MaxAge:     conf.MaxAgeDays,
 		Level:      logLevel,
 		Formatter: &log.JSONFormatter{
 			TimestampFormat: time.RFC822,
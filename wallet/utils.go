@@ -1,7 +1,7 @@
 package wallet
 
 import (
-	"log"
+	"fmt"
 
 	"github.com/mr-tron/base58"
 )
@@ -12,10 +12,10 @@ func Base58Encode(input []byte) []byte {
 	return []byte(encode)
 }
 
-func Base58Decode(input []byte) []byte {
+func Base58Decode(input []byte) ([]byte, error) {
 	decode, err := base58.Decode(string(input[:]))
 	if err != nil {
-		log.Panic(err)
+		return nil, fmt.Errorf("decoding base58: %w", err)
 	}
-	return decode
+	return decode, nil
 }
@@ -6,17 +6,22 @@ import (
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
+	"errors"
+	"fmt"
 
-	log "github.com/sirupsen/logrus"
-	"github.com/workspace/the-crypto-project/util/env"
+	"github.com/workspace/the-crypto-project/config"
+	"github.com/workspace/the-crypto-project/params"
 	"golang.org/x/crypto/ripemd160"
 )
 
-var conf = env.New()
-var (
-	checkSumlength = conf.WalletAddressChecksum
-	version        = byte(0x00) // hexadecimal representation of zero
-)
+// ErrInvalidAddress is returned for malformed addresses, addresses with a
+// bad checksum and addresses of other networks
+var ErrInvalidAddress = errors.New("invalid address")
+
+// checkSumlength returns the bytes of checksum at the end of an address
+func checkSumlength() int {
+	return config.Active.Wallet.AddressChecksum
+}
 
 // https://golang.org/pkg/crypto/ecdsa/
 type Wallet struct {
@@ -25,26 +30,32 @@ type Wallet struct {
 	PublicKey  []byte
 }
 
-// Validate Wallet Address
+// Validate Wallet Address, addresses of other networks are invalid
 func ValidateAddress(address string) bool {
 
 	if len(address) != 34 {
 		return false
 	}
 	//Convert the address to public key hash
-	fullHash := Base58Decode([]byte(address))
+	fullHash, err := Base58Decode([]byte(address))
+	if err != nil || len(fullHash) <= 1+checkSumlength() {
+		return false
+	}
 	// Get the checkSum from Address
-	checkSumFromHash := fullHash[len(fullHash)-checkSumlength:]
+	checkSumFromHash := fullHash[len(fullHash)-checkSumlength():]
 	//Get the version
 	version := fullHash[0]
-	pubKeyHash := fullHash[1 : len(fullHash)-checkSumlength]
+	if version != params.Active.AddressVersion {
+		return false
+	}
+	pubKeyHash := fullHash[1 : len(fullHash)-checkSumlength()]
 	checkSum := CheckSum(append([]byte{version}, pubKeyHash...))
 
 	return bytes.Compare(checkSum, checkSumFromHash) == 0
 }
 func (w *Wallet) Address() []byte {
 	pubHash := PublicKeyHash(w.PublicKey)
-	versionedHash := append([]byte{version}, pubHash...)
+	versionedHash := append([]byte{params.Active.AddressVersion}, pubHash...)
 	checksum := CheckSum(versionedHash)
 	//version-publickeyHash-checksum
 	fullHash := append(versionedHash, checksum...)
@@ -54,33 +65,42 @@ func (w *Wallet) Address() []byte {
 }
 
 // Generate new Key Pair using ecdsa
-func NewKeyPair() (ecdsa.PrivateKey, []byte) {
+func NewKeyPair() (ecdsa.PrivateKey, []byte, error) {
 	curve := elliptic.P256()
 
 	private, err := ecdsa.GenerateKey(curve, rand.Reader)
 	if err != nil {
-		log.Panic(err)
+		return ecdsa.PrivateKey{}, nil, fmt.Errorf("generating key pair: %w", err)
 	}
 
-	pub := append(private.PublicKey.X.Bytes(), private.PublicKey.Y.Bytes()...)
+	return *private, EncodePublicKey(private.PublicKey), nil
+}
 
-	return *private, pub
+// EncodePublicKey returns the 32 byte X of a P-256 key followed by its 32
+// byte Y. Verifiers split the key in halves, so both are padded with
+// leading zeros. Keys used to be encoded without the padding, 1 in 128 of
+// them came out shorter and the ones with a short Y couldn't sign anything
+// valid. Wallets keep the key they were created with, their addresses
+// don't change.
+func EncodePublicKey(pub ecdsa.PublicKey) []byte {
+	return append(pub.X.FillBytes(make([]byte, 32)), pub.Y.FillBytes(make([]byte, 32))...)
 }
 
-func MakeWallet() *Wallet {
-	private, public := NewKeyPair()
-	return &Wallet{private, public}
+func MakeWallet() (*Wallet, error) {
+	private, public, err := NewKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	return &Wallet{private, public}, nil
 }
 
 func PublicKeyHash(pubKey []byte) []byte {
 	//generate a hash using sha256
 	pubHash := sha256.Sum256(pubKey)
 
+	// Writing to a hash never fails
 	hasher := ripemd160.New()
-	_, err := hasher.Write(pubHash[:])
-	if err != nil {
-		log.Panic(err)
-	}
+	hasher.Write(pubHash[:])
 
 	// Re-hash the genrated sha256 using ripemd160
 	publicRipMd := hasher.Sum(nil)
@@ -91,5 +111,5 @@ func CheckSum(data []byte) []byte {
 	firstHash := sha256.Sum256(data)
 	secondHash := sha256.Sum256(firstHash[:])
 
-	return secondHash[:checkSumlength]
+	return secondHash[:checkSumlength()]
 }
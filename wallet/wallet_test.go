@@ -0,0 +1,52 @@
+package wallet
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"math/big"
+	"testing"
+)
+
+// Verifiers split a public key in halves, keys whose X or Y has leading
+// zero bytes must split into the same point
+func TestEncodePublicKeyLeadingZeros(t *testing.T) {
+	digest := sha256.Sum256([]byte("message"))
+	short := map[string]bool{}
+	for i := 0; i < 20000 && len(short) < 2; i++ {
+		private, pub, err := NewKeyPair()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var coordinate string
+		switch {
+		case len(private.PublicKey.X.Bytes()) < 32:
+			coordinate = "X"
+		case len(private.PublicKey.Y.Bytes()) < 32:
+			coordinate = "Y"
+		default:
+			continue
+		}
+		short[coordinate] = true
+
+		if len(pub) != 64 {
+			t.Fatalf("key with a short %s encoded in %d bytes", coordinate, len(pub))
+		}
+		x := new(big.Int).SetBytes(pub[:len(pub)/2])
+		y := new(big.Int).SetBytes(pub[len(pub)/2:])
+		if x.Cmp(private.PublicKey.X) != 0 || y.Cmp(private.PublicKey.Y) != 0 {
+			t.Fatalf("key with a short %s splits into another point", coordinate)
+		}
+		r, s, err := ecdsa.Sign(rand.Reader, &private, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ecdsa.Verify(&ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, digest[:], r, s) {
+			t.Fatalf("signature of a key with a short %s doesn't verify", coordinate)
+		}
+	}
+	if !short["X"] || !short["Y"] {
+		t.Fatalf("keys with a short coordinate %v, want one with a short X and one with a short Y", short)
+	}
+}
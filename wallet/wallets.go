@@ -4,33 +4,21 @@ import (
 	"bytes"
 	"crypto/elliptic"
 	"encoding/gob"
-	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
-	"path"
 	"path/filepath"
-	"runtime"
 
-	log "github.com/sirupsen/logrus"
-)
-
-var (
-	_, b, _, _ = runtime.Caller(0)
-
-	// Root folder of this project
-	Root            = filepath.Join(filepath.Dir(b), "../")
-	walletsPath     = path.Join(Root, "/tmp/")
-	walletsFilename = ".data"
+	"github.com/workspace/the-crypto-project/util/datadir"
 )
 
 type Wallets struct {
 	Wallets map[string]*Wallet
 }
 
-func InitializeWallets(cwd bool) (*Wallets, error) {
+func InitializeWallets() (*Wallets, error) {
 	wallets := Wallets{map[string]*Wallet{}}
-	err := wallets.LoadFile(cwd)
+	err := wallets.LoadFile()
 
 	return &wallets, err
 }
@@ -39,19 +27,22 @@ func (ws *Wallets) GetWallet(address string) (Wallet, error) {
 	var ok bool
 	w := *ws
 	if wallet, ok = w.Wallets[address]; !ok {
-		return *new(Wallet), errors.New("Invalid address")
+		return *new(Wallet), fmt.Errorf("%w: no wallet for %s", ErrInvalidAddress, address)
 	}
 
 	return *wallet, nil
 }
 
-func (ws *Wallets) AddWallet() string {
-	wallet := MakeWallet()
+func (ws *Wallets) AddWallet() (string, error) {
+	wallet, err := MakeWallet()
+	if err != nil {
+		return "", err
+	}
 	address := fmt.Sprintf("%s", wallet.Address())
 
 	ws.Wallets[address] = wallet
 
-	return address
+	return address, nil
 }
 func (ws *Wallets) GetAllAddress() []string {
 	var addresses []string
@@ -60,17 +51,14 @@ func (ws *Wallets) GetAllAddress() []string {
 	}
 	return addresses
 }
-func (ws *Wallets) LoadFile(cwd bool) error {
-	walletsFile := path.Join(walletsPath, walletsFilename)
-
-	if cwd {
-		dir, err := os.Getwd()
-		if err != nil {
-			log.Fatal(err)
-		}
-		walletsFile = path.Join(dir, walletsFilename)
-	}
 
+// LoadFile reads the wallets of the network from the data directory
+func (ws *Wallets) LoadFile() error {
+	return ws.ReadFile(datadir.WalletsFile())
+}
+
+// ReadFile reads the wallets of a wallets file
+func (ws *Wallets) ReadFile(walletsFile string) error {
 	if _, err := os.Stat(walletsFile); os.IsNotExist(err) {
 		return err
 	}
@@ -91,28 +79,19 @@ func (ws *Wallets) LoadFile(cwd bool) error {
 
 	return nil
 }
-func (ws *Wallets) SaveFile(cwd bool) {
-	walletsFile := path.Join(walletsPath, walletsFilename)
-
-	if cwd {
-		dir, err := os.Getwd()
-		if err != nil {
-			log.Fatal(err)
-		}
-		walletsFile = path.Join(dir, walletsFilename)
+func (ws *Wallets) SaveFile() error {
+	walletsFile := datadir.WalletsFile()
+	if err := os.MkdirAll(filepath.Dir(walletsFile), 0700); err != nil {
+		return err
 	}
 	var content bytes.Buffer
 
 	gob.Register(elliptic.P256())
 
 	encoder := gob.NewEncoder(&content)
-	err := encoder.Encode(ws)
-	if err != nil {
-		log.Panic(err)
+	if err := encoder.Encode(ws); err != nil {
+		return fmt.Errorf("encoding wallets: %w", err)
 	}
 
-	err = ioutil.WriteFile(walletsFile, content.Bytes(), 0644)
-	if err != nil {
-		log.Panic(err)
-	}
+	return ioutil.WriteFile(walletsFile, content.Bytes(), 0600)
 }